@@ -1,6 +1,7 @@
 package rootless
 
 import (
+	"context"
 	"io/ioutil"
 	"net"
 	"os"
@@ -9,11 +10,11 @@ import (
 	"strings"
 
 	"github.com/pkg/errors"
-	"github.com/rootless-containers/rootlesskit/pkg/child"
-	"github.com/rootless-containers/rootlesskit/pkg/copyup/tmpfssymlink"
-	"github.com/rootless-containers/rootlesskit/pkg/network/slirp4netns"
-	"github.com/rootless-containers/rootlesskit/pkg/parent"
-	"github.com/rootless-containers/rootlesskit/pkg/port/socat"
+	"github.com/rancher/k3s/pkg/rootlesskit/child"
+	"github.com/rancher/k3s/pkg/rootlesskit/copyup/tmpfssymlink"
+	"github.com/rancher/k3s/pkg/rootlesskit/network/slirp4netns"
+	"github.com/rancher/k3s/pkg/rootlesskit/parent"
+	"github.com/rancher/k3s/pkg/rootlesskit/port/socat"
 	"github.com/sirupsen/logrus"
 )
 
@@ -38,7 +39,11 @@ func Rootless(stateDir string) error {
 		if err != nil {
 			logrus.Fatal(err)
 		}
-		if err := child.Child(*childOpt); err != nil {
+		if err := child.Child(context.Background(), *childOpt); err != nil {
+			if exitErr, ok := errors.Cause(err).(*child.ExitError); ok {
+				logrus.Debug(exitErr)
+				os.Exit(exitErr.ExitCode)
+			}
 			logrus.Fatal("child died", err)
 		}
 	}
@@ -102,7 +107,10 @@ func createParentOpt(stateDir string) (*parent.Opt, error) {
 	if _, err := exec.LookPath(binary); err != nil {
 		return nil, err
 	}
-	opt.NetworkDriver = slirp4netns.NewParentDriver(binary, mtu, ipnet, disableHostLoopback, "")
+	opt.NetworkDriver, err = slirp4netns.NewParentDriver(binary, mtu, ipnet, disableHostLoopback, "", false, "")
+	if err != nil {
+		return nil, err
+	}
 	opt.PortDriver, err = socat.NewParentDriver(&logrusDebugWriter{})
 	if err != nil {
 		return nil, err
@@ -14,7 +14,7 @@ import (
 	"github.com/pkg/errors"
 	"golang.org/x/net/context/ctxhttp"
 
-	"github.com/rootless-containers/rootlesskit/pkg/port"
+	"github.com/rancher/k3s/pkg/rootlesskit/port"
 )
 
 type Client interface {
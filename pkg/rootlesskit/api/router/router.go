@@ -9,7 +9,7 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/pkg/errors"
 
-	"github.com/rootless-containers/rootlesskit/pkg/port"
+	"github.com/rancher/k3s/pkg/rootlesskit/port"
 )
 
 type Backend struct {
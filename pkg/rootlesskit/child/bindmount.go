@@ -0,0 +1,73 @@
+package child
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+
+	"github.com/rancher/k3s/pkg/rootlesskit/common"
+)
+
+// BindMount is a bind mount from the host (i.e. the parent mount namespace) into the namespace.
+type BindMount struct {
+	Source   string
+	Target   string
+	ReadOnly bool
+}
+
+// setupBindMounts performs the bind mounts in the order.
+func setupBindMounts(ctx context.Context, bindMounts []BindMount) error {
+	for _, bm := range bindMounts {
+		if err := setupBindMount(ctx, bm); err != nil {
+			return errors.Wrapf(err, "failed to bind-mount %s on %s", bm.Source, bm.Target)
+		}
+	}
+	return nil
+}
+
+func setupBindMount(ctx context.Context, bm BindMount) error {
+	if !filepath.IsAbs(bm.Source) || !filepath.IsAbs(bm.Target) {
+		return errors.New("source and target must be absolute")
+	}
+	st, err := os.Stat(bm.Source)
+	if err != nil {
+		return err
+	}
+	if !common.IsDryRun(ctx) {
+		if err := createBindMountTarget(bm.Target, st.IsDir()); err != nil {
+			return err
+		}
+	}
+	if err := mount(ctx, bm.Source, bm.Target, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+		return err
+	}
+	if !bm.ReadOnly {
+		return nil
+	}
+	// the flags locked by the user namespace need to be preserved on remounting
+	var sfs unix.Statfs_t
+	if err := unix.Statfs(bm.Source, &sfs); err != nil {
+		return errors.Wrapf(err, "statfs %s", bm.Source)
+	}
+	const lockedFlags = unix.MS_NOSUID | unix.MS_NODEV | unix.MS_NOEXEC | unix.MS_NOATIME | unix.MS_NODIRATIME | unix.MS_RELATIME
+	flags := unix.MS_BIND | unix.MS_REMOUNT | unix.MS_RDONLY | (uintptr(sfs.Flags) & lockedFlags)
+	return mount(ctx, "", bm.Target, "", flags, "")
+}
+
+// createBindMountTarget creates the target directory, or the empty target file.
+func createBindMountTarget(target string, dir bool) error {
+	if dir {
+		return os.MkdirAll(target, 0755)
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_RDONLY, 0644)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
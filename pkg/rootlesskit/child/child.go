@@ -0,0 +1,1231 @@
+package child
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+
+	"github.com/rancher/k3s/pkg/rootlesskit/common"
+	"github.com/rancher/k3s/pkg/rootlesskit/copyup"
+	"github.com/rancher/k3s/pkg/rootlesskit/metrics"
+	"github.com/rancher/k3s/pkg/rootlesskit/msgutil"
+	"github.com/rancher/k3s/pkg/rootlesskit/network"
+	"github.com/rancher/k3s/pkg/rootlesskit/port"
+)
+
+func createCmd(ctx context.Context, opt Opt, targetCmd []string) (*exec.Cmd, error) {
+	if len(targetCmd) == 0 {
+		return nil, errors.New("empty command")
+	}
+	var args []string
+	if len(targetCmd) > 1 {
+		args = targetCmd[1:]
+	}
+	cmd := exec.CommandContext(ctx, targetCmd[0], args...)
+	switch opt.StdinMode {
+	case "", StdinInherit:
+		cmd.Stdin = os.Stdin
+	case StdinNull:
+		// os/exec connects the null device
+		cmd.Stdin = nil
+	case StdinClosed:
+		// os/exec connects a pipe that is closed immediately
+		cmd.Stdin = strings.NewReader("")
+	default:
+		return nil, errors.Errorf("unknown stdin mode: %q", opt.StdinMode)
+	}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = createEnv(opt)
+	if opt.WorkingDir != "" {
+		if err := validateWorkingDir(opt.WorkingDir); err != nil {
+			return nil, err
+		}
+		cmd.Dir = opt.WorkingDir
+	}
+	pdeathsig := opt.Pdeathsig
+	if pdeathsig == 0 {
+		pdeathsig = syscall.SIGKILL
+	}
+	// createCmd is called after the privileged setup, so the credential does not affect the setup.
+	cred, err := createCredential(opt)
+	if err != nil {
+		return nil, err
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Pdeathsig:  pdeathsig,
+		Credential: cred,
+		Cloneflags: opt.Cloneflags,
+	}
+	return cmd, nil
+}
+
+// shellWrapScript execs the positional parameters, with $0 as the command name.
+const shellWrapScript = `exec "$0" "$@"`
+
+// wrapShell returns targetCmd wrapped with shell for Opt.ShellWrap.
+// targetCmd is passed as the positional parameters, not in the script, so no quoting is needed.
+func wrapShell(shell, targetCmd []string) []string {
+	if len(shell) == 0 || len(targetCmd) == 0 {
+		return targetCmd
+	}
+	var wrapped []string
+	wrapped = append(wrapped, shell...)
+	wrapped = append(wrapped, shellWrapScript)
+	return append(wrapped, targetCmd...)
+}
+
+// compatibleCloneflags are the namespaces that can be created for the target command
+// inside the namespaces set up by the child.
+const compatibleCloneflags = unix.CLONE_NEWNS | unix.CLONE_NEWUTS | unix.CLONE_NEWIPC |
+	unix.CLONE_NEWPID | unix.CLONE_NEWNET | unix.CLONE_NEWCGROUP
+
+func validateCloneflags(flags uintptr) error {
+	if flags&unix.CLONE_NEWUSER != 0 {
+		return errors.New("invalid Cloneflags: CLONE_NEWUSER is not supported, as the command would lose the UID/GID mapping and the capabilities")
+	}
+	if extra := flags &^ compatibleCloneflags; extra != 0 {
+		return errors.Errorf("invalid Cloneflags: 0x%x is not a supported namespace flag", extra)
+	}
+	return nil
+}
+
+func validateWorkingDir(dir string) error {
+	st, err := os.Stat(dir)
+	if err != nil {
+		return errors.Wrapf(err, "invalid working directory %s", dir)
+	}
+	if !st.IsDir() {
+		return errors.Errorf("invalid working directory %s: not a directory", dir)
+	}
+	if err := unix.Access(dir, unix.X_OK); err != nil {
+		return errors.Wrapf(err, "working directory %s is not accessible", dir)
+	}
+	return nil
+}
+
+// detectCgroupVersion returns 2 when /sys/fs/cgroup is the cgroup v2 unified hierarchy,
+// otherwise 1.
+func detectCgroupVersion() int {
+	if _, err := os.Stat("/sys/fs/cgroup/cgroup.controllers"); err == nil {
+		return 2
+	}
+	return 1
+}
+
+// SysfsMount specifies whether sysfs is mounted.
+type SysfsMount int
+
+const (
+	// SysfsMountAuto mounts sysfs only when NetworkDriver is set, for /sys/class/net.
+	SysfsMountAuto SysfsMount = iota
+	// SysfsMountAlways mounts sysfs also for HostNetwork, e.g. for a private /sys with copy-up.
+	// Note that the kernel permits mounting sysfs only when the network namespace is owned by the user namespace,
+	// so mountSysfs warns and keeps the host /sys for HostNetwork without a network namespace.
+	SysfsMountAlways
+	// SysfsMountNever does not mount sysfs, even when NetworkDriver is set.
+	// /sys/class/net then shows the network devices of the host, not the tap devices.
+	SysfsMountNever
+)
+
+// SysfsOpt is the option for mounting sysfs.
+// The zero value is for the default behavior.
+type SysfsOpt struct {
+	// Mount defaults to SysfsMountAuto.
+	Mount SysfsMount
+	// ForceReadOnly mounts sysfs as read-only without trying the read-write mount.
+	ForceReadOnly bool
+	// SkipCgroupRbind skips preserving the host /sys/fs/cgroup on the new sysfs.
+	SkipCgroupRbind bool
+	// CgroupVersion forces the cgroup version (1 or 2).
+	// Zero means auto-detection.
+	CgroupVersion int
+}
+
+// mount calls mount(2), or logs it in the dry-run mode.
+func mount(ctx context.Context, source, target, fstype string, flags uintptr, data string) error {
+	if common.IsDryRun(ctx) {
+		logrus.Infof("[dry-run] mount(%q, %q, %q, 0x%x, %q)", source, target, fstype, flags, data)
+		return nil
+	}
+	return unix.Mount(source, target, fstype, flags, data)
+}
+
+// mountSysfs is needed for mounting /sys/class/net
+// when netns is unshared.
+// mountSysfs uses mount(2) directly, so that /bin/mount is not needed in the namespace.
+func mountSysfs(ctx context.Context, sysfsOpt SysfsOpt, m metrics.Metrics) error {
+	defer metrics.Observe(m, metrics.PhaseSysfs, time.Now())
+	var tmp string
+	if !sysfsOpt.SkipCgroupRbind {
+		cgroupVersion := sysfsOpt.CgroupVersion
+		if cgroupVersion == 0 {
+			cgroupVersion = detectCgroupVersion()
+		}
+		var err error
+		tmp, err = ioutil.TempDir("/tmp", "rksys")
+		if err != nil {
+			return errors.Wrap(err, "creating a directory under /tmp")
+		}
+		defer removeStagingDir(ctx, "sysfs", tmp)
+		// cgroup v1 consists of per-controller mounts under /sys/fs/cgroup, so we need rbind.
+		// cgroup v2 is a single unified mount. Mounting a fresh cgroup2 is not possible here
+		// because the cgroup namespace is not unshared, so we bind the host one.
+		var bindFlags uintptr = unix.MS_BIND | unix.MS_REC
+		if cgroupVersion == 2 {
+			bindFlags = unix.MS_BIND
+		}
+		if err := mount(ctx, "/sys/fs/cgroup", tmp, "", bindFlags, ""); err != nil {
+			return errors.Wrapf(err, "bind-mounting /sys/fs/cgroup on %s", tmp)
+		}
+	}
+	mountSysfsRo := func() error {
+		return errors.Wrap(mount(ctx, "none", "/sys", "sysfs", unix.MS_RDONLY, ""), "mounting read-only sysfs on /sys")
+	}
+	if sysfsOpt.ForceReadOnly {
+		if err := mountSysfsRo(); err != nil {
+			return err
+		}
+	} else if err := mount(ctx, "none", "/sys", "sysfs", 0, ""); err != nil {
+		// when the sysfs in the parent namespace is RO,
+		// we can't mount RW sysfs even in the child namespace.
+		// https://github.com/rootless-containers/rootlesskit/pull/23#issuecomment-429292632
+		// https://github.com/torvalds/linux/blob/9f203e2f2f065cd74553e6474f0ae3675f39fb0f/fs/namespace.c#L3326-L3328
+		logrus.WithFields(logrus.Fields{
+			"phase":    "sysfs",
+			"fallback": "ro",
+		}).WithError(err).Warn("failed to mount sysfs, falling back to read-only mount")
+		metrics.Inc(m, metrics.CounterSysfsReadOnly)
+		if err := mountSysfsRo(); err != nil {
+			// when /sys/firmware is masked, even RO sysfs can't be mounted
+			logrus.WithField("phase", "sysfs").WithError(err).Warn("failed to mount sysfs")
+		}
+	}
+	if tmp != "" {
+		if err := mount(ctx, tmp, "/sys/fs/cgroup", "", unix.MS_MOVE, ""); err != nil {
+			return errors.Wrapf(err, "moving %s to /sys/fs/cgroup", tmp)
+		}
+	}
+	return nil
+}
+
+// needsSysfs returns whether mountSysfs needs to be called for opt.
+func needsSysfs(opt Opt) (bool, error) {
+	switch opt.Sysfs.Mount {
+	case SysfsMountAuto:
+		// for /sys/class/net
+		return opt.NetworkDriver != nil, nil
+	case SysfsMountAlways:
+		return true, nil
+	case SysfsMountNever:
+		return false, nil
+	default:
+		return false, errors.Errorf("invalid SysfsMount %d", opt.Sysfs.Mount)
+	}
+}
+
+// removeStagingDir removes the staging directory of mountSysfs and setupDev.
+// The directory is usually no longer a mount point, as the mount is moved to /sys/fs/cgroup or /dev,
+// but it is still mounted when the phase failed in between.
+// os.RemoveAll must not be used here, as it would remove the cgroups when the directory is still mounted.
+// Failures are logged, not returned.
+func removeStagingDir(ctx context.Context, phase, tmp string) {
+	if !common.IsDryRun(ctx) {
+		// EINVAL means tmp is not a mount point
+		if err := unix.Unmount(tmp, unix.MNT_DETACH); err != nil && err != unix.EINVAL {
+			logrus.WithField("phase", phase).WithError(err).Warnf("failed to unmount %s", tmp)
+		}
+	}
+	if err := os.Remove(tmp); err != nil {
+		logrus.WithField("phase", phase).WithError(err).Warnf("failed to remove %s", tmp)
+	}
+}
+
+// mountProcfs mounts a new procfs on /proc, so that /proc reflects the PID namespace.
+// Like mountSysfs, mountProcfs falls back to the read-only mount when the read-write mount is not permitted.
+func mountProcfs(ctx context.Context, m metrics.Metrics) error {
+	const flags = unix.MS_NOSUID | unix.MS_NODEV | unix.MS_NOEXEC
+	if err := mount(ctx, "proc", "/proc", "proc", flags, ""); err != nil {
+		// e.g. when the host /proc is read-only
+		logrus.WithFields(logrus.Fields{
+			"phase":    "procfs",
+			"fallback": "ro",
+		}).WithError(err).Warn("failed to mount procfs, falling back to read-only mount")
+		metrics.Inc(m, metrics.CounterProcfsReadOnly)
+		if err := mount(ctx, "proc", "/proc", "proc", flags|unix.MS_RDONLY, ""); err != nil {
+			// the inherited /proc does not reflect the PID namespace, so this is not ignorable unlike sysfs
+			return errors.Wrap(err, "mounting procfs on /proc (the PID namespace needs to be created, and the host /proc must not be masked)")
+		}
+	}
+	return nil
+}
+
+// setUmask sets the umask of the process, unless umask is nil.
+func setUmask(umask *int) {
+	if umask == nil {
+		return
+	}
+	old := syscall.Umask(*umask)
+	logrus.Debugf("child: set umask %#o (was %#o)", *umask, old)
+}
+
+// activateLoopback brings up lo.
+// When ipv6 is true, activateLoopback also confirms that ::1 is available.
+func activateLoopback(ctx context.Context, ipv6, useNetlink bool) error {
+	if err := withNetlink(useNetlink, "bring up lo", netlinkActivateLoopback, func() error {
+		cmds := [][]string{
+			{"ip", "link", "set", "lo", "up"},
+		}
+		if err := common.ExecsContext(ctx, os.Stderr, os.Environ(), cmds); err != nil {
+			return errors.Wrapf(err, "executing %v", cmds)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	if ipv6 && !common.IsDryRun(ctx) {
+		// fails with EADDRNOTAVAIL when ::1 is not assigned, e.g. with net.ipv6.conf.lo.disable_ipv6=1
+		l, err := net.ListenPacket("udp6", "[::1]:0")
+		if err != nil {
+			return errors.Wrap(err, "IPv6 loopback address ::1 is not available")
+		}
+		l.Close()
+	}
+	return nil
+}
+
+// activateTap configures iface on tap, adding the default routes only when primary is true.
+func activateTap(ctx context.Context, tap string, iface common.InterfaceMessage, primary bool) error {
+	var cmds [][]string
+	if iface.MAC != "" {
+		if _, err := net.ParseMAC(iface.MAC); err != nil {
+			return errors.Wrapf(err, "invalid MAC address %q for %s", iface.MAC, tap)
+		}
+		cmds = append(cmds, []string{"ip", "link", "set", "dev", tap, "address", iface.MAC})
+	}
+	cmds = append(cmds, []string{"ip", "link", "set", tap, "up"})
+	if iface.MTU != 0 {
+		cmds = append(cmds, []string{"ip", "link", "set", "dev", tap, "mtu", strconv.Itoa(iface.MTU)})
+	}
+	if iface.TxQueueLen != 0 {
+		cmds = append(cmds, []string{"ip", "link", "set", "dev", tap, "txqueuelen", strconv.Itoa(iface.TxQueueLen)})
+	}
+	if iface.IP != "" {
+		cmds = append(cmds, []string{"ip", "addr", "add", iface.IP + "/" + strconv.Itoa(iface.Netmask), "dev", tap})
+	}
+	if primary {
+		if cmd := defaultRouteCmd(tap, defaultGateways(iface)); cmd != nil {
+			cmds = append(cmds, cmd)
+		}
+	}
+	if iface.IPv6 != "" {
+		cmds = append(cmds, []string{"ip", "-6", "addr", "add", iface.IPv6 + "/" + strconv.Itoa(iface.IPv6Netmask), "dev", tap})
+		if primary && iface.IPv6Gateway != "" {
+			cmds = append(cmds, []string{"ip", "-6", "route", "add", "default", "via", iface.IPv6Gateway, "dev", tap})
+		}
+	}
+	if err := execIPCommands(ctx, cmds); err != nil {
+		return errors.Wrapf(err, "executing %v", cmds)
+	}
+	return nil
+}
+
+// defaultRouteCmd returns the command for adding the default route via gateways,
+// as a multipath route when there are multiple gateways.
+// Returns nil when there is no gateway, e.g. for an IPv6-only interface.
+func defaultRouteCmd(tap string, gateways []string) []string {
+	if len(gateways) == 0 {
+		return nil
+	}
+	cmd := []string{"ip", "route", "add", "default"}
+	if len(gateways) == 1 {
+		return append(cmd, "via", gateways[0], "dev", tap)
+	}
+	for _, gw := range gateways {
+		cmd = append(cmd, "nexthop", "via", gw, "dev", tap)
+	}
+	return cmd
+}
+
+// defaultGateways returns iface.Gateways without the duplicates, or iface.Gateway.
+func defaultGateways(iface common.InterfaceMessage) []string {
+	if len(iface.Gateways) == 0 {
+		if iface.Gateway == "" {
+			return nil
+		}
+		return []string{iface.Gateway}
+	}
+	var gws []string
+	seen := make(map[string]bool)
+	for _, gw := range iface.Gateways {
+		if !seen[gw] {
+			seen[gw] = true
+			gws = append(gws, gw)
+		}
+	}
+	return gws
+}
+
+// primaryIP returns the IPv4 address of the primary interface in netmsg, or empty.
+func primaryIP(netmsg common.NetworkMessage) string {
+	ifaces, primary, err := interfaces(netmsg)
+	if err != nil {
+		return ""
+	}
+	return ifaces[primary].IP
+}
+
+// setInterface replaces the i-th interface returned by interfaces.
+func setInterface(netmsg *common.NetworkMessage, i int, iface common.InterfaceMessage) {
+	if i == 0 {
+		netmsg.InterfaceMessage = iface
+	} else {
+		netmsg.Interfaces[i-1] = iface
+	}
+}
+
+// interfaces returns the interfaces in netmsg, along with the index of the primary one.
+func interfaces(netmsg common.NetworkMessage) ([]common.InterfaceMessage, int, error) {
+	ifaces := append([]common.InterfaceMessage{netmsg.InterfaceMessage}, netmsg.Interfaces...)
+	tapNames := make(map[string]int)
+	for i, iface := range ifaces {
+		if iface.DHCP && iface.IP != "" {
+			return nil, 0, errors.Errorf("interface %d has both DHCP and a static IP %q", i, iface.IP)
+		}
+		for _, gw := range iface.Gateways {
+			if ip := net.ParseIP(gw); ip == nil || ip.To4() == nil {
+				return nil, 0, errors.Errorf("invalid gateway %q for interface %d: needs to be an IPv4 address", gw, i)
+			}
+		}
+		if iface.TxQueueLen < 0 {
+			return nil, 0, errors.Errorf("invalid txqueuelen %d for interface %d: needs to be positive", iface.TxQueueLen, i)
+		}
+		if iface.TapName == "" {
+			continue
+		}
+		if err := network.ValidateInterfaceName(iface.TapName); err != nil {
+			return nil, 0, err
+		}
+		if j, ok := tapNames[iface.TapName]; ok {
+			return nil, 0, errors.Errorf("interfaces %d and %d have the same tap name %q", j, i, iface.TapName)
+		}
+		tapNames[iface.TapName] = i
+	}
+	primary := -1
+	for i, iface := range ifaces {
+		if !iface.Primary {
+			continue
+		}
+		if primary >= 0 {
+			return nil, 0, errors.Errorf("interfaces %d and %d are both marked as primary", primary, i)
+		}
+		primary = i
+	}
+	if primary < 0 {
+		primary = 0
+	}
+	return ifaces, primary, nil
+}
+
+// retryTap calls fn up to retryCount+1 times with exponential backoff,
+// as long as fn fails because the tap device has not appeared yet.
+// Other failures are returned immediately.
+func retryTap(ctx context.Context, tap string, retryCount int, retryInterval time.Duration, fn func() error) error {
+	if retryInterval <= 0 {
+		retryInterval = 100 * time.Millisecond
+	}
+	for i := 0; ; i++ {
+		err := fn()
+		if err == nil || i >= retryCount {
+			return err
+		}
+		// /sys/class/net is available because mountSysfs is called in advance, unless SysfsMountNever
+		if _, statErr := os.Stat(filepath.Join("/sys/class/net", tap)); !os.IsNotExist(statErr) {
+			return err
+		}
+		logrus.WithFields(logrus.Fields{
+			"phase": "tap",
+			"tap":   tap,
+			"retry": i + 1,
+		}).WithError(err).Debugf("tap is not ready yet, retrying after %v", retryInterval)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(retryInterval):
+		}
+		retryInterval *= 2
+	}
+}
+
+// validateRouteMTU checks the MTU against the minimum of IPv4 (RFC 791) or IPv6 (RFC 8200).
+func validateRouteMTU(r common.RouteMessage) error {
+	if r.MTU == 0 {
+		return nil
+	}
+	min := 68
+	if ip, _, err := net.ParseCIDR(r.Dest); err == nil && ip.To4() == nil {
+		min = 1280
+	}
+	if r.MTU < min || r.MTU > 65535 {
+		return errors.Errorf("invalid MTU %d for route %q: needs to be in [%d, 65535]", r.MTU, r.Dest, min)
+	}
+	return nil
+}
+
+func activateRoutes(ctx context.Context, tap string, routes []common.RouteMessage) error {
+	for _, r := range routes {
+		if err := validateRouteMTU(r); err != nil {
+			return err
+		}
+		cmd := []string{"ip", "route", "add", r.Dest, "via", r.Gateway, "dev", tap}
+		if r.Metric != 0 {
+			cmd = append(cmd, "metric", strconv.Itoa(r.Metric))
+		}
+		if r.Table != 0 {
+			cmd = append(cmd, "table", strconv.Itoa(r.Table))
+		}
+		if r.MTU != 0 {
+			cmd = append(cmd, "mtu", strconv.Itoa(r.MTU))
+		}
+		cmds := [][]string{cmd}
+		if err := common.ExecsContext(ctx, os.Stderr, os.Environ(), cmds); err != nil {
+			return errors.Wrapf(err, "executing %v", cmds)
+		}
+	}
+	return nil
+}
+
+func validateRule(r common.RuleMessage) error {
+	if r.FWMark <= 0 || r.Table <= 0 {
+		return errors.Errorf("invalid rule %+v: FWMark and Table need to be positive", r)
+	}
+	return nil
+}
+
+func activateRules(ctx context.Context, rules []common.RuleMessage) error {
+	for _, r := range rules {
+		if err := validateRule(r); err != nil {
+			return err
+		}
+		family := "-4"
+		if r.IPv6 {
+			family = "-6"
+		}
+		cmd := []string{"ip", family, "rule", "add", "fwmark", strconv.Itoa(r.FWMark), "table", strconv.Itoa(r.Table)}
+		if r.Priority != 0 {
+			cmd = append(cmd, "priority", strconv.Itoa(r.Priority))
+		}
+		cmds := [][]string{cmd}
+		if err := common.ExecsContext(ctx, os.Stderr, os.Environ(), cmds); err != nil {
+			return errors.Wrapf(err, "executing %v", cmds)
+		}
+	}
+	return nil
+}
+
+// setupCopyDir returns whether /etc was copied up, along with the paths that were copied up.
+func setupCopyDir(driver copyup.ChildDriver, dirs, files []string) (bool, []string, error) {
+	if driver != nil {
+		copied, err := driver.CopyUp(dirs)
+		if err != nil {
+			return copiedUp(copied, "/etc"), copied, err
+		}
+		if len(files) != 0 {
+			fileDriver, ok := driver.(copyup.FileChildDriver)
+			if !ok {
+				return copiedUp(copied, "/etc"), copied, errors.New("copy-up driver does not support copying up files")
+			}
+			copiedFiles, err := fileDriver.CopyUpFiles(files)
+			copied = append(copied, copiedFiles...)
+			if err != nil {
+				return copiedUp(copied, "/etc"), copied, err
+			}
+		}
+		return copiedUp(copied, "/etc"), copied, nil
+	}
+	if len(dirs) != 0 || len(files) != 0 {
+		return false, nil, errors.New("copy-up driver is not specified")
+	}
+	return false, nil, nil
+}
+
+// copiedUp returns true if p or one of its parent directories is in copied.
+func copiedUp(copied []string, p string) bool {
+	for _, c := range copied {
+		if c == p || strings.HasPrefix(p, strings.TrimSuffix(c, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// configureDevice calls the network driver for the i-th interface.
+func configureDevice(driver network.ChildDriver, netmsg common.NetworkMessage, i int, iface common.InterfaceMessage) (*network.Device, error) {
+	if deviceDriver, ok := driver.(network.DeviceChildDriver); ok {
+		dev, err := deviceDriver.ConfigureDevice(netmsg, iface)
+		if err == nil && dev.Mode == network.DeviceModePacketSocket && dev.File == nil {
+			err = errors.Errorf("network driver configured %q without a packet socket", dev.Name)
+		}
+		return dev, err
+	}
+	var (
+		tap string
+		err error
+	)
+	if i == 0 {
+		tap, err = driver.ConfigureTap(netmsg)
+	} else {
+		multiDriver, ok := driver.(network.MultiChildDriver)
+		if !ok {
+			return nil, errors.New("network driver does not support multiple interfaces")
+		}
+		tap, err = multiDriver.ConfigureInterfaceTap(netmsg, iface)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &network.Device{Mode: network.DeviceModeTap, Name: tap}, nil
+}
+
+// setupNet returns the names of the tap devices, and the function that stops renewing the DHCP leases
+// and closes the packet sockets.
+// msg.Network is updated with the DHCP leases.
+func setupNet(ctx context.Context, msg *common.Message, copied []string, opt Opt) (taps []string, _ func(), retErr error) {
+	driver := opt.NetworkDriver
+	// HostNetwork
+	if driver == nil {
+		return nil, func() {}, nil
+	}
+	var cleanups []func()
+	cleanupNet := func() {
+		for _, f := range cleanups {
+			f()
+		}
+	}
+	// not a named result, as the error paths return a nil function
+	defer func() {
+		if retErr != nil {
+			cleanupNet()
+		}
+	}()
+	extraHosts, err := parseExtraHosts(msg.ExtraHosts)
+	if err != nil {
+		return nil, nil, err
+	}
+	// the packet sockets do not need /dev/net/tun
+	if _, ok := driver.(network.DeviceChildDriver); !ok {
+		if err := checkDevNetTun(); err != nil {
+			return nil, nil, err
+		}
+	}
+	ifaces, primary, err := interfaces(msg.Network)
+	if err != nil {
+		return nil, nil, err
+	}
+	ipv6 := false
+	for _, iface := range ifaces {
+		ipv6 = ipv6 || iface.IPv6 != ""
+	}
+	// netlink is not used in the dry-run mode, so as to log the equivalent commands
+	useNetlink := opt.Netlink && !common.IsDryRun(ctx)
+	if !opt.SkipLoopback {
+		if err := activateLoopback(ctx, ipv6, useNetlink); err != nil {
+			return nil, nil, err
+		}
+	}
+	var leasedDNS []string
+	for i, iface := range ifaces {
+		tapStart := time.Now()
+		dev, err := configureDevice(driver, msg.Network, i, iface)
+		if err != nil {
+			return nil, nil, err
+		}
+		tap := dev.Name
+		if dev.Mode == network.DeviceModePacketSocket {
+			cleanups = append(cleanups, func() { dev.File.Close() })
+			if iface.DHCP || len(iface.Routes) != 0 {
+				return nil, nil, errors.Errorf("DHCP and routes cannot be configured for the packet socket %q", tap)
+			}
+			logrus.Debugf("not configuring %q, as the packets are consumed by the userspace network stack", tap)
+			taps = append(taps, tap)
+			metrics.Observe(opt.Metrics, metrics.PhaseTap, tapStart)
+			continue
+		}
+		if iface.TapName != "" && tap != iface.TapName {
+			return nil, nil, errors.Errorf("network driver configured tap %q, expected %q", tap, iface.TapName)
+		}
+		taps = append(taps, tap)
+		if iface.DHCP {
+			if common.IsDryRun(ctx) {
+				logrus.Infof("[dry-run] leasing an IPv4 address on %s with DHCP", tap)
+				continue
+			}
+			if err := retryTap(ctx, tap, opt.TapRetryCount, opt.TapRetryInterval, func() error {
+				return bringUpTap(ctx, tap, iface.MAC)
+			}); err != nil {
+				return nil, nil, err
+			}
+			lease, stop, err := leaseDHCP(ctx, tap)
+			if err != nil {
+				return nil, nil, err
+			}
+			cleanups = append(cleanups, stop)
+			iface.IP = lease.IP.String()
+			iface.Netmask = lease.Netmask
+			if lease.Gateway != nil {
+				iface.Gateway = lease.Gateway.String()
+			}
+			if i == primary {
+				leasedDNS = lease.DNS
+			}
+			ifaces[i] = iface
+			setInterface(&msg.Network, i, iface)
+		}
+		iface := iface
+		if err := retryTap(ctx, tap, opt.TapRetryCount, opt.TapRetryInterval, func() error {
+			return withNetlink(useNetlink, "configure "+tap, func() error {
+				return netlinkActivateTap(tap, iface, i == primary)
+			}, func() error {
+				return activateTap(ctx, tap, iface, i == primary)
+			})
+		}); err != nil {
+			return nil, nil, err
+		}
+		if err := withNetlink(useNetlink, "add routes to "+tap, func() error {
+			return netlinkActivateRoutes(tap, iface.Routes)
+		}, func() error {
+			return activateRoutes(ctx, tap, iface.Routes)
+		}); err != nil {
+			return nil, nil, err
+		}
+		metrics.Observe(opt.Metrics, metrics.PhaseTap, tapStart)
+		if opt.VerifyGateway && !common.IsDryRun(ctx) && i == primary {
+			for _, gw := range defaultGateways(iface) {
+				if err := verifyGateway(gw, verifyGatewayTimeout); err != nil {
+					logrus.WithField("phase", "network").WithError(err).Warnf("gateway %s seems unreachable", gw)
+				}
+			}
+		}
+	}
+	if len(msg.Network.Rules) != 0 {
+		if err := withNetlink(useNetlink, "add rules", func() error {
+			return netlinkActivateRules(msg.Network.Rules)
+		}, func() error {
+			return activateRules(ctx, msg.Network.Rules)
+		}); err != nil {
+			return nil, nil, err
+		}
+	}
+	if len(dnsServers(msg.Network)) == 0 {
+		msg.Network.DNSServers = leasedDNS
+	}
+	if msg.Network.DNSBridgeFD != 0 {
+		if opt.SkipLoopback {
+			return nil, nil, errors.New("the DNS bridge cannot be used with SkipLoopback")
+		}
+		stopDNSBridge, err := startDNSBridge(ctx, msg.Network)
+		if err != nil {
+			return nil, nil, err
+		}
+		cleanups = append(cleanups, stopDNSBridge)
+		msg.Network.DNS = ""
+		msg.Network.DNSServers = []string{dnsBridgeAddr}
+	}
+	if err := applySysctls(ctx, opt.Sysctls); err != nil {
+		return nil, nil, err
+	}
+	if err := enableConntrackHelpers(ctx, opt.ConntrackHelpers); err != nil {
+		return nil, nil, err
+	}
+	// writing the files is preferred over bind-mounting them, because bind-mounts are
+	// unmounted when the files are recreated on the host.
+	if copiedUp(copied, "/etc/resolv.conf") {
+		if err := writeResolvConf(msg.Network, opt.PreserveResolvConf); err != nil {
+			return nil, nil, err
+		}
+	} else {
+		if !opt.WatchResolvConf {
+			logrus.WithField("phase", "network").Warn("Mounting /etc/resolv.conf without copying-up /etc. " +
+				"Note that /etc/resolv.conf in the namespace will be unmounted when it is recreated on the host. " +
+				"Unless /etc/resolv.conf is statically configured, copying-up /etc or watching /etc/resolv.conf is highly recommended. " +
+				"Please refer to RootlessKit documentation for further information.")
+		}
+		if err := mountResolvConf(ctx, msg.StateDir, msg.Network, opt.PreserveResolvConf); err != nil {
+			return nil, nil, err
+		}
+	}
+	if opt.HostGateway {
+		extraHosts = append(extraHosts, hostGatewayEntries(ifaces[primary], opt.HostGatewayAlias)...)
+	}
+	if copiedUp(copied, "/etc/hosts") {
+		if err := writeEtcHosts(msg.Hostname, extraHosts); err != nil {
+			return nil, nil, err
+		}
+	} else if err := mountEtcHosts(ctx, msg.StateDir, msg.Hostname, extraHosts); err != nil {
+		return nil, nil, err
+	}
+	return taps, cleanupNet, nil
+}
+
+// Errors returned from Child can be tested with errors.Cause.
+var (
+	ErrPipeFDNotSet    = errors.New("pipe FD is not set")
+	ErrUnexpectedStage = errors.New("unexpected stage")
+	ErrEmptyStateDir   = errors.New("empty StateDir")
+	// ErrMissingCapabilities is returned when the re-exec did not grant the capabilities for setting up the namespaces.
+	ErrMissingCapabilities = errors.New("missing capabilities")
+	// ErrMissingIDMapping is returned when the parent did not map the root of the user namespace.
+	ErrMissingIDMapping = errors.New("missing ID mapping")
+	// ErrCommandExited is the cause when the target command failed without an exit status.
+	// Otherwise the cause is *ExitError. IsCommandExited matches both.
+	ErrCommandExited = errors.New("command exited")
+)
+
+// IsCommandExited returns true if the cause of err is ErrCommandExited or *ExitError.
+func IsCommandExited(err error) bool {
+	cause := errors.Cause(err)
+	if _, ok := cause.(*ExitError); ok {
+		return true
+	}
+	return cause == ErrCommandExited
+}
+
+// ExitError is returned from Child when the target command exited with a non-zero status.
+type ExitError struct {
+	TargetCmd []string
+	// ExitCode is 128+signum when the command was terminated by a signal, as in shells.
+	ExitCode int
+	err      *exec.ExitError
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("command %v exited: %v", e.TargetCmd, e.err)
+}
+
+// newExitError returns nil if err is not *exec.ExitError.
+func newExitError(targetCmd []string, err error) *ExitError {
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return nil
+	}
+	status, ok := exitErr.Sys().(syscall.WaitStatus)
+	if !ok {
+		return nil
+	}
+	code := status.ExitStatus()
+	if status.Signaled() {
+		code = 128 + int(status.Signal())
+	}
+	return &ExitError{
+		TargetCmd: targetCmd,
+		ExitCode:  code,
+		err:       exitErr,
+	}
+}
+
+type Opt struct {
+	PipeFDEnvKey  string              // needs to be set, unless Pipe or PipeFDPath is set
+	PipeFDPath    string              // optional, "/dev/fd/N" or "/proc/self/fd/N" used instead of PipeFDEnvKey, e.g. when the launcher sanitizes the environment
+	Pipe          io.ReadWriteCloser  // optional, used instead of PipeFDEnvKey, e.g. net.Pipe for driving the stages in-process (needs DebugNoReexec)
+	TargetCmd     []string            // needs to be set
+	InitCmds      [][]string          // optional, run in the order before TargetCmd
+	NetworkDriver network.ChildDriver // nil for HostNetwork
+	CopyUpDriver  copyup.ChildDriver  // cannot be nil if len(CopyUpDirs) != 0 || len(CopyUpFiles) != 0
+	CopyUpDirs    []string
+	CopyUpFiles   []string // the driver needs to implement copyup.FileChildDriver
+	PortDriver    port.ChildDriver
+	// PortDriverRestartCount is the maximum number of restarting PortDriver when it exits with an error.
+	// The ports forwarded before the restart need to be added again. Zero disables restarting.
+	PortDriverRestartCount int
+	// PortDriverRestartInterval is the interval before the first restart, doubled for each attempt.
+	// Defaults to 1s.
+	PortDriverRestartInterval time.Duration
+	// NetnsPath is the path of an existing network namespace, e.g. "/var/run/netns/foo", to run the commands in.
+	// The network namespace is used as-is, so NetworkDriver and PortDriver cannot be set.
+	// Joining needs CAP_SYS_ADMIN in the user namespace that owns the network namespace.
+	NetnsPath string
+	// ShutdownGracePeriod is the duration to wait before sending SIGKILL to the target command
+	// after relaying SIGTERM, SIGINT, or SIGHUP. Zero means the target command is never killed forcibly.
+	ShutdownGracePeriod time.Duration
+	// WorkingDir is the working directory of the target command.
+	// Empty means the current directory.
+	WorkingDir string
+	// EnvKeep is the list of the environment variables to be kept. Empty means all.
+	EnvKeep []string
+	// EnvDrop is the list of the environment variables to be removed.
+	EnvDrop []string
+	// EnvExtra is merged on top of the filtered environment variables.
+	EnvExtra map[string]string
+	// Pdeathsig is sent to the target command when the child dies. Defaults to SIGKILL.
+	Pdeathsig syscall.Signal
+	// Cloneflags creates additional namespaces for the target command (and InitCmds).
+	// Only CLONE_NEWNS, CLONE_NEWUTS, CLONE_NEWIPC, CLONE_NEWPID, CLONE_NEWNET, and CLONE_NEWCGROUP are supported.
+	// Note that CLONE_NEWNET disconnects the command from the network and the ports set up by the child.
+	Cloneflags uintptr
+	// SeccompProfilePath is the path of the seccomp profile applied to TargetCmd,
+	// in the format of the "linux.seccomp" object of the OCI runtime spec.
+	// Needs the "seccomp" build tag.
+	SeccompProfilePath string
+	// NoNewPrivs sets no_new_privs for TargetCmd, so that TargetCmd and the descendants cannot gain
+	// privileges via setuid binaries or file capabilities.
+	NoNewPrivs bool
+	// TapRetryCount is the number of retries for configuring the tap device
+	// when the device is not ready yet.
+	TapRetryCount int
+	// TapRetryInterval is the initial interval of the retries, doubled on each retry.
+	// Defaults to 100ms.
+	TapRetryInterval time.Duration
+	// Sysfs is used only when NetworkDriver is set, unless Sysfs.Mount is SysfsMountAlways.
+	Sysfs SysfsOpt
+	// MountProc mounts a new procfs on /proc.
+	// Needs the PID namespace to be created with parent.Opt.CreatePIDNS.
+	MountProc bool
+	// SetupTimeout is the timeout for setting up copy-up and network.
+	// The target command is not subject to the timeout.
+	// Zero means no timeout.
+	SetupTimeout time.Duration
+	// LogFormat is either "text" or "json".
+	// Empty keeps the current logrus formatter.
+	LogFormat string
+	// WatchResolvConf re-mounts /etc/resolv.conf when it is recreated on the host.
+	// Ignored when /etc/resolv.conf is copied up or NetworkDriver is nil.
+	WatchResolvConf bool
+	// PreserveResolvConf preserves the comments and the other lines of the host /etc/resolv.conf,
+	// replacing only the nameserver lines (and the search and options lines when set in the network message).
+	PreserveResolvConf bool
+	// RunAsUser is the user name or the numeric uid in the namespace for running the target command.
+	// Empty means the mapped root.
+	RunAsUser string
+	// RunAsGroup is the group name or the numeric gid in the namespace for running the target command.
+	// Empty means the primary group of RunAsUser.
+	RunAsGroup string
+	// SupplementaryGroups is the list of the gids in the namespace to be added to the target command,
+	// in addition to the groups of RunAsUser in /etc/group.
+	SupplementaryGroups []int
+	// StdinMode defaults to StdinInherit.
+	StdinMode StdinMode
+	// StdoutLog is the file to tee the stdout of the target command.
+	// Relative paths are resolved against StateDir.
+	StdoutLog string
+	// StderrLog is the file to tee the stderr of the target command.
+	// Relative paths are resolved against StateDir.
+	StderrLog string
+	// PreExecHook is called after setting up the network and the ports, before starting the target command.
+	// An error aborts the startup.
+	PreExecHook func(msg common.Message) error
+	// PostStopHook is called after the target command exits, before tearing down the ports,
+	// with the error returned from waiting for the command.
+	// An error is logged, and does not replace the exit status of the command.
+	PostStopHook func(exitErr error) error
+	// Sysctls is applied in the network namespace, e.g. {"net.ipv4.ping_group_range": "0 2147483647"}.
+	// Only "net.*" keys are allowed. Ignored when NetworkDriver is nil.
+	Sysctls map[string]string
+	// ConntrackHelpers are the conntrack helpers assigned to their default ports, e.g. "ftp" and "sip".
+	// Needs the helper modules to be loaded on the host; the unavailable helpers are warned.
+	// Ignored when NetworkDriver is nil.
+	ConntrackHelpers []string
+	// SkipLoopback skips bringing up the loopback interface, for the network drivers that configure it by themselves.
+	SkipLoopback bool
+	// VerifyGateway sends an ICMP echo request to the IPv4 gateway of the primary interface,
+	// and logs a warning when the gateway does not reply in a few seconds.
+	VerifyGateway bool
+	// Netlink configures lo and the tap devices with netlink, instead of executing `ip` commands.
+	// Falls back to `ip` commands when netlink fails.
+	Netlink bool
+	// DryRun logs the commands and the mounts for setting up the namespaces instead of executing them,
+	// and exits without starting the target command.
+	// Copy-up, the pre-exec hook, and the resolv.conf watcher are skipped.
+	DryRun bool
+	// Metrics observes the durations of the setup phases. Can be nil.
+	Metrics metrics.Metrics
+	// BindMounts are performed after the network setup.
+	BindMounts []BindMount
+	// TmpfsMounts are performed after BindMounts.
+	TmpfsMounts []TmpfsMount
+	// CleanupStateDir defaults to CleanupStateDirNever.
+	CleanupStateDir CleanupStateDir
+	// ReadinessProbe is executed in the namespaces after starting the target command,
+	// until it succeeds. Message 2 is not sent to the parent until then.
+	// Empty means Message 2 is sent before starting the target command.
+	ReadinessProbe []string
+	// ReadinessProbeTimeout defaults to 30s. Exceeding the timeout fails the startup.
+	ReadinessProbeTimeout time.Duration
+	// ReadinessProbeInterval defaults to 1s.
+	ReadinessProbeInterval time.Duration
+	// DebugNoReexec skips re-executing the child after setting up the uid_map and the gid_map,
+	// for attaching a debugger. The child fails with ErrMissingCapabilities unless the capabilities
+	// for the setup, e.g. CAP_SYS_ADMIN, are effective without the re-exec.
+	// Not for production use.
+	DebugNoReexec bool
+	// HostGateway adds HostGatewayAlias to /etc/hosts, mapped to the gateway of the primary interface.
+	// Ignored when NetworkDriver is nil.
+	HostGateway bool
+	// HostGatewayAlias defaults to DefaultHostGatewayAlias.
+	HostGatewayAlias string
+	// ShellWrap is the shell and the flags for running TargetCmd, e.g. {"sh", "-lc"} for sourcing the profile scripts
+	// like a login session. The last flag needs to take the command string, like "-c".
+	// The shell execs TargetCmd after the initialization, so the exit status is not altered by the shell.
+	// Note that the profile scripts may override EnvExtra and WorkingDir.
+	// Empty means TargetCmd is executed directly. InitCmds and ReadinessProbe are not wrapped.
+	ShellWrap []string
+	// Umask is set after setting up the namespaces, before executing InitCmds and TargetCmd, e.g. 022.
+	// Nil keeps the umask inherited from the parent.
+	Umask *int
+	// SetupDev mounts a private tmpfs on /dev, with null, zero, full, random, urandom, and tty bind-mounted from the host,
+	// the standard symlinks, devpts on /dev/pts, and tmpfs on /dev/shm.
+	// Failing to set up tty, /dev/pts, or /dev/shm is logged as a warning.
+	SetupDev bool
+}
+
+// StdinMode specifies the stdin of the target command.
+type StdinMode string
+
+const (
+	// StdinInherit inherits the stdin of the child.
+	StdinInherit StdinMode = "inherit"
+	// StdinNull connects the null device.
+	StdinNull StdinMode = "null"
+	// StdinClosed connects a pipe whose write end is already closed.
+	StdinClosed StdinMode = "closed"
+)
+
+// teeLogs tees the stdout and the stderr of cmd to the files.
+// Empty file names are ignored.
+// The returned function needs to be called after cmd.Wait.
+func teeLogs(cmd *exec.Cmd, stateDir, stdoutLog, stderrLog string) (func(), error) {
+	var files []*os.File
+	closeLogs := func() {
+		for _, f := range files {
+			if err := f.Sync(); err != nil {
+				logrus.WithError(err).Warnf("failed to sync %s", f.Name())
+			}
+			f.Close()
+		}
+	}
+	for _, x := range []struct {
+		name string
+		w    *io.Writer
+	}{
+		{stdoutLog, &cmd.Stdout},
+		{stderrLog, &cmd.Stderr},
+	} {
+		if x.name == "" {
+			continue
+		}
+		p := x.name
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(stateDir, p)
+		}
+		f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			closeLogs()
+			return nil, errors.Wrapf(err, "opening %s", p)
+		}
+		files = append(files, f)
+		*x.w = io.MultiWriter(*x.w, f)
+	}
+	return closeLogs, nil
+}
+
+// sendReady sends message 2 to the parent.
+func sendReady(w io.Writer, taps []string, ip string, setupErr error) error {
+	msg := common.Message{
+		Version: common.ProtocolVersion,
+		Stage:   2,
+		Message2: common.Message2{
+			Taps: taps,
+			IP:   ip,
+		},
+	}
+	if setupErr != nil {
+		msg.SetupError = setupErr.Error()
+	}
+	_, err := msgutil.MarshalToWriter(w, &msg)
+	return err
+}
+
+func setLogFormat(format string) error {
+	switch format {
+	case "":
+	case "text":
+		logrus.SetFormatter(&logrus.TextFormatter{})
+	case "json":
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	default:
+		return errors.Errorf("unknown log format: %q", format)
+	}
+	return nil
+}
+
+// runSetup runs fn with the timeout.
+// fn calls setPhase for reporting the phase in progress on timeout or cancellation.
+// On timeout or cancellation, runSetup still waits for fn to return, so that the caller does not
+// tear down the namespaces concurrently with fn. fn needs to abort on the cancellation of ctx.
+func runSetup(ctx context.Context, timeout time.Duration, fn func(ctx context.Context, setPhase func(string)) error) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	var (
+		mu    sync.Mutex
+		phase string
+	)
+	setPhase := func(s string) {
+		mu.Lock()
+		phase = s
+		mu.Unlock()
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- fn(ctx, setPhase)
+	}()
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		if err := <-errCh; err == nil {
+			// completed just before the cancellation
+			return nil
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if timeout > 0 && ctx.Err() == context.DeadlineExceeded {
+			return errors.Errorf("setup timed out after %v during phase %q", timeout, phase)
+		}
+		return errors.Wrapf(ctx.Err(), "setup aborted during phase %q", phase)
+	}
+}
+
+// Child sets up the namespaces with SetupNamespace, and runs the target command.
+// Cancelling ctx aborts the setup in progress, and kills the target command.
+func Child(ctx context.Context, opt Opt) (retErr error) {
+	ns, err := SetupNamespace(ctx, opt)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := ns.Teardown(retErr); err != nil && retErr == nil {
+			retErr = err
+		}
+	}()
+	if opt.DryRun {
+		logrus.Infof("[dry-run] not starting %v", opt.TargetCmd)
+		return nil
+	}
+	// the umask is inherited by the commands; the files created during the setup keep the inherited umask
+	setUmask(opt.Umask)
+
+	if err := runInitCmds(ctx, opt, ns.Message.StateDir); err != nil {
+		return err
+	}
+	cmd, err := createCmd(ctx, opt, wrapShell(opt.ShellWrap, opt.TargetCmd))
+	if err != nil {
+		return err
+	}
+	closeLogs, err := teeLogs(cmd, ns.Message.StateDir, opt.StdoutLog, opt.StderrLog)
+	if err != nil {
+		return err
+	}
+	exited := make(chan struct{})
+	if opt.NoNewPrivs || ns.seccomp != nil {
+		err = startCmdOnThread(cmd, threadAttrs{
+			netnsPath:  opt.NetnsPath,
+			noNewPrivs: opt.NoNewPrivs,
+			seccomp:    ns.seccomp,
+		}, exited)
+	} else {
+		err = startCmd(cmd, opt.NetnsPath)
+	}
+	if err != nil {
+		closeLogs()
+		return errors.Wrapf(err, "command %v failed to start", opt.TargetCmd)
+	}
+	stopForwardingSignals := forwardSignals(cmd.Process, opt.ShutdownGracePeriod)
+	go func() {
+		err = cmd.Wait()
+		close(exited)
+	}()
+	if len(opt.ReadinessProbe) > 0 {
+		if probeErr := probeReadiness(ctx, opt, exited); probeErr != nil {
+			stopTargetCmd(cmd, exited)
+			stopForwardingSignals()
+			closeLogs()
+			runPostStopHook(opt, err)
+			return probeErr
+		}
+		if readyErr := ns.NotifyReady(); readyErr != nil {
+			stopTargetCmd(cmd, exited)
+			stopForwardingSignals()
+			closeLogs()
+			runPostStopHook(opt, err)
+			return readyErr
+		}
+	}
+	if startedErr := ns.NotifyStarted(cmd.Process.Pid); startedErr != nil {
+		logrus.WithError(startedErr).Warn("failed to notify the parent of the PID of the target command")
+	}
+	<-exited
+	stopForwardingSignals()
+	closeLogs()
+	runPostStopHook(opt, err)
+	if err != nil {
+		if exitErr := newExitError(opt.TargetCmd, err); exitErr != nil {
+			return exitErr
+		}
+		return errors.Wrapf(ErrCommandExited, "%v: %v", opt.TargetCmd, err)
+	}
+	return nil
+}
+
+// runPostStopHook calls opt.PostStopHook if set.
+func runPostStopHook(opt Opt, exitErr error) {
+	if opt.PostStopHook == nil {
+		return
+	}
+	if err := opt.PostStopHook(exitErr); err != nil {
+		logrus.WithError(err).Warn("post-stop hook failed")
+	}
+}
+
+// runInitCmds runs opt.InitCmds in the order, in the same way as the target command.
+// The first failing command aborts the startup.
+func runInitCmds(ctx context.Context, opt Opt, stateDir string) error {
+	for _, initCmd := range opt.InitCmds {
+		cmd, err := createCmd(ctx, opt, initCmd)
+		if err != nil {
+			return errors.Wrapf(err, "init command %v", initCmd)
+		}
+		closeLogs, err := teeLogs(cmd, stateDir, opt.StdoutLog, opt.StderrLog)
+		if err != nil {
+			return err
+		}
+		if err := startCmd(cmd, opt.NetnsPath); err != nil {
+			closeLogs()
+			return errors.Wrapf(err, "init command %v failed to start", initCmd)
+		}
+		stopForwardingSignals := forwardSignals(cmd.Process, opt.ShutdownGracePeriod)
+		err = cmd.Wait()
+		stopForwardingSignals()
+		closeLogs()
+		if err != nil {
+			return errors.Wrapf(err, "init command %v failed", initCmd)
+		}
+		logrus.Debugf("child: init command %v completed", initCmd)
+	}
+	return nil
+}
@@ -0,0 +1,343 @@
+package child
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/pkg/errors"
+
+	"github.com/rancher/k3s/pkg/rootlesskit/common"
+)
+
+const usernsEnv = "ROOTLESSKIT_TEST_USERNS"
+
+// runInNamespaces reruns the current test in new user and mount namespaces,
+// along with the namespaces specified in cloneflags.
+// It returns true when the caller is already running in the namespaces.
+func runInNamespaces(t *testing.T, cloneflags uintptr) bool {
+	if os.Getenv(usernsEnv) == "1" {
+		if err := syscall.Mount("none", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+			t.Fatal(err)
+		}
+		return true
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^"+t.Name()+"$", "-test.v")
+	cmd.Env = append(os.Environ(), usernsEnv+"=1")
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags:  syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | cloneflags,
+		UidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}},
+		GidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}},
+	}
+	var out strings.Builder
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Start(); err != nil {
+		t.Skipf("namespaces are unavailable: %v", err)
+	}
+	err := cmd.Wait()
+	t.Log(out.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return false
+}
+
+func TestActivateLoopbackIPv6(t *testing.T) {
+	if !runInNamespaces(t, syscall.CLONE_NEWNET) {
+		return
+	}
+	for _, useNetlink := range []bool{false, true} {
+		if err := activateLoopback(context.Background(), true, useNetlink); err != nil {
+			t.Fatalf("useNetlink=%v: %v", useNetlink, err)
+		}
+	}
+	if err := ioutil.WriteFile("/proc/sys/net/ipv6/conf/lo/disable_ipv6", []byte("1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := activateLoopback(context.Background(), true, false); err == nil {
+		t.Fatal("expected an error when ::1 is not available")
+	}
+	if err := activateLoopback(context.Background(), false, false); err != nil {
+		t.Fatalf("expected no error without IPv6: %v", err)
+	}
+}
+
+func TestMountProcfs(t *testing.T) {
+	if !runInNamespaces(t, syscall.CLONE_NEWPID) {
+		return
+	}
+	if err := mountProcfs(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+	self, err := os.Readlink("/proc/self")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if self != "1" {
+		t.Fatalf("expected /proc/self to be 1, got %q", self)
+	}
+	exe, err := os.Readlink("/proc/1/exe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exe != expected {
+		t.Fatalf("expected PID 1 to be %s, got %s", expected, exe)
+	}
+}
+
+func TestMountSysfsStagingDir(t *testing.T) {
+	if !runInNamespaces(t, syscall.CLONE_NEWNET) {
+		return
+	}
+	before, err := filepath.Glob("/tmp/rksys*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mountSysfs(context.Background(), SysfsOpt{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	after, err := filepath.Glob("/tmp/rksys*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) != len(before) {
+		t.Fatalf("expected the staging directory to be removed, got %v", after)
+	}
+	mountinfo, err := ioutil.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(string(mountinfo), "\n") {
+		// the 5th field is the mount point
+		if fields := strings.Fields(line); len(fields) > 4 && strings.HasPrefix(fields[4], "/tmp/rksys") {
+			t.Fatalf("expected no mount on the staging directory, got %q", line)
+		}
+	}
+	if _, err := os.Stat("/sys/fs/cgroup"); err != nil {
+		t.Fatalf("expected /sys/fs/cgroup to be moved into the new sysfs: %v", err)
+	}
+}
+
+func TestDefaultRouteCmd(t *testing.T) {
+	testCases := []struct {
+		name     string
+		iface    common.InterfaceMessage
+		expected []string
+	}{
+		{
+			name: "no gateway",
+		},
+		{
+			name:     "gateway",
+			iface:    common.InterfaceMessage{Gateway: "10.0.2.2"},
+			expected: []string{"ip", "route", "add", "default", "via", "10.0.2.2", "dev", "tap0"},
+		},
+		{
+			name:     "single gateway in gateways",
+			iface:    common.InterfaceMessage{Gateway: "10.0.2.1", Gateways: []string{"10.0.2.2"}},
+			expected: []string{"ip", "route", "add", "default", "via", "10.0.2.2", "dev", "tap0"},
+		},
+		{
+			name:  "multipath",
+			iface: common.InterfaceMessage{Gateways: []string{"10.0.2.2", "10.0.2.3"}},
+			expected: []string{"ip", "route", "add", "default",
+				"nexthop", "via", "10.0.2.2", "dev", "tap0",
+				"nexthop", "via", "10.0.2.3", "dev", "tap0"},
+		},
+		{
+			name:     "duplicates",
+			iface:    common.InterfaceMessage{Gateways: []string{"10.0.2.2", "10.0.2.2"}},
+			expected: []string{"ip", "route", "add", "default", "via", "10.0.2.2", "dev", "tap0"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := defaultRouteCmd("tap0", defaultGateways(tc.iface))
+			if !reflect.DeepEqual(got, tc.expected) {
+				t.Fatalf("expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestInterfacesGateways(t *testing.T) {
+	testCases := []struct {
+		name     string
+		gateways []string
+		wantErr  bool
+	}{
+		{name: "none"},
+		{name: "ipv4", gateways: []string{"10.0.2.2", "10.0.2.3"}},
+		{name: "ipv6", gateways: []string{"10.0.2.2", "fd00::2"}, wantErr: true},
+		{name: "invalid", gateways: []string{"10.0.2"}, wantErr: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			netmsg := common.NetworkMessage{InterfaceMessage: common.InterfaceMessage{IP: "10.0.2.100", Gateways: tc.gateways}}
+			_, _, err := interfaces(netmsg)
+			if tc.wantErr && err == nil {
+				t.Fatalf("expected an error for %v", tc.gateways)
+			}
+			if !tc.wantErr && err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestActivateTapMultipath(t *testing.T) {
+	if !runInNamespaces(t, syscall.CLONE_NEWNET) {
+		return
+	}
+	if out, err := exec.Command("ip", "tuntap", "add", "tap0", "mode", "tap").CombinedOutput(); err != nil {
+		t.Skipf("tap devices are unavailable: %v: %s", err, out)
+	}
+	iface := common.InterfaceMessage{IP: "10.0.2.100", Netmask: 24, Gateways: []string{"10.0.2.2", "10.0.2.3", "10.0.2.2"}}
+	if err := activateTap(context.Background(), "tap0", iface, true); err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command("ip", "route", "show", "default").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, gw := range []string{"10.0.2.2", "10.0.2.3"} {
+		if strings.Count(string(out), "nexthop via "+gw+" ") != 1 {
+			t.Fatalf("expected a nexthop via %s, got %q", gw, string(out))
+		}
+	}
+}
+
+func TestSetUmask(t *testing.T) {
+	old := syscall.Umask(022)
+	defer syscall.Umask(old)
+	testCases := []struct {
+		name     string
+		umask    *int
+		fileMode os.FileMode
+		dirMode  os.FileMode
+	}{
+		{name: "inherited", fileMode: 0644, dirMode: 0755},
+		{name: "027", umask: intPtr(027), fileMode: 0640, dirMode: 0750},
+		{name: "077", umask: intPtr(077), fileMode: 0600, dirMode: 0700},
+		{name: "0", umask: intPtr(0), fileMode: 0666, dirMode: 0777},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			defer syscall.Umask(022)
+			dir, err := ioutil.TempDir("", "umask-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			setUmask(tc.umask)
+			cmd, err := createCmd(context.Background(), Opt{}, []string{"sh", "-c", "touch f && mkdir d"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			cmd.Dir = dir
+			if err := cmd.Run(); err != nil {
+				t.Fatal(err)
+			}
+			for name, expected := range map[string]os.FileMode{"f": tc.fileMode, "d": tc.dirMode} {
+				st, err := os.Stat(filepath.Join(dir, name))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if st.Mode().Perm() != expected {
+					t.Errorf("expected %s to be created with %v, got %v", name, expected, st.Mode().Perm())
+				}
+			}
+		})
+	}
+}
+
+func intPtr(i int) *int {
+	return &i
+}
+
+func TestPrimaryIP(t *testing.T) {
+	testCases := []struct {
+		name     string
+		netmsg   common.NetworkMessage
+		expected string
+	}{
+		{
+			name:     "static",
+			netmsg:   common.NetworkMessage{InterfaceMessage: common.InterfaceMessage{IP: "10.0.2.100"}},
+			expected: "10.0.2.100",
+		},
+		{
+			name: "primary",
+			netmsg: common.NetworkMessage{
+				InterfaceMessage: common.InterfaceMessage{IP: "10.0.2.100"},
+				Interfaces:       []common.InterfaceMessage{{IP: "10.0.3.100", Primary: true}},
+			},
+			expected: "10.0.3.100",
+		},
+		{
+			name:   "IPv6 only",
+			netmsg: common.NetworkMessage{InterfaceMessage: common.InterfaceMessage{IPv6: "fd00::100"}},
+		},
+		{
+			name: "host network",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := primaryIP(tc.netmsg); got != tc.expected {
+				t.Fatalf("expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+type failingNetworkDriver struct{}
+
+func (failingNetworkDriver) ConfigureTap(common.NetworkMessage) (string, error) {
+	return "", errors.New("failed to configure tap")
+}
+
+func TestSetupNetError(t *testing.T) {
+	testCases := []struct {
+		name string
+		msg  common.Message
+	}{
+		{
+			name: "invalid extra hosts",
+			msg:  common.Message{Message1: common.Message1{ExtraHosts: []string{"invalid"}}},
+		},
+		{
+			name: "two primary interfaces",
+			msg: common.Message{Message1: common.Message1{Network: common.NetworkMessage{
+				InterfaceMessage: common.InterfaceMessage{Primary: true},
+				Interfaces:       []common.InterfaceMessage{{Primary: true}},
+			}}},
+		},
+		{
+			name: "driver failure",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			opt := Opt{NetworkDriver: failingNetworkDriver{}, SkipLoopback: true}
+			taps, cleanupNet, err := setupNet(context.Background(), &tc.msg, nil, opt)
+			if err == nil {
+				t.Fatalf("expected an error, got taps %v", taps)
+			}
+			if cleanupNet != nil {
+				t.Fatal("expected no cleanup function on error, as setupNet cleans up by itself")
+			}
+		})
+	}
+}
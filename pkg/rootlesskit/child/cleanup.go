@@ -0,0 +1,75 @@
+package child
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// CleanupStateDir specifies whether the files created by the child under StateDir are removed on exit.
+type CleanupStateDir string
+
+const (
+	// CleanupStateDirNever keeps the files.
+	CleanupStateDirNever CleanupStateDir = "never"
+	// CleanupStateDirAlways removes the files.
+	CleanupStateDirAlways CleanupStateDir = "always"
+	// CleanupStateDirKeepOnError removes the files unless the setup or the target command failed.
+	CleanupStateDirKeepOnError CleanupStateDir = "keep-on-error"
+)
+
+// stateDirFiles returns the files under stateDir that may be created by the child.
+// The status file is not included, as it is always removed by removeStatus.
+func stateDirFiles(stateDir string, opt Opt) []string {
+	res := []string{
+		filepath.Join(stateDir, "resolv.conf"),
+		filepath.Join(stateDir, "hosts"),
+	}
+	for _, p := range []string{opt.StdoutLog, opt.StderrLog} {
+		if p == "" {
+			continue
+		}
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(stateDir, p)
+		}
+		rel, err := filepath.Rel(stateDir, p)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+			continue
+		}
+		res = append(res, p)
+	}
+	return res
+}
+
+// prepareCleanupStateDir needs to be called before creating the files under stateDir.
+// The returned function removes the files that did not exist on calling prepareCleanupStateDir,
+// and needs to be called with the error returned by Child.
+func prepareCleanupStateDir(stateDir string, opt Opt) (func(error), error) {
+	switch opt.CleanupStateDir {
+	case "", CleanupStateDirNever:
+		return func(error) {}, nil
+	case CleanupStateDirAlways, CleanupStateDirKeepOnError:
+	default:
+		return nil, errors.Errorf("unknown state dir cleanup policy: %q", opt.CleanupStateDir)
+	}
+	var created []string
+	for _, p := range stateDirFiles(stateDir, opt) {
+		if _, err := os.Lstat(p); os.IsNotExist(err) {
+			created = append(created, p)
+		}
+	}
+	return func(childErr error) {
+		if childErr != nil && opt.CleanupStateDir == CleanupStateDirKeepOnError {
+			logrus.Infof("keeping the files under %s for debugging", stateDir)
+			return
+		}
+		for _, p := range created {
+			if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+				logrus.WithError(err).Warnf("failed to remove %s", p)
+			}
+		}
+	}, nil
+}
@@ -0,0 +1,110 @@
+package child
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/rancher/k3s/pkg/rootlesskit/common"
+)
+
+// conntrackHelper is the default port of a conntrack helper, for assigning the helper with the CT target.
+type conntrackHelper struct {
+	proto string
+	port  int
+}
+
+var conntrackHelpers = map[string]conntrackHelper{
+	"ftp":  {"tcp", 21},
+	"irc":  {"tcp", 6667},
+	"pptp": {"tcp", 1723},
+	"sip":  {"udp", 5060},
+	"tftp": {"udp", 69},
+}
+
+// conntrackHelperSysctl enables the automatic helper assignment, removed in Linux 6.0.
+const conntrackHelperSysctl = "/proc/sys/net/netfilter/nf_conntrack_helper"
+
+func validateConntrackHelpers(helpers []string) error {
+	for _, h := range helpers {
+		if _, ok := conntrackHelpers[h]; !ok {
+			var names []string
+			for name := range conntrackHelpers {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return errors.Errorf("unknown conntrack helper %q (valid: %s)", h, strings.Join(names, ", "))
+		}
+	}
+	return nil
+}
+
+// conntrackHelperAvailable returns true if the module of the helper is loaded (or built-in) on the host.
+// The module cannot be loaded from the namespace, as loading modules needs the privilege on the host.
+func conntrackHelperAvailable(name string) bool {
+	module := "nf_conntrack_" + name
+	if _, err := os.Stat("/sys/module/" + module); err == nil {
+		return true
+	}
+	b, err := ioutil.ReadFile("/proc/modules")
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if strings.HasPrefix(line, module+" ") {
+			return true
+		}
+	}
+	return false
+}
+
+// enableConntrackHelpers assigns the conntrack helpers to the connections on their default ports,
+// in the network namespace.
+// The helpers that cannot be enabled are warned, not failed.
+func enableConntrackHelpers(ctx context.Context, helpers []string) error {
+	if err := validateConntrackHelpers(helpers); err != nil {
+		return err
+	}
+	if len(helpers) == 0 {
+		return nil
+	}
+	// the sysctl is per network namespace, and suffices on the kernels that have it
+	if _, err := os.Stat(conntrackHelperSysctl); err == nil {
+		if common.IsDryRun(ctx) {
+			logrus.Infof("[dry-run] writing \"1\" to %s", conntrackHelperSysctl)
+		} else if err := ioutil.WriteFile(conntrackHelperSysctl, []byte("1"), 0644); err != nil {
+			logrus.WithError(err).Warnf("failed to enable the automatic conntrack helper assignment")
+		}
+	}
+	_, iptablesErr := exec.LookPath("iptables")
+	for _, name := range helpers {
+		if !common.IsDryRun(ctx) && !conntrackHelperAvailable(name) {
+			logrus.Warnf("conntrack helper %q is not available; load nf_conntrack_%s on the host (needs the host privilege)", name, name)
+			continue
+		}
+		if iptablesErr != nil {
+			logrus.WithError(iptablesErr).Warnf("conntrack helper %q cannot be assigned without iptables", name)
+			continue
+		}
+		h := conntrackHelpers[name]
+		var cmds [][]string
+		// OUTPUT for the connections from the namespace, PREROUTING for the connections to the namespace
+		for _, chain := range []string{"OUTPUT", "PREROUTING"} {
+			cmds = append(cmds, []string{"iptables", "-t", "raw", "-A", chain,
+				"-p", h.proto, "--dport", strconv.Itoa(h.port), "-j", "CT", "--helper", name})
+		}
+		if err := common.ExecsContext(ctx, os.Stderr, os.Environ(), cmds); err != nil {
+			logrus.WithError(err).Warnf("failed to assign conntrack helper %q", name)
+			continue
+		}
+		logrus.Debugf("assigned conntrack helper %q to %s port %d", name, h.proto, h.port)
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package child
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/rancher/k3s/pkg/rootlesskit/common"
+	"github.com/rancher/k3s/pkg/rootlesskit/msgutil"
+)
+
+// dnsUpdater updates the DNS servers in /etc/resolv.conf, for Message 3 and ControlRequestDNS.
+type dnsUpdater struct {
+	mu       sync.Mutex
+	stateDir string
+	netmsg   common.NetworkMessage
+	copiedUp bool
+	opt      Opt
+}
+
+func newDNSUpdater(msg common.Message, copied []string, opt Opt) *dnsUpdater {
+	return &dnsUpdater{
+		stateDir: msg.StateDir,
+		netmsg:   msg.Network,
+		copiedUp: copiedUp(copied, "/etc/resolv.conf"),
+		opt:      opt,
+	}
+}
+
+func (u *dnsUpdater) update(servers []string) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.opt.NetworkDriver == nil {
+		return errors.New("cannot update DNS servers for HostNetwork")
+	}
+	if u.netmsg.DNSBridgeFD != 0 {
+		return errors.New("cannot update DNS servers, as the DNS queries are forwarded with the DNS bridge")
+	}
+	if u.netmsg.ResolvConfPath != "" {
+		return errors.Errorf("cannot update DNS servers, as /etc/resolv.conf is mounted from %s", u.netmsg.ResolvConfPath)
+	}
+	netmsg := u.netmsg
+	netmsg.DNS = ""
+	netmsg.DNSServers = servers
+	if err := updateResolvConf(u.stateDir, netmsg, u.copiedUp, u.opt.PreserveResolvConf); err != nil {
+		return errors.Wrapf(err, "failed to update DNS servers to %v", servers)
+	}
+	u.netmsg = netmsg
+	logrus.Infof("updated DNS servers to %v", servers)
+	return nil
+}
+
+// serveControl handles Message 3 sent by the parent after Message 2,
+// until the parent closes the socketpair.
+// pipe is closed on return.
+func serveControl(pipe io.ReadCloser, dns *dnsUpdater) {
+	defer pipe.Close()
+	for {
+		var m common.Message
+		if _, err := msgutil.UnmarshalFromReader(pipe, &m); err != nil {
+			if err != io.EOF {
+				logrus.WithError(err).Warn("failed to read a control message from the parent")
+			}
+			return
+		}
+		if m.Stage != 3 {
+			logrus.Warnf("ignoring a control message with unexpected stage %d", m.Stage)
+			continue
+		}
+		if err := dns.update(m.DNSServers); err != nil {
+			logrus.WithError(err).Warn("ignoring DNS servers")
+		}
+	}
+}
+
+// serveControlSocket connects to ns.Message.ControlSocketPath and handles ControlRequest,
+// until the parent closes the connection.
+func serveControlSocket(ns *Namespace, dns *dnsUpdater) {
+	p := ns.Message.ControlSocketPath
+	conn, err := net.Dial("unix", p)
+	if err != nil {
+		logrus.WithError(err).Warnf("failed to connect to the control socket %s", p)
+		return
+	}
+	defer conn.Close()
+	for {
+		var req common.ControlRequest
+		if _, err := msgutil.UnmarshalFromReader(conn, &req); err != nil {
+			if err != io.EOF {
+				logrus.WithError(err).Warn("failed to read a control request from the parent")
+			}
+			return
+		}
+		var res common.ControlResponse
+		if err := handleControlRequest(&res, req, ns, dns); err != nil {
+			res.Error = err.Error()
+		}
+		if _, err := msgutil.MarshalToWriter(conn, &res); err != nil {
+			logrus.WithError(err).Warn("failed to send a control response to the parent")
+			return
+		}
+	}
+}
+
+func handleControlRequest(res *common.ControlResponse, req common.ControlRequest, ns *Namespace, dns *dnsUpdater) error {
+	switch req.Type {
+	case common.ControlRequestDNS:
+		return dns.update(req.DNSServers)
+	case common.ControlRequestStatus:
+		st, err := ns.status()
+		if err != nil {
+			return err
+		}
+		res.Status, err = json.Marshal(st)
+		return err
+	default:
+		return errors.Errorf("unknown control request type %q", req.Type)
+	}
+}
@@ -0,0 +1,50 @@
+package child
+
+import (
+	"syscall"
+
+	"github.com/opencontainers/runc/libcontainer/user"
+	"github.com/pkg/errors"
+)
+
+// createCredential returns the credential for opt.RunAsUser, opt.RunAsGroup, and opt.SupplementaryGroups.
+// Names are resolved using /etc/passwd and /etc/group in the namespace.
+// Numeric ids are accepted without the entries.
+// nil is returned when none of them is specified.
+func createCredential(opt Opt) (*syscall.Credential, error) {
+	if opt.RunAsUser == "" && opt.RunAsGroup == "" && len(opt.SupplementaryGroups) == 0 {
+		return nil, nil
+	}
+	userSpec := opt.RunAsUser
+	if opt.RunAsGroup != "" {
+		userSpec += ":" + opt.RunAsGroup
+	}
+	defaults := &user.ExecUser{
+		Uid:  0,
+		Gid:  0,
+		Home: "/",
+	}
+	passwdPath, err := user.GetPasswdPath()
+	if err != nil {
+		return nil, err
+	}
+	groupPath, err := user.GetGroupPath()
+	if err != nil {
+		return nil, err
+	}
+	execUser, err := user.GetExecUserPath(userSpec, defaults, passwdPath, groupPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "resolving user %q", userSpec)
+	}
+	cred := &syscall.Credential{
+		Uid: uint32(execUser.Uid),
+		Gid: uint32(execUser.Gid),
+	}
+	for _, g := range append(execUser.Sgids, opt.SupplementaryGroups...) {
+		if g < 0 {
+			return nil, errors.Errorf("invalid supplementary group %d", g)
+		}
+		cred.Groups = append(cred.Groups, uint32(g))
+	}
+	return cred, nil
+}
@@ -0,0 +1,73 @@
+package child
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCreateCredential(t *testing.T) {
+	testCases := []struct {
+		name    string
+		opt     Opt
+		nilCred bool
+		groups  []uint32
+		wantErr bool
+	}{
+		{name: "none", nilCred: true},
+		{name: "uid only", opt: Opt{RunAsUser: "1000"}},
+		{name: "groups only", opt: Opt{SupplementaryGroups: []int{10, 20}}, groups: []uint32{10, 20}},
+		{name: "uid and groups", opt: Opt{RunAsUser: "1000", RunAsGroup: "1000", SupplementaryGroups: []int{30}}, groups: []uint32{30}},
+		{name: "negative group", opt: Opt{SupplementaryGroups: []int{-1}}, wantErr: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cred, err := createCredential(tc.opt)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", cred)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.nilCred {
+				if cred != nil {
+					t.Fatalf("expected nil, got %+v", cred)
+				}
+				return
+			}
+			if cred == nil {
+				t.Fatal("expected a credential, got nil")
+			}
+			if !reflect.DeepEqual(cred.Groups, tc.groups) {
+				t.Fatalf("expected groups %v, got %v", tc.groups, cred.Groups)
+			}
+		})
+	}
+}
+
+func TestSupplementaryGroups(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("setting supplementary groups requires root")
+	}
+	cmd, err := createCmd(context.Background(), Opt{SupplementaryGroups: []int{10, 20}}, []string{"id", "-G"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	// id -G prints the effective gid followed by the groups returned from getgroups
+	got := strings.Fields(stdout.String())
+	expected := []string{"0", "10", "20"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected groups %v, got %v", expected, got)
+	}
+}
@@ -0,0 +1,99 @@
+package child
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+
+	"github.com/rancher/k3s/pkg/rootlesskit/common"
+)
+
+// devNode is a device node bind-mounted from the host for Opt.SetupDev.
+type devNode struct {
+	name string
+	// optional nodes are skipped with a warning when the bind-mount fails
+	optional bool
+}
+
+var devNodes = []devNode{
+	{name: "null"},
+	{name: "zero"},
+	{name: "full"},
+	{name: "random"},
+	{name: "urandom"},
+	{name: "tty", optional: true},
+}
+
+// devSymlinks maps the names under /dev to the targets.
+var devSymlinks = [][2]string{
+	{"fd", "/proc/self/fd"},
+	{"stdin", "/proc/self/fd/0"},
+	{"stdout", "/proc/self/fd/1"},
+	{"stderr", "/proc/self/fd/2"},
+	{"ptmx", "pts/ptmx"},
+}
+
+// setupDev mounts a private tmpfs on /dev for Opt.SetupDev.
+// The tmpfs is prepared in a staging directory and then moved to /dev,
+// as the device nodes of the host are bind-mounted from /dev.
+// The nodes cannot be created with mknod(2) in the user namespace.
+func setupDev(ctx context.Context) error {
+	tmp, err := ioutil.TempDir("/tmp", "rkdev")
+	if err != nil {
+		return errors.Wrap(err, "creating a directory under /tmp")
+	}
+	defer removeStagingDir(ctx, "dev", tmp)
+	if err := mount(ctx, "tmpfs", tmp, "tmpfs", unix.MS_NOSUID|unix.MS_NOEXEC, "mode=755,size=65536k"); err != nil {
+		return errors.Wrapf(err, "mounting tmpfs on %s", tmp)
+	}
+	for _, n := range devNodes {
+		if err := bindDevNode(ctx, filepath.Join("/dev", n.name), filepath.Join(tmp, n.name)); err != nil {
+			if !n.optional {
+				return err
+			}
+			logrus.WithField("phase", "dev").WithError(err).Warnf("skipping /dev/%s", n.name)
+		}
+	}
+	if !common.IsDryRun(ctx) {
+		for _, l := range devSymlinks {
+			if err := os.Symlink(l[1], filepath.Join(tmp, l[0])); err != nil {
+				return errors.Wrapf(err, "creating /dev/%s", l[0])
+			}
+		}
+		for _, d := range []string{"pts", "shm"} {
+			if err := os.Mkdir(filepath.Join(tmp, d), 0755); err != nil {
+				return errors.Wrapf(err, "creating /dev/%s", d)
+			}
+		}
+	}
+	if err := mount(ctx, "devpts", filepath.Join(tmp, "pts"), "devpts", unix.MS_NOSUID|unix.MS_NOEXEC, "newinstance,ptmxmode=0666,mode=0620"); err != nil {
+		logrus.WithField("phase", "dev").WithError(err).Warn("failed to mount devpts on /dev/pts")
+	}
+	if err := mount(ctx, "shm", filepath.Join(tmp, "shm"), "tmpfs", unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, "mode=1777,size=65536k"); err != nil {
+		logrus.WithField("phase", "dev").WithError(err).Warn("failed to mount tmpfs on /dev/shm")
+	}
+	if err := mount(ctx, tmp, "/dev", "", unix.MS_MOVE, ""); err != nil {
+		return errors.Wrapf(err, "moving %s to /dev", tmp)
+	}
+	return nil
+}
+
+// bindDevNode bind-mounts the device node src on dst, creating dst as a regular file.
+func bindDevNode(ctx context.Context, src, dst string) error {
+	if !common.IsDryRun(ctx) {
+		f, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			return errors.Wrapf(err, "creating %s", dst)
+		}
+		f.Close()
+	}
+	if err := mount(ctx, src, dst, "", unix.MS_BIND, ""); err != nil {
+		return errors.Wrapf(err, "bind-mounting %s", src)
+	}
+	return nil
+}
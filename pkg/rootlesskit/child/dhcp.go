@@ -0,0 +1,359 @@
+package child
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// Minimal DHCPv4 client (RFC 2131), for leasing the address of a tap device.
+// The lease is renewed, but a changed address is not applied to the running namespace.
+
+const (
+	dhcpServerPort = 67
+	dhcpClientPort = 68
+
+	dhcpDiscover = 1
+	dhcpOffer    = 2
+	dhcpRequest  = 3
+	dhcpAck      = 5
+	dhcpNak      = 6
+
+	dhcpOptSubnetMask    = 1
+	dhcpOptRouter        = 3
+	dhcpOptDNS           = 6
+	dhcpOptRequestedIP   = 50
+	dhcpOptLeaseTime     = 51
+	dhcpOptMessageType   = 53
+	dhcpOptServerID      = 54
+	dhcpOptParamList     = 55
+	dhcpOptRenewalTime   = 58
+	dhcpOptEnd           = 255
+	dhcpOptPad           = 0
+	dhcpHeaderLen        = 236
+	dhcpReplyTimeout     = 3 * time.Second
+	dhcpAttempts         = 4
+	dhcpMinRenewInterval = 10 * time.Second
+)
+
+var dhcpMagicCookie = []byte{99, 130, 83, 99}
+
+// dhcpLease is the configuration leased from the DHCP server.
+type dhcpLease struct {
+	IP        net.IP
+	Netmask   int
+	Gateway   net.IP // can be nil
+	DNS       []string
+	ServerID  net.IP
+	LeaseTime time.Duration
+	T1        time.Duration
+}
+
+// renewalInterval is T1, or the half of the lease time.
+func (l *dhcpLease) renewalInterval() time.Duration {
+	d := l.T1
+	if d <= 0 {
+		d = l.LeaseTime / 2
+	}
+	if d < dhcpMinRenewInterval {
+		d = dhcpMinRenewInterval
+	}
+	return d
+}
+
+// dhcpClient is bound to the UDP port 68 of the tap device.
+type dhcpClient struct {
+	tap  string
+	mac  net.HardwareAddr
+	conn net.PacketConn
+}
+
+// newDHCPClient needs to be called after bringing up tap.
+func newDHCPClient(tap string) (*dhcpClient, error) {
+	netIf, err := net.InterfaceByName(tap)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, unix.IPPROTO_UDP)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating DHCP socket")
+	}
+	f := os.NewFile(uintptr(fd), "dhcp")
+	defer f.Close()
+	for _, opt := range []int{unix.SO_REUSEADDR, unix.SO_BROADCAST} {
+		if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, opt, 1); err != nil {
+			return nil, errors.Wrap(err, "setting DHCP socket options")
+		}
+	}
+	if err := unix.BindToDevice(fd, tap); err != nil {
+		return nil, errors.Wrapf(err, "binding DHCP socket to %s", tap)
+	}
+	if err := unix.Bind(fd, &unix.SockaddrInet4{Port: dhcpClientPort}); err != nil {
+		return nil, errors.Wrap(err, "binding DHCP socket")
+	}
+	conn, err := net.FilePacketConn(f)
+	if err != nil {
+		return nil, err
+	}
+	return &dhcpClient{
+		tap:  tap,
+		mac:  netIf.HardwareAddr,
+		conn: conn,
+	}, nil
+}
+
+func (c *dhcpClient) Close() error {
+	return c.conn.Close()
+}
+
+// lease obtains a lease with DISCOVER, OFFER, REQUEST, and ACK.
+func (c *dhcpClient) lease(ctx context.Context) (*dhcpLease, error) {
+	xid, err := newDHCPXID()
+	if err != nil {
+		return nil, err
+	}
+	var offer *dhcpLease
+	for i := 0; i < dhcpAttempts && offer == nil; i++ {
+		offer, err = c.exchange(ctx, c.packet(dhcpDiscover, xid, nil, nil, nil), xid, dhcpOffer)
+	}
+	if offer == nil {
+		return nil, dhcpNoReply(err, "offer", c.tap)
+	}
+	req := c.packet(dhcpRequest, xid, nil, offer.IP, offer.ServerID)
+	for i := 0; i < dhcpAttempts; i++ {
+		var ack *dhcpLease
+		ack, err = c.exchange(ctx, req, xid, dhcpAck)
+		if ack != nil {
+			return ack, nil
+		}
+	}
+	return nil, dhcpNoReply(err, "ack", c.tap)
+}
+
+// dhcpNoReply returns the error for no reply. err can be nil for timeouts.
+func dhcpNoReply(err error, what, tap string) error {
+	if err == nil {
+		return errors.Errorf("no DHCP %s on %s in %d attempts", what, tap, dhcpAttempts)
+	}
+	return errors.Wrapf(err, "no DHCP %s on %s", what, tap)
+}
+
+// renew extends l in the RENEWING state.
+func (c *dhcpClient) renew(ctx context.Context, l *dhcpLease) (*dhcpLease, error) {
+	xid, err := newDHCPXID()
+	if err != nil {
+		return nil, err
+	}
+	return c.exchange(ctx, c.packet(dhcpRequest, xid, l.IP, nil, nil), xid, dhcpAck)
+}
+
+// exchange broadcasts pkt, and waits for a reply of msgType.
+// Returns nil without an error when no reply was received in dhcpReplyTimeout.
+func (c *dhcpClient) exchange(ctx context.Context, pkt []byte, xid uint32, msgType byte) (*dhcpLease, error) {
+	dst := &net.UDPAddr{IP: net.IPv4bcast, Port: dhcpServerPort}
+	if _, err := c.conn.WriteTo(pkt, dst); err != nil {
+		return nil, errors.Wrap(err, "sending DHCP request")
+	}
+	deadline := time.Now().Add(dhcpReplyTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	c.conn.SetReadDeadline(deadline)
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := c.conn.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+				return nil, nil
+			}
+			return nil, errors.Wrap(err, "receiving DHCP reply")
+		}
+		typ, l, ok := c.parseReply(buf[:n], xid)
+		if !ok {
+			continue
+		}
+		switch typ {
+		case msgType:
+			return l, nil
+		case dhcpNak:
+			return nil, errors.Errorf("got DHCP NAK on %s", c.tap)
+		}
+	}
+}
+
+func newDHCPXID() (uint32, error) {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(b), nil
+}
+
+// packet creates a DHCP message. ciaddr, requestedIP, and serverID can be nil.
+func (c *dhcpClient) packet(msgType byte, xid uint32, ciaddr, requestedIP, serverID net.IP) []byte {
+	b := make([]byte, dhcpHeaderLen)
+	b[0] = 1 // BOOTREQUEST
+	b[1] = 1 // Ethernet
+	b[2] = 6
+	binary.BigEndian.PutUint32(b[4:8], xid)
+	if ciaddr != nil {
+		copy(b[12:16], ciaddr.To4())
+	} else {
+		// ask the server to broadcast the reply, as we have no address yet
+		binary.BigEndian.PutUint16(b[10:12], 0x8000)
+	}
+	copy(b[28:44], c.mac)
+	b = append(b, dhcpMagicCookie...)
+	b = append(b, dhcpOptMessageType, 1, msgType)
+	if requestedIP != nil {
+		b = append(b, dhcpOptRequestedIP, 4)
+		b = append(b, requestedIP.To4()...)
+	}
+	if serverID != nil {
+		b = append(b, dhcpOptServerID, 4)
+		b = append(b, serverID.To4()...)
+	}
+	b = append(b, dhcpOptParamList, 5, dhcpOptSubnetMask, dhcpOptRouter, dhcpOptDNS, dhcpOptLeaseTime, dhcpOptRenewalTime)
+	return append(b, dhcpOptEnd)
+}
+
+// parseReply returns false for the packets not addressed to c.
+func (c *dhcpClient) parseReply(b []byte, xid uint32) (byte, *dhcpLease, bool) {
+	if len(b) < dhcpHeaderLen+len(dhcpMagicCookie) || b[0] != 2 ||
+		binary.BigEndian.Uint32(b[4:8]) != xid ||
+		!bytes.Equal(b[28:28+len(c.mac)], c.mac) ||
+		!bytes.Equal(b[dhcpHeaderLen:dhcpHeaderLen+len(dhcpMagicCookie)], dhcpMagicCookie) {
+		return 0, nil, false
+	}
+	l := &dhcpLease{
+		IP: net.IP(append([]byte{}, b[16:20]...)),
+	}
+	var typ byte
+	opts := b[dhcpHeaderLen+len(dhcpMagicCookie):]
+	for len(opts) > 0 {
+		code := opts[0]
+		if code == dhcpOptEnd {
+			break
+		}
+		if code == dhcpOptPad {
+			opts = opts[1:]
+			continue
+		}
+		if len(opts) < 2 || len(opts) < 2+int(opts[1]) {
+			return 0, nil, false
+		}
+		v := opts[2 : 2+int(opts[1])]
+		opts = opts[2+int(opts[1]):]
+		switch code {
+		case dhcpOptMessageType:
+			if len(v) == 1 {
+				typ = v[0]
+			}
+		case dhcpOptSubnetMask:
+			if len(v) == 4 {
+				l.Netmask, _ = net.IPMask(v).Size()
+			}
+		case dhcpOptRouter:
+			if len(v) >= 4 {
+				l.Gateway = net.IP(append([]byte{}, v[:4]...))
+			}
+		case dhcpOptDNS:
+			for i := 0; i+4 <= len(v); i += 4 {
+				l.DNS = append(l.DNS, net.IP(v[i:i+4]).String())
+			}
+		case dhcpOptServerID:
+			if len(v) == 4 {
+				l.ServerID = net.IP(append([]byte{}, v...))
+			}
+		case dhcpOptLeaseTime:
+			if len(v) == 4 {
+				l.LeaseTime = time.Duration(binary.BigEndian.Uint32(v)) * time.Second
+			}
+		case dhcpOptRenewalTime:
+			if len(v) == 4 {
+				l.T1 = time.Duration(binary.BigEndian.Uint32(v)) * time.Second
+			}
+		}
+	}
+	return typ, l, true
+}
+
+// bringUpTap sets mac (optional) and brings up tap, for sending DHCP requests.
+func bringUpTap(ctx context.Context, tap, mac string) error {
+	var cmds [][]string
+	if mac != "" {
+		if _, err := net.ParseMAC(mac); err != nil {
+			return errors.Wrapf(err, "invalid MAC address %q for %s", mac, tap)
+		}
+		cmds = append(cmds, []string{"ip", "link", "set", "dev", tap, "address", mac})
+	}
+	cmds = append(cmds, []string{"ip", "link", "set", tap, "up"})
+	if err := execIPCommands(ctx, cmds); err != nil {
+		return errors.Wrapf(err, "executing %v", cmds)
+	}
+	return nil
+}
+
+// leaseDHCP obtains a lease on tap, and returns the function that stops renewing the lease.
+// tap needs to be up.
+func leaseDHCP(ctx context.Context, tap string) (*dhcpLease, func(), error) {
+	c, err := newDHCPClient(tap)
+	if err != nil {
+		return nil, nil, err
+	}
+	l, err := c.lease(ctx)
+	if err != nil {
+		c.Close()
+		return nil, nil, err
+	}
+	if l.IP.IsUnspecified() || l.Netmask == 0 {
+		c.Close()
+		return nil, nil, errors.Errorf("got an incomplete DHCP lease on %s: %+v", tap, *l)
+	}
+	logrus.Debugf("leased %s/%d on %s: %+v", l.IP, l.Netmask, tap, *l)
+	renewCtx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer c.Close()
+		current := l
+		interval := current.renewalInterval()
+		for {
+			select {
+			case <-renewCtx.Done():
+				return
+			case <-time.After(interval):
+			}
+			renewed, err := c.renew(renewCtx, current)
+			if renewed == nil {
+				if renewCtx.Err() != nil {
+					return
+				}
+				logrus.WithError(err).Warnf("failed to renew the DHCP lease of %s on %s", current.IP, tap)
+				interval = dhcpMinRenewInterval
+				continue
+			}
+			if !renewed.IP.Equal(current.IP) {
+				logrus.Warnf("DHCP server assigned %s instead of %s on %s; the address is not updated", renewed.IP, current.IP, tap)
+			}
+			current = renewed
+			interval = current.renewalInterval()
+			logrus.Debugf("renewed the DHCP lease of %s on %s", current.IP, tap)
+		}
+	}()
+	return l, func() {
+		cancel()
+		<-done
+	}, nil
+}
@@ -0,0 +1,226 @@
+package child
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/rancher/k3s/pkg/rootlesskit/common"
+)
+
+// dnsBridgeAddr is the address of the forwarder for common.NetworkMessage.DNSBridgeFD,
+// the same as the systemd-resolved stub.
+const dnsBridgeAddr = "127.0.0.53"
+
+const (
+	dnsBridgeTimeout    = 5 * time.Second
+	dnsBridgeTCPTimeout = 10 * time.Second
+)
+
+// dnsBridge forwards the DNS queries to the upstreams over the socket in the network namespace of the parent.
+// The IDs of the queries are rewritten, as the queries from the clients share the socket.
+type dnsBridge struct {
+	conn      net.PacketConn
+	upstreams []*net.UDPAddr
+	mu        sync.Mutex
+	nextID    uint16
+	pending   map[uint16]chan []byte
+}
+
+// startDNSBridge starts the forwarder on dnsBridgeAddr:53 over UDP and TCP.
+// The returned function stops the forwarder.
+func startDNSBridge(ctx context.Context, netmsg common.NetworkMessage) (func(), error) {
+	if common.IsDryRun(ctx) {
+		logrus.Infof("[dry-run] forwarding DNS queries on %s to %v", dnsBridgeAddr, netmsg.DNSBridgeUpstreams)
+		return func() {}, nil
+	}
+	b := &dnsBridge{
+		pending: make(map[uint16]chan []byte),
+	}
+	for _, u := range netmsg.DNSBridgeUpstreams {
+		addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(u, "53"))
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid DNS bridge upstream %q", u)
+		}
+		b.upstreams = append(b.upstreams, addr)
+	}
+	if len(b.upstreams) == 0 {
+		return nil, errors.New("no DNS bridge upstream")
+	}
+	f := os.NewFile(uintptr(netmsg.DNSBridgeFD), "dns-bridge")
+	conn, err := net.FilePacketConn(f)
+	f.Close()
+	if err != nil {
+		return nil, errors.Wrapf(err, "using fd %d for the DNS bridge", netmsg.DNSBridgeFD)
+	}
+	b.conn = conn
+	addr := net.JoinHostPort(dnsBridgeAddr, "53")
+	udp, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrapf(err, "listening on udp %s", addr)
+	}
+	tcp, err := net.Listen("tcp", addr)
+	if err != nil {
+		udp.Close()
+		conn.Close()
+		return nil, errors.Wrapf(err, "listening on tcp %s", addr)
+	}
+	go b.readResponses()
+	go b.serveUDP(udp)
+	go b.serveTCP(tcp)
+	logrus.Debugf("forwarding DNS queries on %s to %v", addr, netmsg.DNSBridgeUpstreams)
+	return func() {
+		tcp.Close()
+		udp.Close()
+		conn.Close()
+	}, nil
+}
+
+func (b *dnsBridge) register() (uint16, chan []byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i := 0; i < 1<<16; i++ {
+		id := b.nextID
+		b.nextID++
+		if _, ok := b.pending[id]; !ok {
+			ch := make(chan []byte, 1)
+			b.pending[id] = ch
+			return id, ch, nil
+		}
+	}
+	return 0, nil, errors.New("too many DNS queries in flight")
+}
+
+func (b *dnsBridge) unregister(id uint16) {
+	b.mu.Lock()
+	delete(b.pending, id)
+	b.mu.Unlock()
+}
+
+// query sends q to the upstreams in order until one of them responds.
+func (b *dnsBridge) query(q []byte) ([]byte, error) {
+	if len(q) < 12 {
+		return nil, errors.Errorf("too short DNS message (%d bytes)", len(q))
+	}
+	id, ch, err := b.register()
+	if err != nil {
+		return nil, err
+	}
+	defer b.unregister(id)
+	fwd := make([]byte, len(q))
+	copy(fwd, q)
+	binary.BigEndian.PutUint16(fwd, id)
+	for _, u := range b.upstreams {
+		if _, err = b.conn.WriteTo(fwd, u); err != nil {
+			continue
+		}
+		select {
+		case res := <-ch:
+			copy(res, q[:2])
+			return res, nil
+		case <-time.After(dnsBridgeTimeout):
+			err = errors.Errorf("timed out waiting for the response from %s", u)
+		}
+	}
+	return nil, err
+}
+
+// readResponses dispatches the responses from the upstreams to the pending queries.
+func (b *dnsBridge) readResponses() {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := b.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if n < 12 || !b.isUpstream(addr) {
+			continue
+		}
+		b.mu.Lock()
+		ch, ok := b.pending[binary.BigEndian.Uint16(buf)]
+		b.mu.Unlock()
+		if !ok {
+			continue
+		}
+		res := make([]byte, n)
+		copy(res, buf)
+		select {
+		case ch <- res:
+		default:
+		}
+	}
+}
+
+func (b *dnsBridge) isUpstream(addr net.Addr) bool {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+	for _, u := range b.upstreams {
+		if u.IP.Equal(udpAddr.IP) && u.Port == udpAddr.Port {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *dnsBridge) serveUDP(l net.PacketConn) {
+	buf := make([]byte, 65535)
+	for {
+		n, client, err := l.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		q := make([]byte, n)
+		copy(q, buf)
+		go func() {
+			res, err := b.query(q)
+			if err != nil {
+				logrus.WithError(err).Debug("failed to forward a DNS query")
+				return
+			}
+			l.WriteTo(res, client)
+		}()
+	}
+}
+
+// serveTCP handles the queries with the two-byte length prefix, but forwards them over UDP.
+func (b *dnsBridge) serveTCP(l net.Listener) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer c.Close()
+			for {
+				c.SetDeadline(time.Now().Add(dnsBridgeTCPTimeout))
+				var hdr [2]byte
+				if _, err := io.ReadFull(c, hdr[:]); err != nil {
+					return
+				}
+				q := make([]byte, binary.BigEndian.Uint16(hdr[:]))
+				if _, err := io.ReadFull(c, q); err != nil {
+					return
+				}
+				res, err := b.query(q)
+				if err != nil {
+					logrus.WithError(err).Debug("failed to forward a DNS query")
+					return
+				}
+				binary.BigEndian.PutUint16(hdr[:], uint16(len(res)))
+				if _, err := c.Write(append(hdr[:], res...)); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
@@ -0,0 +1,49 @@
+package child
+
+import (
+	"os"
+	"sort"
+	"strings"
+)
+
+// createEnv returns the environment variables for the target command.
+//
+// The variables of the current process are filtered with opt.EnvKeep and opt.EnvDrop,
+// and then opt.EnvExtra is merged on top of them.
+// i.e. opt.EnvExtra wins over the kept host values.
+//
+// opt.PipeFDEnvKey is always removed.
+func createEnv(opt Opt) []string {
+	keep := make(map[string]bool, len(opt.EnvKeep))
+	for _, k := range opt.EnvKeep {
+		keep[k] = true
+	}
+	drop := make(map[string]bool, len(opt.EnvDrop)+1)
+	for _, k := range opt.EnvDrop {
+		drop[k] = true
+	}
+	drop[opt.PipeFDEnvKey] = true
+	var env []string
+	for _, kv := range os.Environ() {
+		k := strings.SplitN(kv, "=", 2)[0]
+		if len(keep) != 0 && !keep[k] {
+			continue
+		}
+		if drop[k] {
+			continue
+		}
+		if _, ok := opt.EnvExtra[k]; ok {
+			continue
+		}
+		env = append(env, kv)
+	}
+	extraKeys := make([]string, 0, len(opt.EnvExtra))
+	for k := range opt.EnvExtra {
+		extraKeys = append(extraKeys, k)
+	}
+	sort.Strings(extraKeys)
+	for _, k := range extraKeys {
+		env = append(env, k+"="+opt.EnvExtra[k])
+	}
+	return env
+}
@@ -0,0 +1,71 @@
+package child
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const verifyGatewayTimeout = 3 * time.Second
+
+// verifyGateway sends an ICMP echo request to the IPv4 gateway and waits for the reply until the timeout.
+func verifyGateway(gateway string, timeout time.Duration) error {
+	ip := net.ParseIP(gateway).To4()
+	if ip == nil {
+		return errors.Errorf("invalid IPv4 gateway %q", gateway)
+	}
+	c, err := net.ListenPacket("ip4:icmp", "0.0.0.0")
+	if err != nil {
+		return errors.Wrap(err, "opening ICMP socket")
+	}
+	defer c.Close()
+	if err := c.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+	id := uint16(os.Getpid())
+	const seq = 1
+	// type=8 (echo request), code=0, checksum, id, seq
+	req := make([]byte, 8)
+	req[0] = 8
+	binary.BigEndian.PutUint16(req[4:], id)
+	binary.BigEndian.PutUint16(req[6:], seq)
+	binary.BigEndian.PutUint16(req[2:], icmpChecksum(req))
+	if _, err := c.WriteTo(req, &net.IPAddr{IP: ip}); err != nil {
+		return errors.Wrapf(err, "sending ICMP echo request to %s", gateway)
+	}
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := c.ReadFrom(buf)
+		if err != nil {
+			return errors.Wrapf(err, "waiting for ICMP echo reply from %s", gateway)
+		}
+		// the IPv4 header is stripped by the net package
+		rep := buf[:n]
+		if len(rep) < 8 || rep[0] != 0 {
+			continue
+		}
+		if fromIP, ok := from.(*net.IPAddr); !ok || !fromIP.IP.Equal(ip) {
+			continue
+		}
+		if binary.BigEndian.Uint16(rep[4:]) == id && binary.BigEndian.Uint16(rep[6:]) == seq {
+			return nil
+		}
+	}
+}
+
+func icmpChecksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,266 @@
+package child
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+
+	"github.com/rancher/k3s/pkg/rootlesskit/common"
+)
+
+// parseExtraHosts parses entries like "host ip" or "ip host",
+// and returns them in the "ip host" form.
+func parseExtraHosts(extraHosts []string) ([]string, error) {
+	var res []string
+	for _, e := range extraHosts {
+		fields := strings.Fields(e)
+		if len(fields) != 2 {
+			return nil, errors.Errorf("invalid extra host entry %q: expected \"host ip\" or \"ip host\"", e)
+		}
+		ip, host := fields[0], fields[1]
+		if net.ParseIP(ip) == nil {
+			ip, host = host, ip
+		}
+		if net.ParseIP(ip) == nil {
+			return nil, errors.Errorf("invalid extra host entry %q: no valid IP address", e)
+		}
+		if net.ParseIP(host) != nil {
+			return nil, errors.Errorf("invalid extra host entry %q: no host name", e)
+		}
+		res = append(res, ip+" "+host)
+	}
+	return res, nil
+}
+
+// DefaultHostGatewayAlias is the default of Opt.HostGatewayAlias.
+const DefaultHostGatewayAlias = "host.rootlesskit.internal"
+
+// hostGatewayEntries returns the "ip host" entries that map alias to the gateways of iface,
+// i.e. defaultGateways(iface) and iface.IPv6Gateway.
+func hostGatewayEntries(iface common.InterfaceMessage, alias string) []string {
+	if alias == "" {
+		alias = DefaultHostGatewayAlias
+	}
+	gws := defaultGateways(iface)
+	if iface.IPv6Gateway != "" {
+		gws = append(gws, iface.IPv6Gateway)
+	}
+	var res []string
+	for _, gw := range gws {
+		res = append(res, gw+" "+alias)
+	}
+	return res
+}
+
+// generateEtcHosts makes sure the current hostname is resolved into
+// 127.0.0.1 or ::1, not into the host eth0 IP address.
+// The existing entries in /etc/hosts are preserved, and the entries already present are not added again.
+//
+// When hostname is set, it is also resolved into 127.0.1.1.
+//
+// extraHosts needs to be parsed with parseExtraHosts in advance.
+//
+// Note that /etc/hosts is not used by nslookup/dig. (Use `getent ahostsv4` instead.)
+func generateEtcHosts(hostname string, extraHosts []string) ([]byte, error) {
+	etcHosts, err := ioutil.ReadFile("/etc/hosts")
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	current, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	s := string(etcHosts)
+	if s != "" && !strings.HasSuffix(s, "\n") {
+		s += "\n"
+	}
+	var entries []string
+	if hostname != "" {
+		entries = append(entries, "127.0.1.1 "+hostname)
+	}
+	entries = append(entries, "127.0.0.1 "+current, "::1 "+current)
+	entries = append(entries, extraHosts...)
+	for _, e := range entries {
+		fields := strings.Fields(e)
+		if !hasEtcHostsEntry(s, fields[0], fields[1]) {
+			s += e + "\n"
+		}
+	}
+	return []byte(s), nil
+}
+
+// hasEtcHostsEntry returns true if etcHosts already maps ip to host.
+func hasEtcHostsEntry(etcHosts, ip, host string) bool {
+	parsedIP := net.ParseIP(ip)
+	for _, line := range strings.Split(etcHosts, "\n") {
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 || !parsedIP.Equal(net.ParseIP(fields[0])) {
+			continue
+		}
+		for _, f := range fields[1:] {
+			if f == host {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// writeEtcHosts is akin to writeResolvConf, but writes the file atomically when possible.
+// TODO: dedupe
+func writeEtcHosts(hostname string, extraHosts []string) error {
+	newEtcHosts, err := generateEtcHosts(hostname, extraHosts)
+	if err != nil {
+		return err
+	}
+	warnReplacingSymlink("/etc/hosts")
+	return writeEtcFile("/etc/hosts", newEtcHosts)
+}
+
+// writeEtcFile writes the file in the copied-up /etc atomically when possible, otherwise in place.
+func writeEtcFile(p string, data []byte) error {
+	if err := writeFileAtomic(p, data, 0644); err != nil {
+		// e.g. when the file was copied up as a file, /etc is read-only and the file is a mount point
+		if err := ioutil.WriteFile(p, data, 0644); err != nil {
+			return errors.Wrapf(err, "writing %s", p)
+		}
+	}
+	return nil
+}
+
+// writeFileAtomic writes the file via a temporary file in the same directory.
+// A symlink on the path is replaced with the file.
+func writeFileAtomic(p string, data []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(p), "."+filepath.Base(p))
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), perm)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), p)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// writeFileInPlace truncates and writes the existing file p with a single write,
+// for the files that are bind-mounted elsewhere and cannot be replaced with writeFileAtomic,
+// as the bind-mount refers to the inode, not to the path.
+// The readers may observe the file empty, but not partially written.
+func writeFileInPlace(p string, data []byte) error {
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// resolveMountTarget resolves the symlink on p, as bind-mounting on a symlink
+// actually mounts on the target of the symlink.
+// e.g. /etc/resolv.conf is a symlink to ../run/systemd/resolve/stub-resolv.conf
+// on the hosts with systemd-resolved.
+func resolveMountTarget(p string) (string, error) {
+	st, err := os.Lstat(p)
+	if err != nil {
+		return "", errors.Wrapf(err, "stat %s", p)
+	}
+	if st.Mode()&os.ModeSymlink == 0 {
+		return p, nil
+	}
+	target, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		return "", errors.Wrapf(err, "%s is a symlink that cannot be resolved, copying-up /etc is needed", p)
+	}
+	logrus.Warnf("%s is a symlink, mounting on %s instead. Copying-up /etc is recommended.", p, target)
+	return target, nil
+}
+
+// warnReplacingSymlink warns when p is a symlink, before replacing it with a file in the copied-up /etc.
+// The symlinks created by the tmpfssymlink copy-up are replaced silently.
+func warnReplacingSymlink(p string) {
+	st, err := os.Lstat(p)
+	if err != nil || st.Mode()&os.ModeSymlink == 0 {
+		return
+	}
+	target, _ := os.Readlink(p)
+	if !isCopyUpSymlink(p, target) {
+		logrus.Warnf("replacing the symlink %s (to %s) with a file", p, target)
+	}
+}
+
+// isCopyUpSymlink returns true if the symlink p to target points into the read-only ".ro*" directory
+// created by the tmpfssymlink copy-up next to p.
+func isCopyUpSymlink(p, target string) bool {
+	dir := filepath.Dir(p)
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(dir, target)
+	}
+	rel, err := filepath.Rel(dir, target)
+	if err != nil {
+		return false
+	}
+	parts := strings.SplitN(rel, string(filepath.Separator), 2)
+	return len(parts) == 2 && strings.HasPrefix(parts[0], ".ro")
+}
+
+// mountEtcHosts is akin to mountResolvConf
+// TODO: dedupe
+func mountEtcHosts(ctx context.Context, tempDir, hostname string, extraHosts []string) error {
+	newEtcHosts, err := generateEtcHosts(hostname, extraHosts)
+	if err != nil {
+		return err
+	}
+	myEtcHosts := filepath.Join(tempDir, "hosts")
+	if err := ioutil.WriteFile(myEtcHosts, newEtcHosts, 0644); err != nil {
+		return errors.Wrapf(err, "writing %s", myEtcHosts)
+	}
+	target, err := resolveMountTarget("/etc/hosts")
+	if err != nil {
+		return err
+	}
+	cmds := [][]string{
+		{"mount", "--bind", myEtcHosts, target},
+	}
+	if err := common.ExecsContext(ctx, os.Stderr, os.Environ(), cmds); err != nil {
+		return errors.Wrapf(err, "executing %v", cmds)
+	}
+	return nil
+}
+
+// setHostname sets the hostname in the UTS namespace created by the parent.
+// Empty hostname is ignored.
+func setHostname(ctx context.Context, hostname string) error {
+	if hostname == "" {
+		return nil
+	}
+	if common.IsDryRun(ctx) {
+		logrus.Infof("[dry-run] setting hostname %q", hostname)
+		return nil
+	}
+	if err := unix.Sethostname([]byte(hostname)); err != nil {
+		return errors.Wrapf(err, "setting hostname %q", hostname)
+	}
+	return nil
+}
@@ -0,0 +1,258 @@
+package child
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"github.com/rancher/k3s/pkg/rootlesskit/common"
+)
+
+func TestHasEtcHostsEntry(t *testing.T) {
+	const etcHosts = `127.0.0.1	localhost
+::1	localhost ip6-localhost ip6-loopback
+# 10.0.0.1 commented
+10.0.0.2 foo bar # baz
+`
+	testCases := []struct {
+		ip       string
+		host     string
+		expected bool
+	}{
+		{"127.0.0.1", "localhost", true},
+		{"::1", "ip6-loopback", true},
+		{"0:0:0:0:0:0:0:1", "ip6-localhost", true},
+		{"127.0.0.1", "ip6-localhost", false},
+		{"10.0.0.1", "commented", false},
+		{"10.0.0.2", "bar", true},
+		{"10.0.0.2", "baz", false},
+		{"10.0.0.3", "foo", false},
+	}
+	for _, tc := range testCases {
+		if got := hasEtcHostsEntry(etcHosts, tc.ip, tc.host); got != tc.expected {
+			t.Errorf("hasEtcHostsEntry(%q, %q): expected %v, got %v", tc.ip, tc.host, tc.expected, got)
+		}
+	}
+}
+
+func TestWriteEtcHosts(t *testing.T) {
+	if !runInNamespaces(t, syscall.CLONE_NEWUTS) {
+		return
+	}
+	if err := syscall.Sethostname([]byte("current")); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Mount("none", "/etc", "tmpfs", 0, ""); err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		name       string
+		existing   *string
+		hostname   string
+		extraHosts []string
+		expected   string
+	}{
+		{
+			name:     "no existing file",
+			expected: "127.0.0.1 current\n::1 current\n",
+		},
+		{
+			name:     "pre-populated",
+			existing: strPtr("127.0.0.1\tlocalhost my-alias\n10.0.0.1 registry.local"),
+			hostname: "foo",
+			expected: "127.0.0.1\tlocalhost my-alias\n10.0.0.1 registry.local\n127.0.1.1 foo\n127.0.0.1 current\n::1 current\n",
+		},
+		{
+			name:       "already present",
+			existing:   strPtr("127.0.0.1 localhost current\n::1 localhost current\n127.0.1.1 foo\n"),
+			hostname:   "foo",
+			extraHosts: []string{"10.0.0.1 registry.local"},
+			expected:   "127.0.0.1 localhost current\n::1 localhost current\n127.0.1.1 foo\n10.0.0.1 registry.local\n",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_ = syscall.Unlink("/etc/hosts")
+			if tc.existing != nil {
+				if err := ioutil.WriteFile("/etc/hosts", []byte(*tc.existing), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// writing twice must not duplicate the entries
+			for i := 0; i < 2; i++ {
+				if err := writeEtcHosts(tc.hostname, tc.extraHosts); err != nil {
+					t.Fatal(err)
+				}
+			}
+			b, err := ioutil.ReadFile("/etc/hosts")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != tc.expected {
+				t.Fatalf("expected %q, got %q", tc.expected, string(b))
+			}
+		})
+	}
+}
+
+func TestHostGatewayEntries(t *testing.T) {
+	testCases := []struct {
+		name     string
+		netmsg   common.NetworkMessage
+		alias    string
+		expected []string
+	}{
+		{
+			name:     "default alias",
+			netmsg:   common.NetworkMessage{InterfaceMessage: common.InterfaceMessage{IP: "10.0.2.100", Gateway: "10.0.2.2"}},
+			expected: []string{"10.0.2.2 host.rootlesskit.internal"},
+		},
+		{
+			name: "custom alias with IPv6",
+			netmsg: common.NetworkMessage{InterfaceMessage: common.InterfaceMessage{
+				IP: "10.0.2.100", Gateway: "10.0.2.2", IPv6: "fd00::100", IPv6Gateway: "fd00::2",
+			}},
+			alias:    "host.docker.internal",
+			expected: []string{"10.0.2.2 host.docker.internal", "fd00::2 host.docker.internal"},
+		},
+		{
+			name: "primary interface",
+			netmsg: common.NetworkMessage{
+				InterfaceMessage: common.InterfaceMessage{IP: "10.0.2.100", Gateway: "10.0.2.2"},
+				Interfaces:       []common.InterfaceMessage{{IP: "10.0.3.100", Gateway: "10.0.3.2", Primary: true}},
+			},
+			expected: []string{"10.0.3.2 host.rootlesskit.internal"},
+		},
+		{
+			name: "multipath",
+			netmsg: common.NetworkMessage{InterfaceMessage: common.InterfaceMessage{
+				IP: "10.0.2.100", Gateways: []string{"10.0.2.2", "10.0.2.3"}, IPv6: "fd00::100", IPv6Gateway: "fd00::2",
+			}},
+			expected: []string{"10.0.2.2 host.rootlesskit.internal", "10.0.2.3 host.rootlesskit.internal", "fd00::2 host.rootlesskit.internal"},
+		},
+		{
+			name:   "no gateway",
+			netmsg: common.NetworkMessage{InterfaceMessage: common.InterfaceMessage{IPv6: "fd00::100"}},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ifaces, primary, err := interfaces(tc.netmsg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			entries := hostGatewayEntries(ifaces[primary], tc.alias)
+			if !reflect.DeepEqual(entries, tc.expected) {
+				t.Fatalf("expected %v, got %v", tc.expected, entries)
+			}
+			extraHosts, err := parseExtraHosts(entries)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := generateEtcHosts("", extraHosts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			alias := tc.alias
+			if alias == "" {
+				alias = DefaultHostGatewayAlias
+			}
+			for _, gw := range defaultGateways(ifaces[primary]) {
+				if !hasEtcHostsEntry(string(b), gw, alias) {
+					t.Fatalf("expected %s to resolve to %s, got %q", alias, gw, string(b))
+				}
+			}
+		})
+	}
+}
+
+func strPtr(s string) *string {
+	return &s
+}
+
+func TestIsCopyUpSymlink(t *testing.T) {
+	testCases := []struct {
+		name     string
+		target   string
+		expected bool
+	}{
+		{name: "relative copied-up", target: ".ro123/resolv.conf", expected: true},
+		{name: "absolute copied-up", target: "/etc/.ro123/resolv.conf", expected: true},
+		{name: "relative", target: "../run/systemd/resolve/stub-resolv.conf"},
+		{name: "absolute", target: "/run/systemd/resolve/stub-resolv.conf"},
+		{name: "ro directory itself", target: ".ro123"},
+		{name: "escaping ro directory", target: ".ro123/../../run/resolv.conf"},
+		{name: "ro directory elsewhere", target: "/run/.ro123/resolv.conf"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := isCopyUpSymlink("/etc/resolv.conf", tc.target); got != tc.expected {
+				t.Fatalf("expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestResolveMountTarget(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mount-target-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if dir, err = filepath.EvalSymlinks(dir); err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []string{"etc/.ro123", "run/systemd/resolve"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range []string{"etc/hosts", "etc/.ro123/resolv.conf", "run/systemd/resolve/stub-resolv.conf"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, f), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	symlinks := map[string]string{
+		"etc/relative":  "../run/systemd/resolve/stub-resolv.conf",
+		"etc/absolute":  filepath.Join(dir, "run/systemd/resolve/stub-resolv.conf"),
+		"etc/dangling":  "../run/nonexistent",
+		"etc/copied-up": ".ro123/resolv.conf",
+	}
+	for p, target := range symlinks {
+		if err := os.Symlink(target, filepath.Join(dir, p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	testCases := []struct {
+		name     string
+		expected string
+		wantErr  bool
+	}{
+		{name: "hosts", expected: "etc/hosts"},
+		{name: "relative", expected: "run/systemd/resolve/stub-resolv.conf"},
+		{name: "absolute", expected: "run/systemd/resolve/stub-resolv.conf"},
+		{name: "dangling", wantErr: true},
+		{name: "copied-up", expected: "etc/.ro123/resolv.conf"},
+		{name: "nonexistent", wantErr: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := resolveMountTarget(filepath.Join(dir, "etc", tc.name))
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expected := filepath.Join(dir, tc.expected); got != expected {
+				t.Fatalf("expected %q, got %q", expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package child
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/rancher/k3s/pkg/rootlesskit/common"
+)
+
+var (
+	ipBatchOnce      sync.Once
+	ipBatchSupported bool
+)
+
+// detectIPBatch returns true if `ip -batch` is supported by the installed iproute2.
+func detectIPBatch() bool {
+	ipBatchOnce.Do(func() {
+		ipBatchSupported = exec.Command("ip", "-batch", os.DevNull).Run() == nil
+		logrus.Debugf("ip -batch supported: %v", ipBatchSupported)
+	})
+	return ipBatchSupported
+}
+
+// execIPCommands executes `ip` commands in a single `ip -batch -` process when possible,
+// falling back to executing them one by one.
+// Commands with global options such as `ip -6` are not batched, as `ip -batch` rejects
+// the options in the batch lines.
+func execIPCommands(ctx context.Context, cmds [][]string) error {
+	var b bytes.Buffer
+	for _, cmd := range cmds {
+		if len(cmd) < 2 || cmd[0] != "ip" || strings.HasPrefix(cmd[1], "-") || common.IsDryRun(ctx) || !detectIPBatch() {
+			return common.ExecsContext(ctx, os.Stderr, os.Environ(), cmds)
+		}
+		b.WriteString(strings.Join(cmd[1:], " ") + "\n")
+	}
+	x := exec.CommandContext(ctx, "ip", "-batch", "-")
+	var stderr bytes.Buffer
+	x.Stdin = &b
+	x.Stdout = os.Stderr
+	x.Stderr = io.MultiWriter(os.Stderr, &stderr)
+	x.SysProcAttr = &syscall.SysProcAttr{
+		Pdeathsig: syscall.SIGKILL,
+	}
+	logrus.Debugf("executing %v in ip -batch", cmds)
+	if err := x.Run(); err != nil {
+		i := failedIPBatchLine(stderr.String())
+		if i < 0 || i >= len(cmds) {
+			return errors.Wrapf(err, "ip -batch: %s", strings.TrimSpace(stderr.String()))
+		}
+		return errors.Wrap(common.NewExecError(i, cmds[i], stderr.Bytes(), err), "ip -batch")
+	}
+	return nil
+}
+
+// ipBatchFailedRegexp matches the message of iproute2, e.g. "Command failed -:2".
+var ipBatchFailedRegexp = regexp.MustCompile(`Command failed -:(\d+)`)
+
+// failedIPBatchLine returns the zero-origin index of the failed command in `ip -batch -`,
+// or -1 if unknown.
+func failedIPBatchLine(stderr string) int {
+	m := ipBatchFailedRegexp.FindStringSubmatch(stderr)
+	if m == nil {
+		return -1
+	}
+	n, err := strconv.Atoi(m[1])
+	if err != nil {
+		return -1
+	}
+	return n - 1
+}
@@ -0,0 +1,93 @@
+package child
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/rancher/k3s/pkg/rootlesskit/common"
+)
+
+func TestFailedIPBatchLine(t *testing.T) {
+	testCases := []struct {
+		stderr   string
+		expected int
+	}{
+		{"RTNETLINK answers: File exists\nCommand failed -:1\n", 0},
+		{"Error: either \"to\" is duplicate, or \"foo\" is a garbage.\nCommand failed -:3\n", 2},
+		{"RTNETLINK answers: Operation not permitted\n", -1},
+		{"Command failed -:\n", -1},
+		{"Command failed -:99999999999999999999\n", -1},
+		{"", -1},
+	}
+	for _, tc := range testCases {
+		if got := failedIPBatchLine(tc.stderr); got != tc.expected {
+			t.Errorf("failedIPBatchLine(%q): expected %d, got %d", tc.stderr, tc.expected, got)
+		}
+	}
+}
+
+// tapCommands returns commands equivalent to the ones executed by activateTap.
+func tapCommands(tap string) [][]string {
+	return [][]string{
+		{"ip", "link", "set", tap, "up"},
+		{"ip", "link", "set", "dev", tap, "mtu", "1500"},
+		{"ip", "addr", "add", "10.0.2.100/24", "dev", tap},
+		{"ip", "route", "add", "default", "via", "10.0.2.2", "dev", tap},
+	}
+}
+
+func recreateTap(t *testing.T, tap string) {
+	_ = exec.Command("ip", "link", "del", tap).Run()
+	if out, err := exec.Command("ip", "tuntap", "add", tap, "mode", "tap").CombinedOutput(); err != nil {
+		t.Skipf("tap devices are unavailable: %v: %s", err, out)
+	}
+}
+
+func TestExecIPCommands(t *testing.T) {
+	if !runInNamespaces(t, syscall.CLONE_NEWNET) {
+		return
+	}
+	if !detectIPBatch() {
+		t.Skip("ip -batch is not supported")
+	}
+	const tap, n = "tap0", 10
+	var batch, sequential time.Duration
+	for i := 0; i < n; i++ {
+		recreateTap(t, tap)
+		begin := time.Now()
+		if err := execIPCommands(context.Background(), tapCommands(tap)); err != nil {
+			t.Fatal(err)
+		}
+		batch += time.Since(begin)
+		recreateTap(t, tap)
+		begin = time.Now()
+		if err := common.ExecsContext(context.Background(), os.Stderr, os.Environ(), tapCommands(tap)); err != nil {
+			t.Fatal(err)
+		}
+		sequential += time.Since(begin)
+	}
+	t.Logf("average latency for %d commands: ip -batch %v, sequential %v", len(tapCommands(tap)), batch/n, sequential/n)
+
+	// the global options are not accepted in the batch lines
+	recreateTap(t, tap)
+	ipv6 := append(tapCommands(tap), []string{"ip", "-6", "addr", "add", "fd00::100/64", "dev", tap})
+	if err := execIPCommands(context.Background(), ipv6); err != nil {
+		t.Fatal(err)
+	}
+
+	// the route already exists
+	err := execIPCommands(context.Background(), tapCommands(tap)[3:])
+	execErr, ok := errors.Cause(err).(*common.ExecError)
+	if !ok {
+		t.Fatalf("expected ExecError, got %v", err)
+	}
+	if execErr.Index != 0 || execErr.Args[1] != "route" {
+		t.Fatalf("expected the route command to fail, got %+v", execErr)
+	}
+}
@@ -0,0 +1,390 @@
+package child
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/opencontainers/runc/libcontainer/configs"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+
+	"github.com/rancher/k3s/pkg/rootlesskit/common"
+	"github.com/rancher/k3s/pkg/rootlesskit/metrics"
+	"github.com/rancher/k3s/pkg/rootlesskit/msgutil"
+)
+
+// Namespace is the namespaces set up by SetupNamespace.
+type Namespace struct {
+	// Message is Message 1 sent from the parent, updated with the DHCP leases.
+	Message common.Message
+	// Taps are the names of the tap devices, in the order of the interfaces.
+	Taps []string
+
+	opt        Opt
+	pipe       io.ReadWriteCloser
+	pipeName   string
+	copied     []string
+	readySent  bool
+	seccomp    *configs.Seccomp
+	portErrCh  chan error
+	portQuitCh chan struct{}
+	// mu guards process
+	mu      sync.Mutex
+	process *ProcessStatus
+	// teardowns are called in the reverse order, with the error passed to Teardown
+	teardowns []func(error)
+}
+
+func (ns *Namespace) addTeardown(f func(error)) {
+	ns.teardowns = append(ns.teardowns, f)
+}
+
+// SetupNamespace sets up the namespaces for opt, and starts the port driver,
+// but does not run opt.TargetCmd.
+// Cancelling ctx aborts the setup in progress.
+//
+// Message 2 is sent to the parent before returning, unless opt.ReadinessProbe is set.
+// When opt.ReadinessProbe is set, the caller needs to call NotifyReady after running the probe.
+//
+// On success, the caller needs to call Teardown after running the workload in the namespaces.
+// On error, the namespaces are torn down and the parent is notified before returning.
+func SetupNamespace(ctx context.Context, opt Opt) (_ *Namespace, retErr error) {
+	if err := setLogFormat(opt.LogFormat); err != nil {
+		return nil, err
+	}
+	if opt.DryRun {
+		ctx = common.WithDryRun(ctx)
+	}
+	pipe, pipeFD, pipeName := opt.Pipe, -1, "the pipe"
+	if pipe == nil {
+		f, fd, err := openPipeFD(opt)
+		if err != nil {
+			return nil, err
+		}
+		pipe, pipeFD, pipeName = f, fd, "fd "+strconv.Itoa(fd)
+	}
+	var msg common.Message
+	if _, err := msgutil.UnmarshalFromReader(pipe, &msg); err != nil {
+		return nil, errors.Wrapf(err, "parsing message from %s", pipeName)
+	}
+	logrus.Debugf("child: got msg from parent: %+v", msg)
+	if msg.Version < common.MinProtocolVersion || msg.Version > common.ProtocolVersion {
+		return nil, errors.Errorf("protocol version mismatch: got %d, expected %d-%d (the parent and the child binaries may be mixed)",
+			msg.Version, common.MinProtocolVersion, common.ProtocolVersion)
+	}
+	if msg.Stage == 0 {
+		if !opt.DebugNoReexec {
+			if pipeFD < 0 {
+				return nil, errors.New("Pipe cannot be inherited by the re-exec, needs DebugNoReexec")
+			}
+			// the parent has configured the child's uid_map and gid_map, but the child doesn't have caps here.
+			// so we exec the child again to obtain caps.
+			// PID should be kept.
+			if err := syscall.Exec("/proc/self/exe", os.Args, os.Environ()); err != nil {
+				return nil, err
+			}
+			panic("should not reach here")
+		}
+		logrus.Warn("DebugNoReexec: skipping re-exec, not for production use")
+		msg = common.Message{}
+		if _, err := msgutil.UnmarshalFromReader(pipe, &msg); err != nil {
+			return nil, errors.Wrapf(err, "parsing message from %s", pipeName)
+		}
+		logrus.Debugf("child: got msg from parent: %+v", msg)
+	}
+	if msg.Stage != 1 {
+		return nil, errors.Wrapf(ErrUnexpectedStage, "expected stage 1, got stage %d", msg.Stage)
+	}
+	if pipeFD >= 0 {
+		if opt.PipeFDEnvKey != "" {
+			os.Unsetenv(opt.PipeFDEnvKey)
+		}
+		// the pipe is closed after sending message 2, but the commands executed until then should not inherit it.
+		syscall.CloseOnExec(pipeFD)
+	}
+	if msg.Network.DNSBridgeFD != 0 {
+		syscall.CloseOnExec(msg.Network.DNSBridgeFD)
+	}
+	ns := &Namespace{
+		opt:      opt,
+		pipe:     pipe,
+		pipeName: pipeName,
+	}
+	ns.addTeardown(func(err error) {
+		if !ns.readySent {
+			if err != nil {
+				sendReady(pipe, nil, "", err)
+			}
+			pipe.Close()
+		}
+	})
+	defer func() {
+		if retErr != nil {
+			ns.Teardown(retErr)
+		}
+	}()
+	if !opt.DryRun {
+		if err := checkIDMaps(); err != nil {
+			return nil, err
+		}
+	}
+	if !opt.DryRun {
+		if err := checkCapabilities(opt); err != nil {
+			return nil, err
+		}
+	}
+	if opt.NetnsPath != "" {
+		if err := validateNetnsPath(opt); err != nil {
+			return nil, err
+		}
+	}
+	if err := validateCloneflags(opt.Cloneflags); err != nil {
+		return nil, err
+	}
+	if opt.Umask != nil && (*opt.Umask < 0 || *opt.Umask > 0777) {
+		return nil, errors.Errorf("invalid Umask: %#o", *opt.Umask)
+	}
+	if opt.SeccompProfilePath != "" {
+		var err error
+		if ns.seccomp, err = loadSeccompProfile(opt.SeccompProfilePath); err != nil {
+			return nil, err
+		}
+	}
+	if msg.StateDir == "" {
+		return nil, errors.WithStack(ErrEmptyStateDir)
+	}
+	cleanupStateDir, err := prepareCleanupStateDir(msg.StateDir, opt)
+	if err != nil {
+		return nil, err
+	}
+	ns.addTeardown(cleanupStateDir)
+	var cleanupNet func()
+	setupErr := runSetup(ctx, opt.SetupTimeout, func(ctx context.Context, setPhase func(string)) error {
+		setPhase("copy-up")
+		var err error
+		if opt.DryRun {
+			logrus.Infof("[dry-run] copying up %v and %v", opt.CopyUpDirs, opt.CopyUpFiles)
+		} else {
+			copyUpStart := time.Now()
+			_, ns.copied, err = setupCopyDir(opt.CopyUpDriver, opt.CopyUpDirs, opt.CopyUpFiles)
+			metrics.Observe(opt.Metrics, metrics.PhaseCopyUp, copyUpStart)
+		}
+		if err != nil {
+			return err
+		}
+		setPhase("hostname")
+		if err := setHostname(ctx, msg.Hostname); err != nil {
+			return err
+		}
+		if opt.MountProc {
+			setPhase("procfs")
+			if err := mountProcfs(ctx, opt.Metrics); err != nil {
+				return err
+			}
+		}
+		sysfs, err := needsSysfs(opt)
+		if err != nil {
+			return err
+		}
+		if sysfs {
+			setPhase("sysfs")
+			if err := mountSysfs(ctx, opt.Sysfs, opt.Metrics); err != nil {
+				return err
+			}
+		}
+		if opt.SetupDev {
+			setPhase("dev")
+			if err := setupDev(ctx); err != nil {
+				return err
+			}
+		}
+		setPhase("network")
+		ns.Taps, cleanupNet, err = setupNet(ctx, &msg, ns.copied, opt)
+		if err != nil {
+			return err
+		}
+		setPhase("bind-mount")
+		if err := setupBindMounts(ctx, opt.BindMounts); err != nil {
+			return err
+		}
+		setPhase("tmpfs")
+		return setupTmpfsMounts(ctx, opt.TmpfsMounts)
+	})
+	// registered even on error, as the phases after the network may fail
+	if cleanupNet != nil {
+		ns.addTeardown(func(error) { cleanupNet() })
+	}
+	if setupErr != nil {
+		return nil, setupErr
+	}
+	ns.Message = msg
+	if opt.WatchResolvConf && !opt.DryRun && opt.NetworkDriver != nil && !copiedUp(ns.copied, "/etc/resolv.conf") {
+		stopWatchingResolvConf, err := watchResolvConf(resolvConfSource(msg.StateDir, msg.Network))
+		if err != nil {
+			return nil, err
+		}
+		ns.addTeardown(func(error) { stopWatchingResolvConf() })
+	}
+	if opt.PortDriver != nil {
+		ns.portQuitCh = make(chan struct{})
+		ns.portErrCh = make(chan error, 1)
+		go func() {
+			ns.portErrCh <- runChildPortDriver(opt, msg.Port.Opaque, ns.portQuitCh)
+		}()
+	}
+	if err := writeStatus(msg, opt, ns.Taps, nil); err != nil {
+		return nil, err
+	}
+	ns.addTeardown(func(error) { removeStatus(msg.StateDir) })
+	if opt.PreExecHook != nil && !opt.DryRun {
+		if err := opt.PreExecHook(msg); err != nil {
+			return nil, errors.Wrap(err, "pre-exec hook failed")
+		}
+	}
+	if len(opt.ReadinessProbe) == 0 || opt.DryRun {
+		if err := ns.NotifyReady(); err != nil {
+			return nil, err
+		}
+	}
+	return ns, nil
+}
+
+// openPipeFD returns the pipe specified by either opt.PipeFDEnvKey or opt.PipeFDPath, along with the fd number.
+func openPipeFD(opt Opt) (*os.File, int, error) {
+	switch {
+	case opt.PipeFDEnvKey != "" && opt.PipeFDPath != "":
+		return nil, 0, errors.Errorf("PipeFDEnvKey (%q) and PipeFDPath (%q) cannot be set together", opt.PipeFDEnvKey, opt.PipeFDPath)
+	case opt.PipeFDPath != "":
+		return pipeFromPath(opt.PipeFDPath)
+	default:
+		return pipeFromEnv(opt.PipeFDEnvKey)
+	}
+}
+
+// pipeFromPath returns the pipe in the fd specified by p, e.g. "/dev/fd/3", along with the fd number.
+// The fd is used as-is instead of opening p, as the pipe is a socketpair that cannot be opened by the path.
+func pipeFromPath(p string) (*os.File, int, error) {
+	dir, base := filepath.Split(filepath.Clean(p))
+	if dir != "/dev/fd/" && dir != "/proc/self/fd/" {
+		return nil, 0, errors.Errorf("unsupported pipe FD path %q, needs to be /dev/fd/N or /proc/self/fd/N", p)
+	}
+	fd, err := strconv.Atoi(base)
+	if err != nil || fd < 0 {
+		return nil, 0, errors.Errorf("unexpected fd value in pipe FD path %q", p)
+	}
+	var st unix.Stat_t
+	if err := unix.Fstat(fd, &st); err != nil {
+		return nil, 0, errors.Wrapf(ErrPipeFDNotSet, "fd %d of %s is not open: %v", fd, p, err)
+	}
+	return os.NewFile(uintptr(fd), p), fd, nil
+}
+
+// pipeFromEnv returns the pipe in the fd specified by the env var envKey, along with the fd number.
+func pipeFromEnv(envKey string) (*os.File, int, error) {
+	if envKey == "" {
+		return nil, 0, errors.Wrap(ErrPipeFDNotSet, "neither PipeFDEnvKey nor PipeFDPath is set")
+	}
+	s := os.Getenv(envKey)
+	if s == "" {
+		return nil, 0, errors.Wrapf(ErrPipeFDNotSet, "%s is not set", envKey)
+	}
+	fd, err := strconv.Atoi(s)
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "unexpected fd value: %s", s)
+	}
+	return os.NewFile(uintptr(fd), ""), fd, nil
+}
+
+// NotifyReady sends Message 2 to the parent, if not sent yet.
+func (ns *Namespace) NotifyReady() error {
+	if ns.readySent {
+		return nil
+	}
+	ns.readySent = true
+	if err := sendReady(ns.pipe, ns.Taps, primaryIP(ns.Message.Network), nil); err != nil {
+		ns.pipe.Close()
+		return errors.Wrapf(err, "failed to send message 2 to %s", ns.pipeName)
+	}
+	if ns.opt.DryRun {
+		ns.pipe.Close()
+		return nil
+	}
+	// the parent may send Message 3 afterward
+	dns := newDNSUpdater(ns.Message, ns.copied, ns.opt)
+	go serveControl(ns.pipe, dns)
+	if ns.Message.ControlSocketPath != "" {
+		go serveControlSocket(ns, dns)
+	}
+	return nil
+}
+
+// NotifyStarted records the PID and the namespaces of the target command in the status file,
+// and sends Message 4 to the parent. Needs to be called after NotifyReady.
+// pid is the PID of the target command.
+func (ns *Namespace) NotifyStarted(pid int) error {
+	if ns.opt.DryRun {
+		return nil
+	}
+	proc := &ProcessStatus{
+		PID:        pid,
+		Namespaces: namespaceIDs(pid, ns.opt.NetnsPath),
+	}
+	ns.mu.Lock()
+	ns.process = proc
+	ns.mu.Unlock()
+	if err := writeStatus(ns.Message, ns.opt, ns.Taps, proc); err != nil {
+		return err
+	}
+	if ns.Message.Version < 4 {
+		logrus.Debugf("not sending message 4 to the parent (protocol version %d)", ns.Message.Version)
+		return nil
+	}
+	msg := common.Message{
+		Version: common.ProtocolVersion,
+		Stage:   4,
+		Message4: common.Message4{
+			PID:        proc.PID,
+			Namespaces: proc.Namespaces,
+		},
+	}
+	if _, err := msgutil.MarshalToWriter(ns.pipe, &msg); err != nil {
+		return errors.Wrapf(err, "failed to send message 4 to %s", ns.pipeName)
+	}
+	return nil
+}
+
+// status returns the current status.
+func (ns *Namespace) status() (*Status, error) {
+	ns.mu.Lock()
+	proc := ns.process
+	ns.mu.Unlock()
+	return createStatus(ns.Message, ns.opt, ns.Taps, proc)
+}
+
+// Teardown stops the port driver and reverts the setup that can be reverted.
+// workloadErr is the error of the workload that was run in the namespaces, and can be nil.
+// It is reported to the parent when Message 2 has not been sent yet.
+// Returns the error of the port driver.
+func (ns *Namespace) Teardown(workloadErr error) error {
+	var err error
+	if ns.portQuitCh != nil {
+		select {
+		case ns.portQuitCh <- struct{}{}:
+			err = <-ns.portErrCh
+		case err = <-ns.portErrCh:
+		}
+		ns.portQuitCh = nil
+	}
+	for i := len(ns.teardowns) - 1; i >= 0; i-- {
+		ns.teardowns[i](workloadErr)
+	}
+	ns.teardowns = nil
+	return err
+}
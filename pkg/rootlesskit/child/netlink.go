@@ -0,0 +1,230 @@
+package child
+
+import (
+	"net"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/rancher/k3s/pkg/rootlesskit/common"
+)
+
+// withNetlink calls netlinkFn when useNetlink is true, and falls back to fn when netlinkFn fails
+// before adding anything.
+func withNetlink(useNetlink bool, what string, netlinkFn, fn func() error) error {
+	if useNetlink {
+		err := netlinkFn()
+		if err == nil {
+			return nil
+		}
+		if partial, ok := err.(*netlinkPartialError); ok {
+			return errors.Wrapf(partial.error, "failed to %s with netlink after partially applying it", what)
+		}
+		logrus.WithField("phase", "network").WithError(err).Warnf("failed to %s with netlink, falling back to ip commands", what)
+	}
+	return fn()
+}
+
+// netlinkPartialError is returned when netlink failed after adding an address, a route, or a rule.
+// withNetlink does not fall back to the ip commands in that case, as they would fail with EEXIST.
+type netlinkPartialError struct {
+	error
+}
+
+// netlinkChanges tracks whether a netlink function has added anything.
+type netlinkChanges struct {
+	added bool
+}
+
+// add records the result of adding an address, a route, or a rule.
+// err is returned as *netlinkPartialError when something has been added before.
+func (c *netlinkChanges) add(err error) error {
+	if err == nil {
+		c.added = true
+		return nil
+	}
+	if c.added {
+		return &netlinkPartialError{err}
+	}
+	return err
+}
+
+func netlinkActivateLoopback() error {
+	lo, err := netlink.LinkByName("lo")
+	if err != nil {
+		return errors.Wrap(err, "finding lo")
+	}
+	if err := netlink.LinkSetUp(lo); err != nil {
+		return errors.Wrap(err, "setting lo up")
+	}
+	return nil
+}
+
+// netlinkActivateTap is the netlink implementation of activateTap.
+func netlinkActivateTap(tap string, iface common.InterfaceMessage, primary bool) error {
+	link, err := netlink.LinkByName(tap)
+	if err != nil {
+		return errors.Wrapf(err, "finding %s", tap)
+	}
+	if iface.MAC != "" {
+		mac, err := net.ParseMAC(iface.MAC)
+		if err != nil {
+			return errors.Wrapf(err, "invalid MAC address %q for %s", iface.MAC, tap)
+		}
+		if err := netlink.LinkSetHardwareAddr(link, mac); err != nil {
+			return errors.Wrapf(err, "setting MAC address %s on %s", iface.MAC, tap)
+		}
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		return errors.Wrapf(err, "setting %s up", tap)
+	}
+	if iface.MTU != 0 {
+		if err := netlink.LinkSetMTU(link, iface.MTU); err != nil {
+			return errors.Wrapf(err, "setting MTU %d on %s", iface.MTU, tap)
+		}
+	}
+	if iface.TxQueueLen != 0 {
+		if err := netlink.LinkSetTxQLen(link, iface.TxQueueLen); err != nil {
+			return errors.Wrapf(err, "setting txqueuelen %d on %s", iface.TxQueueLen, tap)
+		}
+	}
+	var changes netlinkChanges
+	if iface.IP != "" {
+		if err := changes.add(netlinkAddAddr(link, iface.IP, iface.Netmask)); err != nil {
+			return err
+		}
+	}
+	if primary {
+		if gws := defaultGateways(iface); len(gws) > 1 {
+			if err := changes.add(netlinkAddMultipathRoute(link, gws)); err != nil {
+				return err
+			}
+		} else if len(gws) == 1 {
+			if err := changes.add(netlinkAddRoute(link, nil, gws[0], 0, 0)); err != nil {
+				return err
+			}
+		}
+	}
+	if iface.IPv6 != "" {
+		if err := changes.add(netlinkAddAddr(link, iface.IPv6, iface.IPv6Netmask)); err != nil {
+			return err
+		}
+		if primary && iface.IPv6Gateway != "" {
+			if err := changes.add(netlinkAddRoute(link, nil, iface.IPv6Gateway, 0, 0)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// netlinkActivateRoutes is the netlink implementation of activateRoutes.
+func netlinkActivateRoutes(tap string, routes []common.RouteMessage) error {
+	if len(routes) == 0 {
+		return nil
+	}
+	for _, r := range routes {
+		// checked before adding any route, so that the fallback to the ip commands does not add the routes twice
+		if r.MTU != 0 {
+			return errors.Errorf("MTU of route %q is not supported with netlink", r.Dest)
+		}
+	}
+	link, err := netlink.LinkByName(tap)
+	if err != nil {
+		return errors.Wrapf(err, "finding %s", tap)
+	}
+	var changes netlinkChanges
+	for _, r := range routes {
+		_, dst, err := net.ParseCIDR(r.Dest)
+		if err != nil {
+			return changes.add(errors.Wrapf(err, "invalid route destination %q", r.Dest))
+		}
+		if err := changes.add(netlinkAddRoute(link, dst, r.Gateway, r.Metric, r.Table)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// netlinkActivateRules is the netlink implementation of activateRules.
+func netlinkActivateRules(rules []common.RuleMessage) error {
+	var changes netlinkChanges
+	for _, r := range rules {
+		if err := validateRule(r); err != nil {
+			return changes.add(err)
+		}
+		rule := netlink.NewRule()
+		rule.Family = unix.AF_INET
+		if r.IPv6 {
+			rule.Family = unix.AF_INET6
+		}
+		rule.Mark = r.FWMark
+		rule.Table = r.Table
+		if r.Priority != 0 {
+			rule.Priority = r.Priority
+		}
+		if err := changes.add(errors.Wrapf(netlink.RuleAdd(rule), "adding rule %+v", r)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func netlinkAddAddr(link netlink.Link, ip string, netmask int) error {
+	s := ip + "/" + strconv.Itoa(netmask)
+	addr, err := netlink.ParseAddr(s)
+	if err != nil {
+		return errors.Wrapf(err, "invalid address %q", s)
+	}
+	if err := netlink.AddrAdd(link, addr); err != nil {
+		return errors.Wrapf(err, "adding address %s to %s", s, link.Attrs().Name)
+	}
+	return nil
+}
+
+// netlinkAddRoute adds the default route when dst is nil.
+// gateway can be empty for the routes without gateway.
+// table can be 0 for the main table.
+func netlinkAddRoute(link netlink.Link, dst *net.IPNet, gateway string, metric, table int) error {
+	route := &netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Dst:       dst,
+		Priority:  metric,
+		Table:     table,
+	}
+	if gateway != "" {
+		route.Gw = net.ParseIP(gateway)
+		if route.Gw == nil {
+			return errors.Errorf("invalid gateway %q", gateway)
+		}
+	}
+	if err := netlink.RouteAdd(route); err != nil {
+		return errors.Wrapf(err, "adding route %+v", route)
+	}
+	return nil
+}
+
+// netlinkAddMultipathRoute adds the default route with a nexthop via each of gateways.
+func netlinkAddMultipathRoute(link netlink.Link, gateways []string) error {
+	// the vendored netlink rejects the route without Dst, Src, and Gw
+	route := &netlink.Route{
+		Dst: &net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)},
+	}
+	for _, gw := range gateways {
+		ip := net.ParseIP(gw)
+		if ip == nil {
+			return errors.Errorf("invalid gateway %q", gw)
+		}
+		route.MultiPath = append(route.MultiPath, &netlink.NexthopInfo{
+			LinkIndex: link.Attrs().Index,
+			Gw:        ip,
+		})
+	}
+	if err := netlink.RouteAdd(route); err != nil {
+		return errors.Wrapf(err, "adding multipath route via %v", gateways)
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package child
+
+import (
+	"context"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/rancher/k3s/pkg/rootlesskit/common"
+)
+
+// ipOutput returns the output of the ip command.
+func ipOutput(t *testing.T, args ...string) string {
+	out, err := exec.Command("ip", args...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("ip %v: %v: %s", args, err, out)
+	}
+	return string(out)
+}
+
+func assertContains(t *testing.T, s string, substrs ...string) {
+	for _, substr := range substrs {
+		if !strings.Contains(s, substr) {
+			t.Errorf("expected %q in %q", substr, s)
+		}
+	}
+}
+
+func TestActivateTapAndRoutes(t *testing.T) {
+	if !runInNamespaces(t, syscall.CLONE_NEWNET) {
+		return
+	}
+	// the tap device has no carrier, so the IPv6 address would stay tentative
+	if err := ioutil.WriteFile("/proc/sys/net/ipv6/conf/default/accept_dad", []byte("0"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	testCases := []struct {
+		name           string
+		activateTap    func(tap string, iface common.InterfaceMessage, primary bool) error
+		activateRoutes func(tap string, routes []common.RouteMessage) error
+	}{
+		{
+			name: "ip",
+			activateTap: func(tap string, iface common.InterfaceMessage, primary bool) error {
+				return activateTap(ctx, tap, iface, primary)
+			},
+			activateRoutes: func(tap string, routes []common.RouteMessage) error {
+				return activateRoutes(ctx, tap, routes)
+			},
+		},
+		{
+			name:           "netlink",
+			activateTap:    netlinkActivateTap,
+			activateRoutes: netlinkActivateRoutes,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			const tap = "tap0"
+			recreateTap(t, tap)
+			iface := common.InterfaceMessage{
+				IP: "10.0.2.100", Netmask: 24, Gateway: "10.0.2.2",
+				IPv6: "fd00::100", IPv6Netmask: 64, IPv6Gateway: "fd00::2",
+				MTU: 1400, TxQueueLen: 500, MAC: "02:00:00:00:00:01",
+			}
+			if err := tc.activateTap(tap, iface, true); err != nil {
+				t.Fatal(err)
+			}
+			routes := []common.RouteMessage{
+				{Dest: "192.168.10.0/24", Gateway: "10.0.2.3", Metric: 10},
+				{Dest: "192.168.20.0/24", Gateway: "10.0.2.4", Table: 100},
+			}
+			if err := tc.activateRoutes(tap, routes); err != nil {
+				t.Fatal(err)
+			}
+			assertContains(t, ipOutput(t, "addr", "show", "dev", tap),
+				"inet 10.0.2.100/24", "inet6 fd00::100/64", "mtu 1400", "qlen 500", "link/ether 02:00:00:00:00:01", "UP")
+			assertContains(t, ipOutput(t, "route", "show"),
+				"default via 10.0.2.2 dev tap0", "192.168.10.0/24 via 10.0.2.3 dev tap0 metric 10")
+			assertContains(t, ipOutput(t, "route", "show", "table", "100"), "192.168.20.0/24 via 10.0.2.4 dev tap0")
+			assertContains(t, ipOutput(t, "-6", "route", "show"), "default via fd00::2 dev tap0")
+
+			// the tap device is not primary
+			recreateTap(t, tap)
+			iface = common.InterfaceMessage{IP: "10.0.3.100", Netmask: 24, Gateway: "10.0.3.2"}
+			if err := tc.activateTap(tap, iface, false); err != nil {
+				t.Fatal(err)
+			}
+			assertContains(t, ipOutput(t, "addr", "show", "dev", tap), "inet 10.0.3.100/24")
+			if out := ipOutput(t, "route", "show", "default"); out != "" {
+				t.Errorf("expected no default route, got %q", out)
+			}
+		})
+	}
+}
+
+func TestNetlinkActivateTapMultipath(t *testing.T) {
+	if !runInNamespaces(t, syscall.CLONE_NEWNET) {
+		return
+	}
+	recreateTap(t, "tap0")
+	iface := common.InterfaceMessage{IP: "10.0.2.100", Netmask: 24, Gateways: []string{"10.0.2.2", "10.0.2.3", "10.0.2.2"}}
+	if err := netlinkActivateTap("tap0", iface, true); err != nil {
+		t.Fatal(err)
+	}
+	out := ipOutput(t, "route", "show", "default")
+	for _, gw := range []string{"10.0.2.2", "10.0.2.3"} {
+		if strings.Count(out, "nexthop via "+gw+" ") != 1 {
+			t.Fatalf("expected a nexthop via %s, got %q", gw, out)
+		}
+	}
+}
+
+func TestWithNetlinkPartialError(t *testing.T) {
+	if !runInNamespaces(t, syscall.CLONE_NEWNET) {
+		return
+	}
+	recreateTap(t, "tap0")
+	iface := common.InterfaceMessage{IP: "10.0.2.100", Netmask: 24, Gateway: "10.0.2.2"}
+	if err := netlinkActivateTap("tap0", iface, true); err != nil {
+		t.Fatal(err)
+	}
+	routes := []common.RouteMessage{
+		{Dest: "192.168.10.0/24", Gateway: "10.0.2.3"},
+		// already exists
+		{Dest: "0.0.0.0/0", Gateway: "10.0.2.2"},
+	}
+	fellBack := false
+	err := withNetlink(true, "add routes", func() error {
+		return netlinkActivateRoutes("tap0", routes)
+	}, func() error {
+		fellBack = true
+		return nil
+	})
+	if err == nil || fellBack {
+		t.Fatalf("expected an error without falling back, got %v (fell back: %v)", err, fellBack)
+	}
+
+	// nothing is added, so the fallback is used
+	err = withNetlink(true, "add routes", func() error {
+		return netlinkActivateRoutes("nonexistent", routes)
+	}, func() error {
+		fellBack = true
+		return nil
+	})
+	if err != nil || !fellBack {
+		t.Fatalf("expected to fall back, got %v (fell back: %v)", err, fellBack)
+	}
+}
@@ -0,0 +1,76 @@
+package child
+
+import (
+	"os"
+	"os/exec"
+	"runtime"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// validateNetnsPath checks that opt.NetnsPath can be joined instead of configuring the network.
+func validateNetnsPath(opt Opt) error {
+	if opt.NetworkDriver != nil {
+		return errors.New("NetnsPath cannot be set with NetworkDriver")
+	}
+	if opt.PortDriver != nil {
+		// the port driver runs on the threads that are not in the namespace
+		return errors.New("NetnsPath cannot be set with PortDriver")
+	}
+	if _, err := os.Stat(opt.NetnsPath); err != nil {
+		return errors.Wrap(err, "invalid NetnsPath")
+	}
+	return nil
+}
+
+// startCmd starts cmd in the network namespace at netnsPath.
+// Empty netnsPath starts cmd in the current network namespace.
+//
+// setns(2) affects only the calling thread, so the thread is locked during starting cmd,
+// and then restored to the current network namespace before unlocking.
+func startCmd(cmd *exec.Cmd, netnsPath string) error {
+	if netnsPath == "" {
+		return cmd.Start()
+	}
+	errCh := make(chan error)
+	go func() {
+		runtime.LockOSThread()
+		cur, err := os.Open("/proc/thread-self/ns/net")
+		if err != nil {
+			runtime.UnlockOSThread()
+			errCh <- errors.Wrap(err, "opening the current network namespace")
+			return
+		}
+		defer cur.Close()
+		if err := setns(netnsPath); err != nil {
+			runtime.UnlockOSThread()
+			errCh <- err
+			return
+		}
+		err = cmd.Start()
+		if restoreErr := unix.Setns(int(cur.Fd()), unix.CLONE_NEWNET); restoreErr != nil {
+			// keep the thread locked, so that the thread is terminated when the goroutine exits.
+			// Note that Pdeathsig of cmd is triggered by the termination of the thread.
+			logrus.WithError(restoreErr).Warn("failed to restore the network namespace of the thread")
+		} else {
+			runtime.UnlockOSThread()
+		}
+		errCh <- err
+	}()
+	return <-errCh
+}
+
+// setns joins the network namespace at p, on the calling thread.
+func setns(p string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return errors.Wrapf(err, "opening %s", p)
+	}
+	defer f.Close()
+	if err := unix.Setns(int(f.Fd()), unix.CLONE_NEWNET); err != nil {
+		return errors.Wrapf(err, "joining the network namespace %s", p)
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package child
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+)
+
+// namespaceNames are the names of the namespaces in /proc/PID/ns.
+var namespaceNames = []string{"cgroup", "ipc", "mnt", "net", "pid", "user", "uts"}
+
+// namespaceIDs returns the inode numbers of the namespaces of pid.
+//
+// /proc/PID/ns is read only when /proc is mounted for the current PID namespace,
+// otherwise PID may resolve to an unrelated process, and /proc/self/ns is read instead
+// (with netnsPath for "net"), not reflecting the namespaces created only for the target command.
+func namespaceIDs(pid int, netnsPath string) map[string]uint64 {
+	dir := filepath.Join("/proc", strconv.Itoa(pid), "ns")
+	if self, err := os.Readlink("/proc/self"); err != nil || self != strconv.Itoa(os.Getpid()) {
+		logrus.Debugf("/proc is not mounted for the PID namespace, reading /proc/self/ns instead of %s", dir)
+		dir = "/proc/self/ns"
+	} else {
+		netnsPath = ""
+	}
+	ids := make(map[string]uint64)
+	for _, name := range namespaceNames {
+		p := filepath.Join(dir, name)
+		if name == "net" && netnsPath != "" {
+			p = netnsPath
+		}
+		ino, err := inode(p)
+		if err != nil {
+			// e.g. cgroup namespace is not supported by the kernel
+			logrus.WithError(err).Debugf("failed to get the inode number of %s", p)
+			continue
+		}
+		ids[name] = ino
+	}
+	return ids
+}
+
+func inode(p string) (uint64, error) {
+	st, err := os.Stat(p)
+	if err != nil {
+		return 0, err
+	}
+	sys, ok := st.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, &os.PathError{Op: "stat", Path: p, Err: syscall.ENOTSUP}
+	}
+	return sys.Ino, nil
+}
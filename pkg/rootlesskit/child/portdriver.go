@@ -0,0 +1,33 @@
+package child
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const defaultPortDriverRestartInterval = time.Second
+
+// runChildPortDriver runs opt.PortDriver until quit is received.
+// When the driver exits with an error, the driver is restarted up to opt.PortDriverRestartCount times,
+// doubling the interval for each attempt.
+// A nil error from RunChildDriver is regarded as the clean exit on quit, and never restarted.
+func runChildPortDriver(opt Opt, opaque map[string]string, quit <-chan struct{}) error {
+	interval := opt.PortDriverRestartInterval
+	if interval <= 0 {
+		interval = defaultPortDriverRestartInterval
+	}
+	for i := 0; ; i++ {
+		err := opt.PortDriver.RunChildDriver(opaque, quit)
+		if err == nil || i >= opt.PortDriverRestartCount {
+			return err
+		}
+		logrus.WithError(err).Warnf("port driver exited, restarting in %v (attempt %d/%d)", interval, i+1, opt.PortDriverRestartCount)
+		select {
+		case <-quit:
+			return err
+		case <-time.After(interval):
+		}
+		interval *= 2
+	}
+}
@@ -0,0 +1,65 @@
+package child
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultReadinessProbeTimeout  = 30 * time.Second
+	defaultReadinessProbeInterval = time.Second
+)
+
+// probeReadiness executes opt.ReadinessProbe until it succeeds.
+// Returns an error on timeout, on cancellation of ctx, or when exited is closed.
+func probeReadiness(ctx context.Context, opt Opt, exited <-chan struct{}) error {
+	timeout := opt.ReadinessProbeTimeout
+	if timeout <= 0 {
+		timeout = defaultReadinessProbeTimeout
+	}
+	interval := opt.ReadinessProbeInterval
+	if interval <= 0 {
+		interval = defaultReadinessProbeInterval
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	for i := 1; ; i++ {
+		cmd := exec.CommandContext(ctx, opt.ReadinessProbe[0], opt.ReadinessProbe[1:]...)
+		var out bytes.Buffer
+		cmd.Stdout = &out
+		cmd.Stderr = &out
+		err := startCmd(cmd, opt.NetnsPath)
+		if err == nil {
+			err = cmd.Wait()
+		}
+		if err == nil {
+			logrus.Debugf("readiness probe %v succeeded after %d attempt(s)", opt.ReadinessProbe, i)
+			return nil
+		}
+		logrus.WithError(err).WithField("attempt", i).Debugf("readiness probe %v failed: %s", opt.ReadinessProbe, out.String())
+		select {
+		case <-exited:
+			return errors.Errorf("command %v exited before readiness probe %v succeeded", opt.TargetCmd, opt.ReadinessProbe)
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				return errors.Errorf("readiness probe %v did not succeed in %v: %v", opt.ReadinessProbe, timeout, err)
+			}
+			return errors.Wrapf(ctx.Err(), "readiness probe %v", opt.ReadinessProbe)
+		case <-time.After(interval):
+		}
+	}
+}
+
+// stopTargetCmd kills the target command that failed the readiness probe.
+func stopTargetCmd(cmd *exec.Cmd, exited <-chan struct{}) {
+	if err := cmd.Process.Signal(os.Kill); err != nil {
+		logrus.WithError(err).Debugf("failed to kill %v", cmd.Args)
+	}
+	<-exited
+}
@@ -0,0 +1,72 @@
+package child
+
+import (
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/syndtr/gocapability/capability"
+)
+
+// checkCapabilities checks that the capabilities needed for setting up the namespaces are effective after the re-exec,
+// or without the re-exec when Opt.DebugNoReexec is set.
+func checkCapabilities(opt Opt) error {
+	caps, err := capability.NewPid(0)
+	if err != nil {
+		return errors.Wrapf(ErrMissingCapabilities, "failed to get the capabilities: %v", err)
+	}
+	logrus.Debugf("child: capabilities after re-exec: %s", caps)
+	required := []capability.Cap{capability.CAP_SYS_ADMIN}
+	if opt.NetworkDriver != nil {
+		required = append(required, capability.CAP_NET_ADMIN)
+	}
+	var missing []string
+	for _, c := range required {
+		if !caps.Get(capability.EFFECTIVE, c) {
+			missing = append(missing, "CAP_"+strings.ToUpper(c.String()))
+		}
+	}
+	if len(missing) != 0 && opt.DebugNoReexec {
+		return errors.Wrapf(ErrMissingCapabilities, "%s not effective without the re-exec (DebugNoReexec is set)", strings.Join(missing, ", "))
+	}
+	if len(missing) != 0 {
+		return errors.Wrapf(ErrMissingCapabilities, "%s not effective after the re-exec (is the user namespace created, and /proc/self/exe executable?)",
+			strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// checkIDMaps checks that the parent has mapped the root of the user namespace in /proc/self/uid_map and /proc/self/gid_map,
+// as the mounts fail with EPERM otherwise.
+func checkIDMaps() error {
+	for _, f := range []string{"uid_map", "gid_map"} {
+		p := "/proc/self/" + f
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			return errors.Wrapf(ErrMissingIDMapping, "failed to read %s: %v", p, err)
+		}
+		if !mapsRoot(string(b)) {
+			return errors.Wrapf(ErrMissingIDMapping, "%s does not map the root (%q); newuidmap and newgidmap may have failed, check /etc/subuid and /etc/subgid",
+				p, strings.TrimSpace(string(b)))
+		}
+	}
+	return nil
+}
+
+// mapsRoot returns true if the uid_map or gid_map content s has an entry for the ID 0 in the namespace.
+func mapsRoot(s string) bool {
+	for _, line := range strings.Split(s, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			continue
+		}
+		inside, err1 := strconv.ParseUint(fields[0], 10, 32)
+		count, err2 := strconv.ParseUint(fields[2], 10, 32)
+		if err1 == nil && err2 == nil && inside == 0 && count > 0 {
+			return true
+		}
+	}
+	return false
+}
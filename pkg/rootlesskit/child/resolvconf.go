@@ -0,0 +1,260 @@
+package child
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/rancher/k3s/pkg/rootlesskit/common"
+)
+
+// dnsServers returns netmsg.DNSServers, or netmsg.DNS for the backward compatibility.
+func dnsServers(netmsg common.NetworkMessage) []string {
+	if len(netmsg.DNSServers) != 0 {
+		return netmsg.DNSServers
+	}
+	if netmsg.DNS != "" {
+		return []string{netmsg.DNS}
+	}
+	return nil
+}
+
+// generateResolvConf writes the nameserver addresses verbatim, after validating them.
+// IPv6 addresses may have a zone, e.g. "fe80::1%eth0".
+func generateResolvConf(netmsg common.NetworkMessage) ([]byte, error) {
+	var b bytes.Buffer
+	for _, d := range dnsServers(netmsg) {
+		if net.ParseIP(strings.SplitN(d, "%", 2)[0]) == nil {
+			return nil, errors.Errorf("invalid nameserver address %q", d)
+		}
+		b.WriteString("nameserver " + d + "\n")
+	}
+	if len(netmsg.SearchDomains) != 0 {
+		b.WriteString("search " + strings.Join(netmsg.SearchDomains, " ") + "\n")
+	}
+	if len(netmsg.ResolvOptions) != 0 {
+		b.WriteString("options " + strings.Join(netmsg.ResolvOptions, " ") + "\n")
+	}
+	return b.Bytes(), nil
+}
+
+// mergeResolvConf replaces the nameserver lines of the host resolv.conf with the ones generated from netmsg,
+// preserving the comments and the other lines.
+// The "search" and "options" lines are also replaced when netmsg has them.
+// The generated lines are placed at the first replaced line, or appended when no line is replaced.
+func mergeResolvConf(host []byte, netmsg common.NetworkMessage) ([]byte, error) {
+	generated, err := generateResolvConf(netmsg)
+	if err != nil {
+		return nil, err
+	}
+	replaced := map[string]bool{"nameserver": true}
+	if len(netmsg.SearchDomains) != 0 {
+		replaced["search"] = true
+		replaced["domain"] = true
+	}
+	if len(netmsg.ResolvOptions) != 0 {
+		replaced["options"] = true
+	}
+	var b bytes.Buffer
+	inserted := false
+	for _, line := range strings.SplitAfter(string(host), "\n") {
+		if line == "" {
+			continue
+		}
+		if fields := strings.Fields(line); len(fields) != 0 && replaced[fields[0]] {
+			if !inserted {
+				b.Write(generated)
+				inserted = true
+			}
+			continue
+		}
+		b.WriteString(line)
+		if !strings.HasSuffix(line, "\n") {
+			b.WriteString("\n")
+		}
+	}
+	if !inserted {
+		b.Write(generated)
+	}
+	return b.Bytes(), nil
+}
+
+// buildResolvConf generates resolv.conf from netmsg.
+// When preserveHost is true, the current /etc/resolv.conf is merged with mergeResolvConf.
+func buildResolvConf(netmsg common.NetworkMessage, preserveHost bool) ([]byte, error) {
+	if !preserveHost {
+		return generateResolvConf(netmsg)
+	}
+	host, err := ioutil.ReadFile("/etc/resolv.conf")
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "reading /etc/resolv.conf")
+	}
+	return mergeResolvConf(host, netmsg)
+}
+
+// validateResolvConfPath checks that netmsg.ResolvConfPath is a regular file.
+func validateResolvConfPath(netmsg common.NetworkMessage) error {
+	st, err := os.Stat(netmsg.ResolvConfPath)
+	if err != nil {
+		return errors.Wrap(err, "invalid resolv.conf path")
+	}
+	if !st.Mode().IsRegular() {
+		return errors.Errorf("invalid resolv.conf path %q: not a regular file", netmsg.ResolvConfPath)
+	}
+	return nil
+}
+
+// readOrGenerateResolvConf returns the content of netmsg.ResolvConfPath if set,
+// otherwise generates it with buildResolvConf.
+func readOrGenerateResolvConf(netmsg common.NetworkMessage, preserveHost bool) ([]byte, error) {
+	if netmsg.ResolvConfPath == "" {
+		return buildResolvConf(netmsg, preserveHost)
+	}
+	if err := validateResolvConfPath(netmsg); err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadFile(netmsg.ResolvConfPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading %s", netmsg.ResolvConfPath)
+	}
+	return b, nil
+}
+
+// resolvConfSource returns the file to be bind-mounted on /etc/resolv.conf.
+func resolvConfSource(tempDir string, netmsg common.NetworkMessage) string {
+	if netmsg.ResolvConfPath != "" {
+		return netmsg.ResolvConfPath
+	}
+	return filepath.Join(tempDir, "resolv.conf")
+}
+
+func writeResolvConf(netmsg common.NetworkMessage, preserveHost bool) error {
+	b, err := readOrGenerateResolvConf(netmsg, preserveHost)
+	if err != nil {
+		return err
+	}
+	// remove copied-up link
+	warnReplacingSymlink("/etc/resolv.conf")
+	_ = os.Remove("/etc/resolv.conf")
+	if err := ioutil.WriteFile("/etc/resolv.conf", b, 0644); err != nil {
+		return errors.Wrapf(err, "writing %s", "/etc/resolv.conf")
+	}
+	return nil
+}
+
+// mountResolvConf does not work when /etc/resolv.conf is a managed by
+// systemd or NetworkManager, because our bind-mounted /etc/resolv.conf (in our namespaces)
+// is unexpectedly unmounted when /etc/resolv.conf is recreated in the initial initial namespace.
+//
+// If /etc/resolv.conf is a symlink, e.g. to ../run/systemd/resolve/stub-resolv.conf,
+// our bind-mounted /etc/resolv.conf is still unmounted when /run/systemd/resolve/stub-resolv.conf is recreated.
+//
+// Use writeResolvConf with copying-up /etc for most cases, or watchResolvConf
+// for re-mounting /etc/resolv.conf on recreation.
+//
+// netmsg.ResolvConfPath is bind-mounted as-is when set.
+func mountResolvConf(ctx context.Context, tempDir string, netmsg common.NetworkMessage, preserveHost bool) error {
+	myResolvConf := resolvConfSource(tempDir, netmsg)
+	if netmsg.ResolvConfPath != "" {
+		if err := validateResolvConfPath(netmsg); err != nil {
+			return err
+		}
+	} else {
+		b, err := buildResolvConf(netmsg, preserveHost)
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(myResolvConf, b, 0644); err != nil {
+			return errors.Wrapf(err, "writing %s", myResolvConf)
+		}
+	}
+	target, err := resolveMountTarget("/etc/resolv.conf")
+	if err != nil {
+		return err
+	}
+	cmds := [][]string{
+		{"mount", "--bind", myResolvConf, target},
+	}
+	if err := common.ExecsContext(ctx, os.Stderr, os.Environ(), cmds); err != nil {
+		return errors.Wrapf(err, "executing %v", cmds)
+	}
+	return nil
+}
+
+// updateResolvConf rewrites /etc/resolv.conf, for the running target command.
+// When /etc/resolv.conf is copied up, the file is written with writeEtcFile.
+// Otherwise the copy under tempDir is written with writeFileInPlace, not atomically,
+// as renaming another file over the copy would detach it from the existing bind-mount on /etc/resolv.conf.
+func updateResolvConf(tempDir string, netmsg common.NetworkMessage, copiedUp, preserveHost bool) error {
+	b, err := buildResolvConf(netmsg, preserveHost)
+	if err != nil {
+		return err
+	}
+	if copiedUp {
+		return writeEtcFile("/etc/resolv.conf", b)
+	}
+	myResolvConf := filepath.Join(tempDir, "resolv.conf")
+	if err := writeFileInPlace(myResolvConf, b); err != nil {
+		return errors.Wrapf(err, "writing %s", myResolvConf)
+	}
+	return nil
+}
+
+// watchResolvConf watches the host for recreating /etc/resolv.conf (or the target of the symlink),
+// and bind-mounts myResolvConf again, as the recreation unmounts our bind-mount.
+// mountResolvConf needs to be called beforehand, and myResolvConf needs to be resolvConfSource.
+// The returned function stops the watcher.
+func watchResolvConf(myResolvConf string) (func(), error) {
+	target, err := filepath.EvalSymlinks("/etc/resolv.conf")
+	if err != nil {
+		return nil, errors.Wrap(err, "resolving /etc/resolv.conf")
+	}
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, errors.Wrap(err, "creating inotify watcher")
+	}
+	if err := w.Add(filepath.Dir(target)); err != nil {
+		w.Close()
+		return nil, errors.Wrapf(err, "watching %s", filepath.Dir(target))
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case ev, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				if ev.Name != target || ev.Op&fsnotify.Create == 0 {
+					continue
+				}
+				cmds := [][]string{
+					{"mount", "--bind", myResolvConf, target},
+				}
+				if err := common.Execs(os.Stderr, os.Environ(), cmds); err != nil {
+					logrus.WithError(err).Warnf("failed to re-mount %s", target)
+					continue
+				}
+				logrus.Debugf("re-mounted %s on %s", myResolvConf, target)
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				logrus.WithError(err).Warn("error while watching resolv.conf")
+			}
+		}
+	}()
+	return func() {
+		w.Close()
+		<-done
+	}, nil
+}
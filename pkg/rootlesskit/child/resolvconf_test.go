@@ -0,0 +1,238 @@
+package child
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/rancher/k3s/pkg/rootlesskit/common"
+)
+
+func TestGenerateResolvConf(t *testing.T) {
+	testCases := []struct {
+		name     string
+		netmsg   common.NetworkMessage
+		expected string
+		wantErr  bool
+	}{
+		{
+			name:     "legacy",
+			netmsg:   common.NetworkMessage{DNS: "10.0.2.3"},
+			expected: "nameserver 10.0.2.3\n",
+		},
+		{
+			name:     "ipv6",
+			netmsg:   common.NetworkMessage{DNSServers: []string{"fd00::3", "2001:4860:4860::8888"}},
+			expected: "nameserver fd00::3\nnameserver 2001:4860:4860::8888\n",
+		},
+		{
+			name:     "ipv6 with zone",
+			netmsg:   common.NetworkMessage{DNSServers: []string{"fe80::1%tap0"}},
+			expected: "nameserver fe80::1%tap0\n",
+		},
+		{
+			name:     "dual stack",
+			netmsg:   common.NetworkMessage{DNS: "ignored", DNSServers: []string{"10.0.2.3", "fd00::3"}},
+			expected: "nameserver 10.0.2.3\nnameserver fd00::3\n",
+		},
+		{
+			name: "search and options",
+			netmsg: common.NetworkMessage{
+				DNSServers:    []string{"fd00::3"},
+				SearchDomains: []string{"example.com", "example.org"},
+				ResolvOptions: []string{"ndots:2", "edns0"},
+			},
+			expected: "nameserver fd00::3\nsearch example.com example.org\noptions ndots:2 edns0\n",
+		},
+		{
+			name:    "invalid",
+			netmsg:  common.NetworkMessage{DNSServers: []string{"[fd00::3]"}},
+			wantErr: true,
+		},
+		{
+			name:     "none",
+			expected: "",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			b, err := generateResolvConf(tc.netmsg)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %q", string(b))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != tc.expected {
+				t.Fatalf("expected %q, got %q", tc.expected, string(b))
+			}
+		})
+	}
+}
+
+func TestWriteResolvConfIPv6(t *testing.T) {
+	if !runInNamespaces(t, 0) {
+		return
+	}
+	if err := syscall.Mount("none", "/etc", "tmpfs", 0, ""); err != nil {
+		t.Fatal(err)
+	}
+	netmsg := common.NetworkMessage{DNSServers: []string{"fd00::3", "fe80::1%tap0"}}
+	if err := writeResolvConf(netmsg, false); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile("/etc/resolv.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "nameserver fd00::3\nnameserver fe80::1%tap0\n"
+	if string(b) != expected {
+		t.Fatalf("expected %q, got %q", expected, string(b))
+	}
+}
+
+func TestMountResolvConfSymlink(t *testing.T) {
+	if !runInNamespaces(t, 0) {
+		return
+	}
+	for _, d := range []string{"/etc", "/run"} {
+		if err := syscall.Mount("none", d, "tmpfs", 0, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	const stub = "/run/systemd/resolve/stub-resolv.conf"
+	if err := os.MkdirAll(filepath.Dir(stub), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(stub, []byte("nameserver 127.0.0.53\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../run/systemd/resolve/stub-resolv.conf", "/etc/resolv.conf"); err != nil {
+		t.Fatal(err)
+	}
+	tempDir, err := ioutil.TempDir("", "resolvconf-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	netmsg := common.NetworkMessage{DNS: "10.0.2.3"}
+	if err := mountResolvConf(context.Background(), tempDir, netmsg, false); err != nil {
+		t.Fatal(err)
+	}
+	st, err := os.Lstat("/etc/resolv.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Mode()&os.ModeSymlink == 0 {
+		t.Fatal("expected /etc/resolv.conf to remain a symlink")
+	}
+	for _, p := range []string{"/etc/resolv.conf", stub} {
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := "nameserver 10.0.2.3\n"; string(b) != expected {
+			t.Fatalf("expected %q in %s, got %q", expected, p, string(b))
+		}
+	}
+}
+
+func TestUpdateResolvConfMounted(t *testing.T) {
+	if !runInNamespaces(t, 0) {
+		return
+	}
+	if err := syscall.Mount("none", "/etc", "tmpfs", 0, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile("/etc/resolv.conf", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	tempDir, err := ioutil.TempDir("", "resolvconf-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	if err := mountResolvConf(context.Background(), tempDir, common.NetworkMessage{DNS: "10.0.2.3"}, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := updateResolvConf(tempDir, common.NetworkMessage{DNS: "10.0.2.4"}, false, false); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile("/etc/resolv.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "nameserver 10.0.2.4\n"; string(b) != expected {
+		t.Fatalf("expected %q, got %q", expected, string(b))
+	}
+}
+
+func TestMergeResolvConf(t *testing.T) {
+	const host = `# Generated by resolvconf
+# Do not edit
+nameserver 192.168.1.1
+nameserver 192.168.1.2
+search lan
+options timeout:1
+sortlist 130.155.160.0/255.255.240.0`
+	testCases := []struct {
+		name     string
+		host     string
+		netmsg   common.NetworkMessage
+		expected string
+	}{
+		{
+			name:   "nameservers",
+			host:   host,
+			netmsg: common.NetworkMessage{DNSServers: []string{"10.0.2.3", "fd00::3"}},
+			expected: `# Generated by resolvconf
+# Do not edit
+nameserver 10.0.2.3
+nameserver fd00::3
+search lan
+options timeout:1
+sortlist 130.155.160.0/255.255.240.0
+`,
+		},
+		{
+			name:   "search and options",
+			host:   host,
+			netmsg: common.NetworkMessage{DNS: "10.0.2.3", SearchDomains: []string{"example.com"}, ResolvOptions: []string{"ndots:2"}},
+			expected: `# Generated by resolvconf
+# Do not edit
+nameserver 10.0.2.3
+search example.com
+options ndots:2
+sortlist 130.155.160.0/255.255.240.0
+`,
+		},
+		{
+			name:     "no nameserver line",
+			host:     "# empty\n",
+			netmsg:   common.NetworkMessage{DNS: "10.0.2.3"},
+			expected: "# empty\nnameserver 10.0.2.3\n",
+		},
+		{
+			name:     "no host file",
+			netmsg:   common.NetworkMessage{DNS: "10.0.2.3"},
+			expected: "nameserver 10.0.2.3\n",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			b, err := mergeResolvConf([]byte(tc.host), tc.netmsg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != tc.expected {
+				t.Fatalf("expected %q, got %q", tc.expected, string(b))
+			}
+		})
+	}
+}
@@ -0,0 +1,39 @@
+package child
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+
+	"github.com/opencontainers/runc/libcontainer/configs"
+	"github.com/opencontainers/runc/libcontainer/seccomp"
+	"github.com/opencontainers/runc/libcontainer/specconv"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+)
+
+// loadSeccompProfile loads the seccomp profile in the format of the "linux.seccomp" object of the OCI runtime spec.
+// Unknown fields are rejected, so that the profiles in other formats are not silently misinterpreted.
+func loadSeccompProfile(p string) (*configs.Seccomp, error) {
+	if !seccomp.IsEnabled() {
+		return nil, errors.New("seccomp is not supported by the kernel or by the build (needs the \"seccomp\" build tag)")
+	}
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading the seccomp profile")
+	}
+	var profile specs.LinuxSeccomp
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&profile); err != nil {
+		return nil, errors.Wrapf(err, "parsing the seccomp profile %s", p)
+	}
+	config, err := specconv.SetupSeccomp(&profile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid seccomp profile %s", p)
+	}
+	if config == nil {
+		return nil, errors.Errorf("invalid seccomp profile %s: no default action nor syscalls", p)
+	}
+	return config, nil
+}
@@ -0,0 +1,50 @@
+package child
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// forwardSignals relays SIGTERM, SIGINT, and SIGHUP received by the current process to proc.
+// When gracePeriod is non-zero, proc is killed with SIGKILL if it is still running
+// gracePeriod after the first relayed signal.
+//
+// The returned function stops relaying, and needs to be called after proc exits.
+func forwardSignals(proc *os.Process, gracePeriod time.Duration) func() {
+	sigCh := make(chan os.Signal, 32)
+	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	doneCh := make(chan struct{})
+	finishedCh := make(chan struct{})
+	go func() {
+		defer close(finishedCh)
+		var killCh <-chan time.Time
+		for {
+			select {
+			case sig := <-sigCh:
+				logrus.Debugf("child: forwarding signal %v to pid %d", sig, proc.Pid)
+				if err := proc.Signal(sig); err != nil {
+					logrus.Warnf("child: failed to forward signal %v to pid %d: %v", sig, proc.Pid, err)
+				}
+				if gracePeriod > 0 && killCh == nil {
+					killCh = time.After(gracePeriod)
+				}
+			case <-killCh:
+				logrus.Warnf("child: pid %d did not exit in %v, sending SIGKILL", proc.Pid, gracePeriod)
+				if err := proc.Kill(); err != nil {
+					logrus.Warnf("child: failed to kill pid %d: %v", proc.Pid, err)
+				}
+			case <-doneCh:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(sigCh)
+		close(doneCh)
+		<-finishedCh
+	}
+}
@@ -0,0 +1,145 @@
+package child
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/rancher/k3s/pkg/rootlesskit/common"
+	"github.com/rancher/k3s/pkg/rootlesskit/port"
+)
+
+// StatusVersion is incremented on incompatible changes to Status.
+const StatusVersion = 1
+
+// StatusFileName is the name of the status file under StateDir.
+const StatusFileName = "status.json"
+
+// Status is written to StateDir/status.json after the setup,
+// and removed when the child exits.
+type Status struct {
+	Version int `json:"version"`
+	// Network is nil for HostNetwork.
+	Network *NetworkStatus `json:"network,omitempty"`
+	// Ports are the ports that were published when the status was written.
+	// Empty unless the port driver implements port.ChildManager.
+	Ports []port.Status `json:"ports,omitempty"`
+	// Process is set after the target command started.
+	Process *ProcessStatus `json:"process,omitempty"`
+}
+
+// ProcessStatus is the target command.
+type ProcessStatus struct {
+	// PID is in the PID namespace of the child.
+	PID int `json:"pid"`
+	// Namespaces are the inode numbers of the namespaces, e.g. {"net": 4026532281}.
+	Namespaces map[string]uint64 `json:"namespaces,omitempty"`
+}
+
+// NetworkStatus is the configuration of the network.
+type NetworkStatus struct {
+	Interfaces []InterfaceStatus `json:"interfaces"`
+	DNS        []string          `json:"dns,omitempty"`
+}
+
+// InterfaceStatus is the configuration of a tap device.
+type InterfaceStatus struct {
+	Tap         string `json:"tap"`
+	IP          string `json:"ip"`
+	Netmask     int    `json:"netmask"`
+	Gateway     string `json:"gateway,omitempty"`
+	IPv6        string `json:"ipv6,omitempty"`
+	IPv6Netmask int    `json:"ipv6Netmask,omitempty"`
+	IPv6Gateway string `json:"ipv6Gateway,omitempty"`
+	MTU         int    `json:"mtu,omitempty"`
+	TxQueueLen  int    `json:"txqueuelen,omitempty"`
+	Primary     bool   `json:"primary,omitempty"`
+	// DHCP is set when IP, Netmask, and Gateway were leased with DHCP.
+	DHCP bool `json:"dhcp,omitempty"`
+	// Gateways are set for the multipath default route.
+	Gateways []string `json:"gateways,omitempty"`
+}
+
+func createStatus(msg common.Message, opt Opt, taps []string, proc *ProcessStatus) (*Status, error) {
+	st := &Status{
+		Version: StatusVersion,
+		Process: proc,
+	}
+	if opt.NetworkDriver != nil {
+		ifaces, primary, err := interfaces(msg.Network)
+		if err != nil {
+			return nil, err
+		}
+		st.Network = &NetworkStatus{
+			DNS: dnsServers(msg.Network),
+		}
+		for i, tap := range taps {
+			iface := ifaces[i]
+			st.Network.Interfaces = append(st.Network.Interfaces, InterfaceStatus{
+				Tap:         tap,
+				IP:          iface.IP,
+				Netmask:     iface.Netmask,
+				Gateway:     iface.Gateway,
+				Gateways:    iface.Gateways,
+				IPv6:        iface.IPv6,
+				IPv6Netmask: iface.IPv6Netmask,
+				IPv6Gateway: iface.IPv6Gateway,
+				MTU:         iface.MTU,
+				TxQueueLen:  iface.TxQueueLen,
+				Primary:     i == primary,
+				DHCP:        iface.DHCP,
+			})
+		}
+	}
+	if pm, ok := opt.PortDriver.(port.ChildManager); ok {
+		ports, err := pm.ListPorts(context.TODO())
+		if err != nil {
+			return nil, err
+		}
+		st.Ports = ports
+	}
+	return st, nil
+}
+
+// writeStatus writes the status file atomically.
+func writeStatus(msg common.Message, opt Opt, taps []string, proc *ProcessStatus) error {
+	st, err := createStatus(msg, opt, taps, proc)
+	if err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	p := filepath.Join(msg.StateDir, StatusFileName)
+	tmp, err := ioutil.TempFile(msg.StateDir, "."+StatusFileName)
+	if err != nil {
+		return errors.Wrapf(err, "creating a temporary file for %s", p)
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return errors.Wrapf(err, "writing %s", tmp.Name())
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return errors.Wrapf(err, "closing %s", tmp.Name())
+	}
+	if err := os.Rename(tmp.Name(), p); err != nil {
+		os.Remove(tmp.Name())
+		return errors.Wrapf(err, "renaming %s to %s", tmp.Name(), p)
+	}
+	return nil
+}
+
+func removeStatus(stateDir string) {
+	p := filepath.Join(stateDir, StatusFileName)
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		logrus.WithError(err).Warnf("failed to remove %s", p)
+	}
+}
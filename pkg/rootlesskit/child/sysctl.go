@@ -0,0 +1,51 @@
+package child
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/rancher/k3s/pkg/rootlesskit/common"
+)
+
+// sysctlPath returns the path under /proc/sys for the key.
+// Only the sysctls namespaced in the network namespace are allowed.
+func sysctlPath(key string) (string, error) {
+	if !strings.HasPrefix(key, "net.") {
+		return "", errors.Errorf("sysctl %q is not namespaced in the network namespace", key)
+	}
+	for _, c := range strings.Split(key, ".") {
+		if c == "" || c == ".." || strings.Contains(c, "/") {
+			return "", errors.Errorf("invalid sysctl %q", key)
+		}
+	}
+	return filepath.Join("/proc/sys", strings.Replace(key, ".", "/", -1)), nil
+}
+
+// applySysctls applies the sysctls in the sorted order of the keys.
+func applySysctls(ctx context.Context, sysctls map[string]string) error {
+	keys := make([]string, 0, len(sysctls))
+	for k := range sysctls {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		p, err := sysctlPath(k)
+		if err != nil {
+			return err
+		}
+		if common.IsDryRun(ctx) {
+			logrus.Infof("[dry-run] writing %q to %s", sysctls[k], p)
+			continue
+		}
+		if err := ioutil.WriteFile(p, []byte(sysctls[k]), 0644); err != nil {
+			return errors.Wrapf(err, "setting sysctl %s=%s", k, sysctls[k])
+		}
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package child
+
+import (
+	"context"
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSysctlPath(t *testing.T) {
+	testCases := []struct {
+		key      string
+		expected string
+		wantErr  bool
+	}{
+		{key: "net.ipv4.ip_forward", expected: "/proc/sys/net/ipv4/ip_forward"},
+		{key: "net.ipv4.ping_group_range", expected: "/proc/sys/net/ipv4/ping_group_range"},
+		{key: "kernel.pid_max", wantErr: true},
+		{key: "vm.overcommit_memory", wantErr: true},
+		{key: "net..ip_forward", wantErr: true},
+		{key: "net.ipv4.", wantErr: true},
+		{key: "net.ipv4/../../kernel", wantErr: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.key, func(t *testing.T) {
+			got, err := sysctlPath(tc.key)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.expected {
+				t.Fatalf("expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestApplySysctlsPingGroupRange(t *testing.T) {
+	if !runInNamespaces(t, syscall.CLONE_NEWNET) {
+		return
+	}
+	if err := exec.Command("ip", "link", "set", "lo", "up").Run(); err != nil {
+		t.Fatal(err)
+	}
+	if fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, syscall.IPPROTO_ICMP); err == nil {
+		syscall.Close(fd)
+		t.Fatal("expected ICMP sockets to be disallowed by the default ping_group_range")
+	}
+	// only gid 0 is mapped in the user namespace
+	if err := applySysctls(context.Background(), map[string]string{"net.ipv4.ping_group_range": "0 0"}); err != nil {
+		t.Fatal(err)
+	}
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, syscall.IPPROTO_ICMP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fd)
+	tv := syscall.NsecToTimeval(int64(5 * time.Second))
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		t.Fatal(err)
+	}
+	// echo request; the kernel fills in the identifier and the checksum
+	req := []byte{8, 0, 0, 0, 0, 0, 0, 1}
+	if err := syscall.Sendto(fd, req, 0, &syscall.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	n, _, err := syscall.Recvfrom(fd, buf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n < 8 || buf[0] != 0 {
+		t.Fatalf("expected an echo reply, got %v", buf[:n])
+	}
+}
+
+func TestApplySysctlsNotNamespaced(t *testing.T) {
+	err := applySysctls(context.Background(), map[string]string{"kernel.pid_max": "4194304"})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+}
@@ -0,0 +1,57 @@
+package child
+
+import (
+	"os/exec"
+	"runtime"
+
+	"github.com/opencontainers/runc/libcontainer/configs"
+	"github.com/opencontainers/runc/libcontainer/seccomp"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// threadAttrs are the attributes of a thread that are inherited by the processes forked from the thread.
+type threadAttrs struct {
+	netnsPath  string
+	noNewPrivs bool
+	seccomp    *configs.Seccomp
+}
+
+// startCmdOnThread starts cmd from a dedicated locked thread, after applying attrs to the thread.
+//
+// NoNewPrivs and the seccomp filter cannot be removed from the thread, so the thread is terminated after exited is closed.
+// The thread is not terminated earlier, as the termination would trigger Pdeathsig of cmd.
+//
+// As with OCI runtimes, the seccomp profile needs to permit the syscalls for executing the command.
+func startCmdOnThread(cmd *exec.Cmd, attrs threadAttrs, exited <-chan struct{}) error {
+	errCh := make(chan error)
+	go func() {
+		// never unlocked, so that the thread is terminated when the goroutine returns
+		runtime.LockOSThread()
+		if attrs.netnsPath != "" {
+			if err := setns(attrs.netnsPath); err != nil {
+				errCh <- err
+				return
+			}
+		}
+		if attrs.noNewPrivs {
+			if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+				errCh <- errors.Wrap(err, "setting no_new_privs")
+				return
+			}
+		}
+		if attrs.seccomp != nil {
+			if err := seccomp.InitSeccomp(attrs.seccomp); err != nil {
+				errCh <- errors.Wrap(err, "installing the seccomp profile")
+				return
+			}
+		}
+		if err := cmd.Start(); err != nil {
+			errCh <- err
+			return
+		}
+		errCh <- nil
+		<-exited
+	}()
+	return <-errCh
+}
@@ -0,0 +1,59 @@
+package child
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStartCmdOnThreadNoNewPrivs(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("creating a setuid binary requires root")
+	}
+	dir, err := ioutil.TempDir("", "nonewprivs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Chmod(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile("/usr/bin/id")
+	if err != nil {
+		t.Skip(err)
+	}
+	setuidID := filepath.Join(dir, "id")
+	if err := ioutil.WriteFile(setuidID, b, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(setuidID, 0755|os.ModeSetuid); err != nil {
+		t.Fatal(err)
+	}
+	euid := func(noNewPrivs bool) string {
+		cmd, err := createCmd(context.Background(), Opt{RunAsUser: "1000", RunAsGroup: "1000"}, []string{setuidID, "-u"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var stdout bytes.Buffer
+		cmd.Stdout = &stdout
+		exited := make(chan struct{})
+		defer close(exited)
+		if err := startCmdOnThread(cmd, threadAttrs{noNewPrivs: noNewPrivs}, exited); err != nil {
+			t.Fatal(err)
+		}
+		if err := cmd.Wait(); err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimSpace(stdout.String())
+	}
+	if got := euid(false); got != "0" {
+		t.Skipf("the setuid bit is not effective under %s (euid %s)", dir, got)
+	}
+	if got := euid(true); got != "1000" {
+		t.Fatalf("expected the setuid binary to fail to elevate with no_new_privs, got euid %s", got)
+	}
+}
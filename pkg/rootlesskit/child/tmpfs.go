@@ -0,0 +1,55 @@
+package child
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+
+	"github.com/rancher/k3s/pkg/rootlesskit/common"
+)
+
+// TmpfsMount is a private tmpfs mount in the namespace.
+type TmpfsMount struct {
+	Target string
+	// SizeBytes can be 0 for the kernel default (half of the RAM).
+	SizeBytes int64
+	// Mode can be 0 for the kernel default (1777).
+	Mode os.FileMode
+}
+
+// setupTmpfsMounts mounts tmpfs with nosuid and nodev, in the order.
+func setupTmpfsMounts(ctx context.Context, tmpfsMounts []TmpfsMount) error {
+	for _, tm := range tmpfsMounts {
+		if !filepath.IsAbs(tm.Target) {
+			return errors.Errorf("failed to mount tmpfs on %s: target must be absolute", tm.Target)
+		}
+		if tm.SizeBytes < 0 {
+			return errors.Errorf("failed to mount tmpfs on %s: invalid size %d", tm.Target, tm.SizeBytes)
+		}
+		var opts []string
+		if tm.SizeBytes > 0 {
+			opts = append(opts, "size="+strconv.FormatInt(tm.SizeBytes, 10))
+		}
+		if tm.Mode != 0 {
+			mode := uint64(tm.Mode.Perm())
+			if tm.Mode&os.ModeSticky != 0 {
+				mode |= unix.S_ISVTX
+			}
+			opts = append(opts, "mode="+strconv.FormatUint(mode, 8))
+		}
+		if !common.IsDryRun(ctx) {
+			if err := os.MkdirAll(tm.Target, 0755); err != nil {
+				return errors.Wrapf(err, "failed to mount tmpfs on %s", tm.Target)
+			}
+		}
+		if err := mount(ctx, "tmpfs", tm.Target, "tmpfs", unix.MS_NOSUID|unix.MS_NODEV, strings.Join(opts, ",")); err != nil {
+			return errors.Wrapf(err, "failed to mount tmpfs on %s", tm.Target)
+		}
+	}
+	return nil
+}
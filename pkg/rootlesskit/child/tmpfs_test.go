@@ -0,0 +1,56 @@
+package child
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestSetupTmpfsMountsInvalid(t *testing.T) {
+	testCases := []struct {
+		name string
+		tm   TmpfsMount
+	}{
+		{"relative", TmpfsMount{Target: "run"}},
+		{"negative size", TmpfsMount{Target: "/run", SizeBytes: -1}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := setupTmpfsMounts(context.Background(), []TmpfsMount{tc.tm}); err == nil {
+				t.Fatalf("expected an error for %+v", tc.tm)
+			}
+		})
+	}
+}
+
+func TestSetupTmpfsMounts(t *testing.T) {
+	if !runInNamespaces(t, 0) {
+		return
+	}
+	dir, err := ioutil.TempDir("", "tmpfs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	const size = 64 * 1024
+	target := filepath.Join(dir, "scratch")
+	if err := setupTmpfsMounts(context.Background(), []TmpfsMount{{Target: target, SizeBytes: size, Mode: 0700}}); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Unmount(target, syscall.MNT_DETACH)
+	st, err := os.Stat(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Mode().Perm() != 0700 {
+		t.Fatalf("expected mode 0700, got %v", st.Mode().Perm())
+	}
+	err = ioutil.WriteFile(filepath.Join(target, "f"), bytes.Repeat([]byte{'x'}, 2*size), 0644)
+	if pathErr, ok := err.(*os.PathError); !ok || pathErr.Err != syscall.ENOSPC {
+		t.Fatalf("expected ENOSPC, got %v", err)
+	}
+}
@@ -0,0 +1,18 @@
+package child
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+const devNetTun = "/dev/net/tun"
+
+// checkDevNetTun verifies that /dev/net/tun can be opened, before the network driver creates the tap devices.
+func checkDevNetTun() error {
+	f, err := os.OpenFile(devNetTun, os.O_RDWR, 0)
+	if err != nil {
+		return errors.Wrapf(err, "%s not available; load the tun module or grant access", devNetTun)
+	}
+	return f.Close()
+}
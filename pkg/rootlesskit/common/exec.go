@@ -0,0 +1,120 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// GetExecExitStatus returns the exit status of the command that failed with err.
+// err may be *ExecError, optionally wrapped with github.com/pkg/errors.
+func GetExecExitStatus(err error) (int, bool) {
+	err = errors.Cause(err)
+	if execErr, ok := err.(*ExecError); ok {
+		err = execErr.Err
+	}
+	if err == nil {
+		return 0, false
+	}
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return 0, false
+	}
+	status, ok := exitErr.Sys().(syscall.WaitStatus)
+	if !ok {
+		return 0, false
+	}
+	return status.ExitStatus(), true
+}
+
+// ExecError is returned from Execs and ExecsContext when a command fails.
+// ExecError wrapped with github.com/pkg/errors can be retrieved with errors.Cause.
+type ExecError struct {
+	// Index is the index of the failed command in the commands.
+	Index int
+	// Args is the failed command.
+	Args []string
+	// Stderr is the tail of the stderr of the failed command.
+	Stderr string
+	Err    error
+}
+
+func (e *ExecError) Error() string {
+	s := fmt.Sprintf("command #%d %v failed: %v", e.Index, e.Args, e.Err)
+	if e.Stderr != "" {
+		s += ": " + e.Stderr
+	}
+	return s
+}
+
+// maxExecErrorStderr is the maximum length of ExecError.Stderr.
+const maxExecErrorStderr = 1024
+
+// NewExecError creates ExecError with the tail of stderr.
+func NewExecError(index int, args []string, stderr []byte, err error) *ExecError {
+	if len(stderr) > maxExecErrorStderr {
+		stderr = stderr[len(stderr)-maxExecErrorStderr:]
+	}
+	return &ExecError{
+		Index:  index,
+		Args:   args,
+		Stderr: strings.TrimSpace(string(stderr)),
+		Err:    err,
+	}
+}
+
+func Execs(o io.Writer, env []string, cmds [][]string) error {
+	return ExecsContext(context.Background(), o, env, cmds)
+}
+
+type dryRunKey struct{}
+
+// WithDryRun returns a context that makes ExecsContext log the commands instead of executing them.
+func WithDryRun(ctx context.Context) context.Context {
+	return context.WithValue(ctx, dryRunKey{}, true)
+}
+
+// IsDryRun returns true if ctx was created with WithDryRun.
+func IsDryRun(ctx context.Context) bool {
+	dryRun, _ := ctx.Value(dryRunKey{}).(bool)
+	return dryRun
+}
+
+// ExecsContext is similar to Execs but kills the command in progress when ctx is done.
+// The error of the failed command is *ExecError.
+func ExecsContext(ctx context.Context, o io.Writer, env []string, cmds [][]string) error {
+	for i, cmd := range cmds {
+		if IsDryRun(ctx) {
+			logrus.Infof("[dry-run] executing %v", cmd)
+			continue
+		}
+		var args []string
+		if len(cmd) > 1 {
+			args = cmd[1:]
+		}
+		x := exec.CommandContext(ctx, cmd[0], args...)
+		x.Stdin = nil
+		var stderr bytes.Buffer
+		x.Stdout = o
+		x.Stderr = &stderr
+		if o != nil {
+			x.Stderr = io.MultiWriter(o, &stderr)
+		}
+		x.Env = env
+		x.SysProcAttr = &syscall.SysProcAttr{
+			Pdeathsig: syscall.SIGKILL,
+		}
+		logrus.Debugf("executing %v", cmd)
+		if err := x.Run(); err != nil {
+			return NewExecError(i, cmd, stderr.Bytes(), err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package common
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestExecsContextError(t *testing.T) {
+	testCases := []struct {
+		name           string
+		cmds           [][]string
+		expectedIndex  int
+		expectedStderr string
+		expectedStatus int
+	}{
+		{
+			name:           "first",
+			cmds:           [][]string{{"sh", "-c", "echo foo >&2; exit 42"}, {"true"}},
+			expectedIndex:  0,
+			expectedStderr: "foo",
+			expectedStatus: 42,
+		},
+		{
+			name:           "last",
+			cmds:           [][]string{{"true"}, {"sh", "-c", "echo bar >&2"}, {"sh", "-c", "echo baz >&2; exit 1"}},
+			expectedIndex:  2,
+			expectedStderr: "baz",
+			expectedStatus: 1,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := ExecsContext(context.Background(), nil, os.Environ(), tc.cmds)
+			execErr, ok := errors.Cause(errors.Wrap(err, "wrapped")).(*ExecError)
+			if !ok {
+				t.Fatalf("expected ExecError, got %v", err)
+			}
+			if execErr.Index != tc.expectedIndex {
+				t.Fatalf("expected index %d, got %d", tc.expectedIndex, execErr.Index)
+			}
+			if execErr.Stderr != tc.expectedStderr {
+				t.Fatalf("expected stderr %q, got %q", tc.expectedStderr, execErr.Stderr)
+			}
+			status, ok := GetExecExitStatus(errors.Wrap(err, "wrapped"))
+			if !ok || status != tc.expectedStatus {
+				t.Fatalf("expected exit status %d, got %d (%v)", tc.expectedStatus, status, ok)
+			}
+		})
+	}
+}
+
+func TestNewExecErrorStderrTail(t *testing.T) {
+	stderr := make([]byte, maxExecErrorStderr*2)
+	for i := range stderr {
+		stderr[i] = 'a'
+	}
+	stderr[len(stderr)-1] = 'z'
+	execErr := NewExecError(0, []string{"false"}, stderr, errors.New("failed"))
+	if len(execErr.Stderr) != maxExecErrorStderr || execErr.Stderr[maxExecErrorStderr-1] != 'z' {
+		t.Fatalf("expected the tail of stderr, got %d bytes", len(execErr.Stderr))
+	}
+}
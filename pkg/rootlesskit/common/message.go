@@ -0,0 +1,184 @@
+package common
+
+import "encoding/json"
+
+const (
+	// ProtocolVersion is the version of Message sent by the parent.
+	// Incremented on incompatible changes.
+	ProtocolVersion = 4
+	// MinProtocolVersion is the oldest version of Message accepted by the child.
+	// Version 1 parents do not read Message 2.
+	// Version 2 parents do not send Message 3.
+	// Version 3 parents do not read Message 4.
+	MinProtocolVersion = 2
+)
+
+// Message is sent between the parent and the child over a socketpair
+// as JSON, with uint32be length header.
+// Message 0 and Message 1 are sent from the parent to the child.
+// Message 2 is sent from the child to the parent.
+// Message 3 can be sent from the parent to the child any number of times after Message 2.
+// Message 4 is sent from the child to the parent after Message 2, when the target command started.
+type Message struct {
+	// Version is ProtocolVersion of the sender. 0 means an unversioned parent.
+	Version int
+	Stage   int // 0 for Message 0, 1 for Message 1, 2 for Message 2, 3 for Message 3, 4 for Message 4
+	Message0
+	Message1
+	Message2
+	Message3
+	Message4
+}
+
+// Message0 is sent after setting up idmap
+type Message0 struct {
+}
+
+// Message 1 is sent after setting up other stuff
+type Message1 struct {
+	// StateDir cannot be empty
+	StateDir string
+	Network  NetworkMessage
+	Port     PortMessage
+	// ExtraHosts are appended to /etc/hosts.
+	// Each entry is either "host ip" or "ip host".
+	ExtraHosts []string
+	// Hostname is set in the UTS namespace of the child, and resolved into 127.0.1.1 in /etc/hosts.
+	// Empty Hostname keeps the hostname of the host.
+	Hostname string
+	// ControlSocketPath is the Unix socket the child connects to after sending Message 2,
+	// for serving ControlRequest. Optional.
+	ControlSocketPath string
+}
+
+// NetworkMessage is empty for HostNetwork.
+type NetworkMessage struct {
+	// InterfaceMessage is the first interface.
+	InterfaceMessage
+	// Interfaces are the additional interfaces. Optional.
+	Interfaces []InterfaceMessage
+	DNS        string
+	// DNSServers takes precedence over DNS when non-empty.
+	DNSServers []string
+	// SearchDomains and ResolvOptions are written to resolv.conf as "search" and "options" lines.
+	SearchDomains []string
+	ResolvOptions []string
+	// Rules are the policy routing rules, e.g. for routing the packets marked with port.Spec.Mark
+	// via the table populated with RouteMessage.Table. Optional.
+	Rules []RuleMessage
+	// ResolvConfPath is mounted on /etc/resolv.conf verbatim, instead of generating it from DNS.
+	// Optional. Needs to be a regular file.
+	ResolvConfPath string
+	// DNSBridgeFD is the fd of the UDP socket created in the network namespace of the parent.
+	// When set, the child forwards the DNS queries to DNSBridgeUpstreams over the socket,
+	// and DNS and DNSServers are ignored. Optional.
+	DNSBridgeFD int
+	// DNSBridgeUpstreams are the nameservers reachable from the parent, e.g. "127.0.0.53".
+	DNSBridgeUpstreams []string
+}
+
+// InterfaceMessage is a network interface.
+type InterfaceMessage struct {
+	IP      string
+	Netmask int
+	Gateway string
+	// Gateways are the nexthops of the multipath default route, taking precedence over Gateway when non-empty.
+	// Duplicates are ignored, and a single entry is the same as Gateway. IPv4 only. Optional.
+	Gateways []string
+	// IPv6 stuff is optional. Empty IPv6 means IPv4-only.
+	IPv6        string
+	IPv6Netmask int
+	IPv6Gateway string
+	// MTU can be 0 for keeping the default MTU of the tap device.
+	MTU int
+	// TxQueueLen can be 0 for keeping the default txqueuelen of the tap device.
+	TxQueueLen int
+	// MAC can be empty for keeping the random MAC address of the tap device.
+	MAC string
+	// DHCP leases IP, Netmask, and Gateway (and DNSServers for the primary interface, unless set)
+	// from the DHCP server on the tap device, instead of the static configuration.
+	// IP needs to be empty. IPv6 is still configured statically.
+	DHCP bool
+	// TapName is the name of the tap device to be created by the driver.
+	// Empty means the name is chosen by the driver.
+	TapName string
+	// Routes are added after the default route, in the order.
+	Routes []RouteMessage
+	// Primary is set for the interface that has the default routes.
+	// At most one interface can be primary.
+	// When no interface is primary, the first interface is the primary.
+	Primary bool
+	// Opaque strings are specific to driver
+	Opaque map[string]string
+}
+
+// RouteMessage is a static route.
+type RouteMessage struct {
+	Dest    string // CIDR, e.g. "192.168.10.0/24"
+	Gateway string
+	Metric  int // optional
+	Table   int // optional, 0 for the main table
+	MTU     int // optional, 0 for the MTU of the interface
+}
+
+// RuleMessage is a policy routing rule that looks up Table for the packets marked with FWMark.
+type RuleMessage struct {
+	FWMark   int
+	Table    int
+	Priority int  // optional
+	IPv6     bool // the rule is for IPv4 unless set
+}
+
+// Message2 is sent from the child after setting up the namespaces,
+// before starting the target command (or after the readiness probe succeeds).
+type Message2 struct {
+	// SetupError is set when the child failed to set up the namespaces.
+	SetupError string
+	// Taps are the names of the tap devices, in the order of the interfaces.
+	Taps []string
+	// IP is the IPv4 address of the primary interface after the setup, including the DHCP lease.
+	// Empty when the primary interface has no IPv4 address.
+	IP string
+}
+
+// Message3 is sent from the parent to reconfigure the running child.
+type Message3 struct {
+	// DNSServers replaces the nameservers in /etc/resolv.conf.
+	// The search domains and the options are kept.
+	DNSServers []string
+}
+
+// Control request types.
+const (
+	ControlRequestDNS    = "dns"    // replaces the nameservers, like Message 3
+	ControlRequestStatus = "status" // returns the status of the child, as in the status file
+)
+
+// ControlRequest is sent from the parent to the child over the control socket
+// as JSON, with uint32be length header.
+// The child replies with ControlResponse for each ControlRequest, in order.
+type ControlRequest struct {
+	Type       string
+	DNSServers []string `json:",omitempty"` // for ControlRequestDNS
+}
+
+// ControlResponse is sent from the child in reply to ControlRequest.
+type ControlResponse struct {
+	// Error is set when the child failed to handle the request.
+	Error string `json:",omitempty"`
+	// Status is the JSON of the status, for ControlRequestStatus.
+	Status json.RawMessage `json:",omitempty"`
+}
+
+// Message4 is sent from the child after starting the target command.
+type Message4 struct {
+	// PID is the PID of the target command, in the PID namespace of the child.
+	PID int
+	// Namespaces are the inode numbers of the namespaces of the target command,
+	// keyed by the names in /proc/PID/ns, e.g. "net".
+	Namespaces map[string]uint64
+}
+
+type PortMessage struct {
+	Opaque map[string]string
+}
@@ -0,0 +1,11 @@
+package copyup
+
+type ChildDriver interface {
+	CopyUp([]string) ([]string, error)
+}
+
+// FileChildDriver is optionally implemented by ChildDriver,
+// for copying up individual files without copying up the parent directories.
+type FileChildDriver interface {
+	CopyUpFiles([]string) ([]string, error)
+}
@@ -0,0 +1,45 @@
+// Package drivers provides the constructor of copyup.ChildDriver by name.
+// Not in the copyup package, because the implementations import copyup.
+package drivers
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/rancher/k3s/pkg/rootlesskit/copyup"
+	"github.com/rancher/k3s/pkg/rootlesskit/copyup/overlay"
+	"github.com/rancher/k3s/pkg/rootlesskit/copyup/tmpfssymlink"
+)
+
+// TmpfsSymlink mounts tmpfs on the directory, and symlinks the original entries.
+const TmpfsSymlink = "tmpfs+symlink"
+
+// Overlay mounts overlayfs on the directory, with the upper directory on tmpfs.
+// Falls back to TmpfsSymlink when overlayfs is not available.
+const Overlay = "overlay"
+
+var childDrivers = map[string]func() copyup.ChildDriver{
+	TmpfsSymlink: tmpfssymlink.NewChildDriver,
+	Overlay:      overlay.NewChildDriver,
+}
+
+// Names returns the sorted names of the drivers.
+func Names() []string {
+	var names []string
+	for name := range childDrivers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewChildDriver returns the driver for the name.
+func NewChildDriver(name string) (copyup.ChildDriver, error) {
+	f, ok := childDrivers[name]
+	if !ok {
+		return nil, errors.Errorf("unknown copy-up driver %q (valid: %s)", name, strings.Join(Names(), ", "))
+	}
+	return f(), nil
+}
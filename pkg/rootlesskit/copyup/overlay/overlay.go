@@ -0,0 +1,156 @@
+package overlay
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/rancher/k3s/pkg/rootlesskit/common"
+	"github.com/rancher/k3s/pkg/rootlesskit/copyup"
+	"github.com/rancher/k3s/pkg/rootlesskit/copyup/tmpfssymlink"
+)
+
+// NewChildDriver returns the driver that mounts overlayfs on the directory,
+// with the upper directory on tmpfs and the original directory as the lower directory.
+// Falls back to tmpfssymlink when overlayfs is not available (needs kernel 5.11 for user namespaces),
+// or when the directory has submounts, which would be hidden by overlayfs.
+func NewChildDriver() copyup.ChildDriver {
+	return &childDriver{
+		fallback: tmpfssymlink.NewChildDriver(),
+	}
+}
+
+type childDriver struct {
+	fallback copyup.ChildDriver
+}
+
+func (d *childDriver) CopyUp(dirs []string) ([]string, error) {
+	if len(dirs) == 0 {
+		return nil, nil
+	}
+	// the upper directories are on a tmpfs outside of the copied-up directories
+	staging, err := ioutil.TempDir("/tmp", "rootlesskit-o")
+	if err != nil {
+		return nil, errors.Wrap(err, "creating staging directory under /tmp")
+	}
+	defer os.RemoveAll(staging)
+	cmds := [][]string{{"mount", "-n", "-t", "tmpfs", "none", staging}}
+	if err := common.Execs(os.Stderr, os.Environ(), cmds); err != nil {
+		return nil, errors.Wrapf(err, "executing %v", cmds)
+	}
+	// overlayfs keeps the tmpfs alive after detaching it from the staging directory
+	defer common.Execs(os.Stderr, os.Environ(), [][]string{{"umount", "-n", "-l", staging}})
+	var copied []string
+	for i, dir := range dirs {
+		dir := filepath.Clean(dir)
+		if dir == "/tmp" {
+			return copied, errors.New("/tmp cannot be copied up")
+		}
+		if _, err := os.Stat(dir); err != nil {
+			return copied, errors.Wrapf(err, "stat %s", dir)
+		}
+		sub, err := hasSubmounts(dir)
+		if err != nil {
+			return copied, err
+		}
+		if !sub {
+			err = mountOverlay(dir, filepath.Join(staging, strconv.Itoa(i)))
+			if err == nil {
+				copied = append(copied, dir)
+				continue
+			}
+			logrus.WithError(err).Warnf("failed to mount overlayfs on %s, falling back to tmpfs", dir)
+		} else {
+			logrus.Debugf("%s has submounts, falling back to tmpfs", dir)
+		}
+		fallbackCopied, err := d.fallback.CopyUp([]string{dir})
+		copied = append(copied, fallbackCopied...)
+		if err != nil {
+			return copied, err
+		}
+	}
+	return copied, nil
+}
+
+// CopyUpFiles is delegated to the fallback driver, as overlayfs cannot be mounted on files.
+func (d *childDriver) CopyUpFiles(files []string) ([]string, error) {
+	fileDriver, ok := d.fallback.(copyup.FileChildDriver)
+	if !ok {
+		return nil, errors.New("copy-up driver does not support copying up files")
+	}
+	return fileDriver.CopyUpFiles(files)
+}
+
+// mountOverlay mounts overlayfs on dir, with the upper and the work directories under base.
+func mountOverlay(dir, base string) error {
+	upper, work := filepath.Join(base, "upper"), filepath.Join(base, "work")
+	for _, p := range []string{upper, work} {
+		if err := os.MkdirAll(p, 0755); err != nil {
+			return errors.Wrapf(err, "creating %s", p)
+		}
+	}
+	st, err := os.Stat(dir)
+	if err != nil {
+		return errors.Wrapf(err, "stat %s", dir)
+	}
+	// the mode of the upper directory becomes the mode of the merged directory
+	if err := os.Chmod(upper, st.Mode()&(os.ModePerm|os.ModeSticky|os.ModeSetuid|os.ModeSetgid)); err != nil {
+		return errors.Wrapf(err, "chmod %s", upper)
+	}
+	o := "lowerdir=" + dir + ",upperdir=" + upper + ",workdir=" + work
+	cmds := [][]string{{"mount", "-n", "-t", "overlay", "overlay", "-o", o, dir}}
+	if err := common.Execs(os.Stderr, os.Environ(), cmds); err != nil {
+		os.RemoveAll(base)
+		return errors.Wrapf(err, "executing %v", cmds)
+	}
+	return nil
+}
+
+// hasSubmounts returns true if a mount point exists under dir.
+func hasSubmounts(dir string) (bool, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// "36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue"
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		if strings.HasPrefix(unescapeMountPoint(fields[4]), prefix) {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
+
+// unescapeMountPoint unescapes the octal escapes such as "\040" in mountinfo.
+func unescapeMountPoint(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) && isOctal(s[i+1]) && isOctal(s[i+2]) && isOctal(s[i+3]) {
+			b.WriteByte((s[i+1]-'0')<<6 | (s[i+2]-'0')<<3 | (s[i+3] - '0'))
+			i += 3
+			continue
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+func isOctal(c byte) bool {
+	return c >= '0' && c <= '7'
+}
@@ -0,0 +1,142 @@
+package tmpfssymlink
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/rancher/k3s/pkg/rootlesskit/common"
+	"github.com/rancher/k3s/pkg/rootlesskit/copyup"
+)
+
+func NewChildDriver() copyup.ChildDriver {
+	return &childDriver{}
+}
+
+type childDriver struct {
+}
+
+func (d *childDriver) CopyUp(dirs []string) ([]string, error) {
+	// we create bind0 outside of StateDir so as to allow
+	// copying up /run with stateDir=/run/user/1001/rootlesskit/default.
+	bind0, err := ioutil.TempDir("/tmp", "rootlesskit-b")
+	if err != nil {
+		return nil, errors.Wrap(err, "creating bind0 directory under /tmp")
+	}
+	defer os.RemoveAll(bind0)
+	var copied []string
+	for _, d := range dirs {
+		d := filepath.Clean(d)
+		if d == "/tmp" {
+			// TODO: we can support copy-up /tmp by changing bind0TempDir
+			return copied, errors.New("/tmp cannot be copied up")
+		}
+		st, err := os.Stat(d)
+		if err != nil {
+			return copied, errors.Wrapf(err, "stat %s", d)
+		}
+		cmds := [][]string{
+			// TODO: read-only bind (does not work well for /run)
+			{"mount", "--rbind", d, bind0},
+			{"mount", "-n", "-t", "tmpfs", "none", d},
+		}
+		if err := common.Execs(os.Stderr, os.Environ(), cmds); err != nil {
+			return copied, errors.Wrapf(err, "executing %v", cmds)
+		}
+		// tmpfs is created with mode 1777; restore the mode of the original directory
+		if err := os.Chmod(d, st.Mode()&(os.ModePerm|os.ModeSticky|os.ModeSetuid|os.ModeSetgid)); err != nil {
+			return copied, errors.Wrapf(err, "chmod %s", d)
+		}
+		bind1, err := ioutil.TempDir(d, ".ro")
+		if err != nil {
+			return copied, errors.Wrapf(err, "creating a directory under %s", d)
+		}
+		cmds = [][]string{
+			{"mount", "-n", "--move", bind0, bind1},
+		}
+		if err := common.Execs(os.Stderr, os.Environ(), cmds); err != nil {
+			return copied, errors.Wrapf(err, "executing %v", cmds)
+		}
+		files, err := ioutil.ReadDir(bind1)
+		if err != nil {
+			return copied, errors.Wrapf(err, "reading dir %s", bind1)
+		}
+		for _, f := range files {
+			fFull := filepath.Join(bind1, f.Name())
+			if f.Mode()&(os.ModeDevice|os.ModeSocket|os.ModeNamedPipe) != 0 {
+				logrus.Warnf("skipping copy-up of special file %s", filepath.Join(d, f.Name()))
+				continue
+			}
+			var symlinkSrc string
+			// symlinks are reproduced with the original (possibly relative) target,
+			// not dereferenced, so that e.g. the systemd-resolved resolv.conf link is kept intact.
+			if f.Mode()&os.ModeSymlink != 0 {
+				symlinkSrc, err = os.Readlink(fFull)
+				if err != nil {
+					return copied, errors.Wrapf(err, "reading symlink %s", fFull)
+				}
+			} else {
+				symlinkSrc = filepath.Join(filepath.Base(bind1), f.Name())
+			}
+			symlinkDst := filepath.Join(d, f.Name())
+			// `mount` may create extra `/etc/mtab` after mounting empty tmpfs on /etc
+			// https://github.com/rootless-containers/rootlesskit/issues/45
+			if err = os.RemoveAll(symlinkDst); err != nil {
+				return copied, errors.Wrapf(err, "removing %s", symlinkDst)
+			}
+			if err := os.Symlink(symlinkSrc, symlinkDst); err != nil {
+				return copied, errors.Wrapf(err, "symlinking %s to %s", symlinkSrc, symlinkDst)
+			}
+		}
+		copied = append(copied, d)
+	}
+	return copied, nil
+}
+
+// CopyUpFiles replaces each file with a bind-mounted writable copy on tmpfs.
+// Note that the copied-up files cannot be removed or renamed over.
+func (d *childDriver) CopyUpFiles(files []string) ([]string, error) {
+	if len(files) == 0 {
+		return nil, nil
+	}
+	staging, err := ioutil.TempDir("/tmp", "rootlesskit-f")
+	if err != nil {
+		return nil, errors.Wrap(err, "creating staging directory under /tmp")
+	}
+	defer os.RemoveAll(staging)
+	cmds := [][]string{{"mount", "-n", "-t", "tmpfs", "none", staging}}
+	if err := common.Execs(os.Stderr, os.Environ(), cmds); err != nil {
+		return nil, errors.Wrapf(err, "executing %v", cmds)
+	}
+	// the bind mounts keep the tmpfs alive after detaching it from the staging directory
+	defer common.Execs(os.Stderr, os.Environ(), [][]string{{"umount", "-n", "-l", staging}})
+	var copied []string
+	for i, f := range files {
+		f := filepath.Clean(f)
+		st, err := os.Stat(f)
+		if err != nil {
+			return copied, errors.Wrapf(err, "stat %s", f)
+		}
+		if !st.Mode().IsRegular() {
+			return copied, errors.Errorf("%s is not a regular file", f)
+		}
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			return copied, errors.Wrapf(err, "reading %s", f)
+		}
+		cp := filepath.Join(staging, strconv.Itoa(i))
+		if err := ioutil.WriteFile(cp, b, st.Mode().Perm()); err != nil {
+			return copied, errors.Wrapf(err, "writing %s", cp)
+		}
+		cmds := [][]string{{"mount", "-n", "--bind", cp, f}}
+		if err := common.Execs(os.Stderr, os.Environ(), cmds); err != nil {
+			return copied, errors.Wrapf(err, "executing %v", cmds)
+		}
+		copied = append(copied, f)
+	}
+	return copied, nil
+}
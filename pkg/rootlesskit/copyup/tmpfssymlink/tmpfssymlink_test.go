@@ -0,0 +1,115 @@
+package tmpfssymlink
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+const usernsEnv = "ROOTLESSKIT_TEST_USERNS"
+
+// runInUserns reruns the current test in new user and mount namespaces.
+// It returns true when the caller is already running in the namespaces.
+func runInUserns(t *testing.T) bool {
+	if os.Getenv(usernsEnv) == "1" {
+		if err := syscall.Mount("none", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+			t.Fatal(err)
+		}
+		return true
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^"+t.Name()+"$", "-test.v")
+	cmd.Env = append(os.Environ(), usernsEnv+"=1")
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags:  syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS,
+		UidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}},
+		GidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}},
+	}
+	var out strings.Builder
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Start(); err != nil {
+		t.Skipf("user namespaces are unavailable: %v", err)
+	}
+	err := cmd.Wait()
+	t.Log(out.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return false
+}
+
+func TestCopyUp(t *testing.T) {
+	if !runInUserns(t) {
+		return
+	}
+	d, err := ioutil.TempDir("", "tmpfssymlink-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	if err := ioutil.WriteFile(filepath.Join(d, "file"), []byte("foo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(d, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, target := range map[string]string{
+		"relative": "../run/systemd/resolve/stub-resolv.conf",
+		"absolute": "/run/systemd/resolve/stub-resolv.conf",
+		"sibling":  "file",
+	} {
+		if err := os.Symlink(target, filepath.Join(d, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	copied, err := NewChildDriver().CopyUp([]string{d})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(copied) != 1 || copied[0] != d {
+		t.Fatalf("expected %v to be copied up, got %v", d, copied)
+	}
+	testCases := []struct {
+		name   string
+		ro     bool   // linked into the .ro directory
+		target string // kept as is
+	}{
+		{name: "file", ro: true},
+		{name: "dir", ro: true},
+		{name: "relative", target: "../run/systemd/resolve/stub-resolv.conf"},
+		{name: "absolute", target: "/run/systemd/resolve/stub-resolv.conf"},
+		{name: "sibling", target: "file"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := os.Readlink(filepath.Join(d, tc.name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.ro {
+				if filepath.Base(got) != tc.name || !strings.HasPrefix(filepath.Dir(got), ".ro") {
+					t.Fatalf("expected %s to link into the .ro directory, got %q", tc.name, got)
+				}
+				return
+			}
+			if got != tc.target {
+				t.Fatalf("expected %s to keep the target %q, got %q", tc.name, tc.target, got)
+			}
+		})
+	}
+	b, err := ioutil.ReadFile(filepath.Join(d, "sibling"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "foo" {
+		t.Fatalf("expected %q through the sibling link, got %q", "foo", string(b))
+	}
+	if err := ioutil.WriteFile(filepath.Join(d, "new"), []byte("bar"), 0644); err != nil {
+		t.Fatalf("expected the copied-up directory to be writable: %v", err)
+	}
+}
@@ -0,0 +1,59 @@
+// Package metrics provides the hook for observing the setup of the namespaces and the port forwarding.
+package metrics
+
+import (
+	"time"
+)
+
+// Phases
+const (
+	PhaseCopyUp = "copy-up"
+	PhaseSysfs  = "sysfs"
+	PhaseTap    = "tap"
+	PhasePort   = "port"
+)
+
+// Counters
+const (
+	// CounterSysfsReadOnly is incremented when sysfs was mounted read-only as a fallback.
+	CounterSysfsReadOnly = "sysfs-readonly-fallback"
+	// CounterProcfsReadOnly is incremented when procfs was mounted read-only as a fallback.
+	CounterProcfsReadOnly = "procfs-readonly-fallback"
+	// CounterPortConnRejected is incremented when a forwarded connection was rejected due to port.Spec.MaxConnections.
+	CounterPortConnRejected = "port-conn-rejected"
+	// CounterPortConnIdleClosed is incremented when a forwarded connection was closed due to port.Spec.IdleTimeout.
+	CounterPortConnIdleClosed = "port-conn-idle-closed"
+)
+
+// Metrics MUST be thread-safe.
+type Metrics interface {
+	ObserveDuration(phase string, d time.Duration)
+	Inc(counter string)
+}
+
+// NewNoop returns Metrics that does nothing.
+func NewNoop() Metrics {
+	return noop{}
+}
+
+type noop struct{}
+
+func (noop) ObserveDuration(string, time.Duration) {}
+
+func (noop) Inc(string) {}
+
+// Observe calls m.ObserveDuration with the duration since start.
+// m can be nil.
+func Observe(m Metrics, phase string, start time.Time) {
+	if m != nil {
+		m.ObserveDuration(phase, time.Since(start))
+	}
+}
+
+// Inc calls m.Inc.
+// m can be nil.
+func Inc(m Metrics, counter string) {
+	if m != nil {
+		m.Inc(counter)
+	}
+}
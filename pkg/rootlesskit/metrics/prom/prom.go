@@ -0,0 +1,45 @@
+// Package prom provides the Prometheus adapter for metrics.Metrics.
+package prom
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/rancher/k3s/pkg/rootlesskit/metrics"
+)
+
+// New creates Metrics and registers the collectors to reg.
+func New(reg prometheus.Registerer) (metrics.Metrics, error) {
+	m := &promMetrics{
+		durations: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "rootlesskit",
+			Name:      "setup_phase_duration_seconds",
+			Help:      "Duration of the setup phases of the namespaces.",
+		}, []string{"phase"}),
+		counters: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "rootlesskit",
+			Name:      "setup_events_total",
+			Help:      "Number of the notable events during the setup of the namespaces, such as the read-only sysfs fallback.",
+		}, []string{"event"}),
+	}
+	for _, c := range []prometheus.Collector{m.durations, m.counters} {
+		if err := reg.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+type promMetrics struct {
+	durations *prometheus.HistogramVec
+	counters  *prometheus.CounterVec
+}
+
+func (m *promMetrics) ObserveDuration(phase string, d time.Duration) {
+	m.durations.WithLabelValues(phase).Observe(d.Seconds())
+}
+
+func (m *promMetrics) Inc(counter string) {
+	m.counters.WithLabelValues(counter).Inc()
+}
@@ -0,0 +1,78 @@
+// Package msgutil provides utility for JSON message with uint32be header
+package msgutil
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// MaxMessageSize is the maximum length of the JSON payload, excluding the header,
+// for MarshalToWriter and UnmarshalFromReader.
+const MaxMessageSize = 1 << 16
+
+func MarshalToWriter(w io.Writer, x interface{}) (int, error) {
+	return MarshalToWriterWithLimit(w, x, MaxMessageSize)
+}
+
+// MarshalToWriterWithLimit is akin to MarshalToWriter, but rejects the payload larger than limit.
+func MarshalToWriterWithLimit(w io.Writer, x interface{}, limit int) (int, error) {
+	b, err := json.Marshal(x)
+	if err != nil {
+		return 0, err
+	}
+	if len(b) > limit {
+		return 0, errors.Errorf("bad message length: %d (max: %d)", len(b), limit)
+	}
+	h := make([]byte, 4)
+	binary.BigEndian.PutUint32(h, uint32(len(b)))
+	return w.Write(append(h, b...))
+}
+
+func UnmarshalFromReader(r io.Reader, x interface{}) (int, error) {
+	return UnmarshalFromReaderWithLimit(r, x, MaxMessageSize)
+}
+
+// UnmarshalFromReaderWithLimit is akin to UnmarshalFromReader, but rejects the payload larger than limit,
+// without allocating the buffer. limit needs to be consistent with the writer.
+func UnmarshalFromReaderWithLimit(r io.Reader, x interface{}, limit int) (int, error) {
+	hdr := make([]byte, 4)
+	n, err := io.ReadFull(r, hdr)
+	if err == io.ErrUnexpectedEOF {
+		return n, errors.Errorf("truncated header: read %d bytes, expected 4 bytes", n)
+	}
+	if err != nil {
+		return n, err
+	}
+	bLen := binary.BigEndian.Uint32(hdr)
+	// zero-length payload is never written by MarshalToWriter
+	if int64(bLen) > int64(limit) || bLen < 1 {
+		return n, errors.Errorf("bad message length: %d (max: %d)", bLen, limit)
+	}
+	b := make([]byte, bLen)
+	n, err = io.ReadFull(r, b)
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		return 4 + n, errors.Errorf("truncated message: read %d bytes, expected %d bytes", n, bLen)
+	}
+	if err != nil {
+		return 4 + n, err
+	}
+	return 4 + n, json.Unmarshal(b, x)
+}
+
+func Marshal(x interface{}) ([]byte, error) {
+	var b bytes.Buffer
+	_, err := MarshalToWriter(&b, x)
+	return b.Bytes(), err
+}
+
+func Unmarshal(b []byte, x interface{}) error {
+	n, err := UnmarshalFromReader(bytes.NewReader(b), x)
+	if n != len(b) {
+		return errors.Errorf("read %d bytes, expected %d bytes", n, len(b))
+	}
+	return err
+}
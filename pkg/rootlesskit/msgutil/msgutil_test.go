@@ -0,0 +1,176 @@
+package msgutil
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+type testMessage struct {
+	Stage int
+	Data  string
+}
+
+func header(n uint32) []byte {
+	h := make([]byte, 4)
+	binary.BigEndian.PutUint32(h, n)
+	return h
+}
+
+func TestMarshalUnmarshal(t *testing.T) {
+	b, err := Marshal(testMessage{Stage: 1, Data: "foo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := binary.BigEndian.Uint32(b); int(got) != len(b)-4 {
+		t.Fatalf("expected big-endian length %d, got %d", len(b)-4, got)
+	}
+	var m testMessage
+	if err := Unmarshal(b, &m); err != nil {
+		t.Fatal(err)
+	}
+	if m.Stage != 1 || m.Data != "foo" {
+		t.Fatalf("unexpected message: %+v", m)
+	}
+}
+
+func TestUnmarshalFromReader(t *testing.T) {
+	payload := []byte(`{"Stage":1}`)
+	testCases := []struct {
+		name   string
+		input  []byte
+		errSub string
+	}{
+		{
+			name:   "empty",
+			input:  nil,
+			errSub: io.EOF.Error(),
+		},
+		{
+			name:   "truncated header",
+			input:  []byte{0, 0},
+			errSub: "truncated header",
+		},
+		{
+			name:   "zero-length payload",
+			input:  header(0),
+			errSub: "bad message length: 0",
+		},
+		{
+			name:   "oversized payload",
+			input:  header(MaxMessageSize + 1),
+			errSub: "bad message length",
+		},
+		{
+			name:   "truncated payload",
+			input:  append(header(uint32(len(payload))), payload[:3]...),
+			errSub: "truncated message: read 3 bytes",
+		},
+		{
+			name:   "header without payload",
+			input:  header(uint32(len(payload))),
+			errSub: "truncated message: read 0 bytes",
+		},
+		{
+			name:  "valid",
+			input: append(header(uint32(len(payload))), payload...),
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var m testMessage
+			_, err := UnmarshalFromReader(bytes.NewReader(tc.input), &m)
+			if tc.errSub == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.errSub) {
+				t.Fatalf("expected error containing %q, got %v", tc.errSub, err)
+			}
+		})
+	}
+}
+
+func TestWithLimit(t *testing.T) {
+	var b bytes.Buffer
+	if _, err := MarshalToWriterWithLimit(&b, testMessage{Data: strings.Repeat("x", 100)}, 10); err == nil {
+		t.Fatal("expected an error for the payload larger than the limit")
+	}
+	if _, err := MarshalToWriter(&b, testMessage{Data: strings.Repeat("x", 100)}); err != nil {
+		t.Fatal(err)
+	}
+	var m testMessage
+	if _, err := UnmarshalFromReaderWithLimit(bytes.NewReader(b.Bytes()), &m, 10); err == nil {
+		t.Fatal("expected an error for the payload larger than the limit")
+	}
+}
+
+// messageOfSize returns testMessage with the JSON payload of n bytes.
+func messageOfSize(t *testing.T, n int) testMessage {
+	b, err := json.Marshal(testMessage{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testMessage{Data: strings.Repeat("x", n-len(b))}
+}
+
+func TestPipe(t *testing.T) {
+	w, r := net.Pipe()
+	defer w.Close()
+	defer r.Close()
+	msgs := []testMessage{{Stage: 1, Data: "foo"}, {Stage: 2}, messageOfSize(t, MaxMessageSize)}
+	oversized := messageOfSize(t, MaxMessageSize+1)
+	errCh := make(chan error, 1)
+	go func() {
+		for _, m := range msgs {
+			if _, err := MarshalToWriter(w, m); err != nil {
+				errCh <- err
+				return
+			}
+		}
+		// rejected without writing to the pipe, which would block
+		if _, err := MarshalToWriter(w, oversized); err == nil {
+			errCh <- errors.New("expected MarshalToWriter to reject the oversized payload")
+			return
+		}
+		// the reader rejects the payload after reading the header, and closes the pipe
+		if _, err := MarshalToWriterWithLimit(w, oversized, MaxMessageSize+1); err == nil {
+			errCh <- errors.New("expected the write to the closed pipe to fail")
+			return
+		}
+		errCh <- nil
+	}()
+	for i, expected := range msgs {
+		var m testMessage
+		n, err := UnmarshalFromReader(r, &m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := json.Marshal(expected)
+		if n != 4+len(b) {
+			t.Fatalf("message %d: expected %d bytes, got %d", i, 4+len(b), n)
+		}
+		if m != expected {
+			t.Fatalf("message %d: expected %+v, got %+v", i, expected, m)
+		}
+	}
+	var m testMessage
+	n, err := UnmarshalFromReader(r, &m)
+	if err == nil || !strings.Contains(err.Error(), "bad message length") {
+		t.Fatalf("expected an error for the payload larger than MaxMessageSize, got %v", err)
+	}
+	if n != 4 {
+		t.Fatalf("expected only the header to be read, got %d bytes", n)
+	}
+	r.Close()
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+}
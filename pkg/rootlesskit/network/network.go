@@ -0,0 +1,87 @@
+package network
+
+import (
+	"os"
+	"strings"
+	"unicode"
+
+	"github.com/pkg/errors"
+
+	"github.com/rancher/k3s/pkg/rootlesskit/common"
+)
+
+// ParentDriver is called from the parent namespace
+type ParentDriver interface {
+	// MTU returns MTU
+	MTU() int
+	// ConfigureNetwork sets up Slirp, updates msg, and returns destructor function.
+	ConfigureNetwork(childPID int, stateDir string) (netmsg *common.NetworkMessage, cleanup func() error, err error)
+}
+
+// ChildDriver is called from the child namespace
+type ChildDriver interface {
+	ConfigureTap(netmsg common.NetworkMessage) (tap string, err error)
+}
+
+// ValidateInterfaceName validates a network interface name, as the kernel does.
+func ValidateInterfaceName(name string) error {
+	// IFNAMSIZ (16) includes the NUL terminator
+	if name == "" || len(name) > 15 {
+		return errors.Errorf("invalid interface name %q: needs to be 1-15 characters", name)
+	}
+	if name == "." || name == ".." {
+		return errors.Errorf("invalid interface name %q", name)
+	}
+	if strings.IndexFunc(name, func(r rune) bool {
+		return r == '/' || r == ':' || unicode.IsSpace(r) || r > unicode.MaxASCII || !unicode.IsPrint(r)
+	}) >= 0 {
+		return errors.Errorf("invalid interface name %q: contains an invalid character", name)
+	}
+	return nil
+}
+
+// DeviceMode is the kind of Device.
+type DeviceMode int
+
+const (
+	// DeviceModeTap is a kernel tap device, configured by the child with netlink or `ip`.
+	DeviceModeTap DeviceMode = iota
+	// DeviceModePacketSocket is a socket carrying the packets to a userspace network stack,
+	// which configures the network by itself. The child does not configure the addresses and the routes.
+	DeviceModePacketSocket
+)
+
+func (m DeviceMode) String() string {
+	switch m {
+	case DeviceModeTap:
+		return "tap"
+	case DeviceModePacketSocket:
+		return "packet-socket"
+	default:
+		return "unknown"
+	}
+}
+
+// Device is configured by DeviceChildDriver.
+type Device struct {
+	Mode DeviceMode
+	// Name is the name of the tap device for DeviceModeTap.
+	// For DeviceModePacketSocket, Name is only informative, and shown as the tap in the status.
+	Name string
+	// File is the packet socket for DeviceModePacketSocket, and nil for DeviceModeTap.
+	// File is owned by the child, and closed when the namespaces are torn down.
+	File *os.File
+}
+
+// DeviceChildDriver is optionally implemented by ChildDriver, for the devices other than kernel tap devices.
+// When implemented, ConfigureDevice is called instead of ConfigureTap and ConfigureInterfaceTap.
+type DeviceChildDriver interface {
+	// ConfigureDevice is called for netmsg.InterfaceMessage and each of netmsg.Interfaces.
+	ConfigureDevice(netmsg common.NetworkMessage, iface common.InterfaceMessage) (*Device, error)
+}
+
+// MultiChildDriver is optionally implemented by ChildDriver for NetworkMessage.Interfaces.
+type MultiChildDriver interface {
+	// ConfigureInterfaceTap is called for each of netmsg.Interfaces.
+	ConfigureInterfaceTap(netmsg common.NetworkMessage, iface common.InterfaceMessage) (tap string, err error)
+}
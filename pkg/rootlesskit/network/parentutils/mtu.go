@@ -0,0 +1,53 @@
+package parentutils
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultRouteInterface returns the name of the interface used for the IPv4 default route
+// in the current network namespace.
+func DefaultRouteInterface() (string, error) {
+	f, err := os.Open("/proc/net/route")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		// Iface Destination Gateway Flags ...
+		fields := strings.Fields(sc.Text())
+		if len(fields) >= 2 && fields[1] == "00000000" {
+			return fields[0], nil
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return "", errors.Wrap(err, "reading /proc/net/route")
+	}
+	return "", errors.New("no default route found")
+}
+
+// DefaultRouteMTU returns the MTU of the interface used for the IPv4 default route.
+// Network drivers can use this for populating a sensible default MTU.
+func DefaultRouteMTU() (int, error) {
+	iface, err := DefaultRouteInterface()
+	if err != nil {
+		return 0, err
+	}
+	p := filepath.Join("/sys/class/net", iface, "mtu")
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return 0, errors.Wrapf(err, "reading %s", p)
+	}
+	mtu, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return 0, errors.Wrapf(err, "unexpected content in %s", p)
+	}
+	return mtu, nil
+}
@@ -10,10 +10,10 @@ import (
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 
-	"github.com/rootless-containers/rootlesskit/pkg/common"
-	"github.com/rootless-containers/rootlesskit/pkg/network"
-	"github.com/rootless-containers/rootlesskit/pkg/network/iputils"
-	"github.com/rootless-containers/rootlesskit/pkg/network/parentutils"
+	"github.com/rancher/k3s/pkg/rootlesskit/common"
+	"github.com/rancher/k3s/pkg/rootlesskit/network"
+	"github.com/rancher/k3s/pkg/rootlesskit/network/iputils"
+	"github.com/rancher/k3s/pkg/rootlesskit/network/parentutils"
 )
 
 // NewParentDriver instantiates new parent driver.
@@ -22,13 +22,22 @@ import (
 //
 // disableHostLoopback is supported only for slirp4netns v0.3.0+
 // apiSocketPath is supported only for slirp4netns v0.3.0+
-func NewParentDriver(binary string, mtu int, ipnet *net.IPNet, disableHostLoopback bool, apiSocketPath string) network.ParentDriver {
+// enableIPv6 is supported only for slirp4netns v0.4.0+
+//
+// tapName defaults to "tap0".
+func NewParentDriver(binary string, mtu int, ipnet *net.IPNet, disableHostLoopback bool, apiSocketPath string, enableIPv6 bool, tapName string) (network.ParentDriver, error) {
 	if binary == "" {
 		panic("got empty slirp4netns binary")
 	}
 	if mtu < 0 {
 		panic("got negative mtu")
 	}
+	if tapName == "" {
+		tapName = "tap0"
+	}
+	if err := network.ValidateInterfaceName(tapName); err != nil {
+		return nil, err
+	}
 	if mtu == 0 {
 		mtu = 65520
 	}
@@ -38,7 +47,9 @@ func NewParentDriver(binary string, mtu int, ipnet *net.IPNet, disableHostLoopba
 		ipnet:               ipnet,
 		disableHostLoopback: disableHostLoopback,
 		apiSocketPath:       apiSocketPath,
-	}
+		enableIPv6:          enableIPv6,
+		tapName:             tapName,
+	}, nil
 }
 
 const opaqueTap = "slirp4netns.tap"
@@ -49,6 +60,8 @@ type parentDriver struct {
 	ipnet               *net.IPNet
 	disableHostLoopback bool
 	apiSocketPath       string
+	enableIPv6          bool
+	tapName             string
 }
 
 func (d *parentDriver) MTU() int {
@@ -56,7 +69,7 @@ func (d *parentDriver) MTU() int {
 }
 
 func (d *parentDriver) ConfigureNetwork(childPID int, stateDir string) (*common.NetworkMessage, func() error, error) {
-	tap := "tap0"
+	tap := d.tapName
 	var cleanups []func() error
 	if err := parentutils.PrepareTap(childPID, tap); err != nil {
 		return nil, common.Seq(cleanups), errors.Wrapf(err, "setting up tap %s", tap)
@@ -72,6 +85,9 @@ func (d *parentDriver) ConfigureNetwork(childPID int, stateDir string) (*common.
 	if d.apiSocketPath != "" {
 		opts = append(opts, "--api-socket", d.apiSocketPath)
 	}
+	if d.enableIPv6 {
+		opts = append(opts, "--enable-ipv6")
+	}
 	cmd := exec.CommandContext(ctx, d.binary, append(opts, []string{strconv.Itoa(childPID), tap}...)...)
 	cmd.SysProcAttr = &syscall.SysProcAttr{
 		Pdeathsig: syscall.SIGKILL,
@@ -87,9 +103,12 @@ func (d *parentDriver) ConfigureNetwork(childPID int, stateDir string) (*common.
 		return nil, common.Seq(cleanups), errors.Wrapf(err, "executing %v", cmd)
 	}
 	netmsg := common.NetworkMessage{
-		MTU: d.mtu,
-		Opaque: map[string]string{
-			opaqueTap: tap,
+		InterfaceMessage: common.InterfaceMessage{
+			MTU:     d.mtu,
+			TapName: tap,
+			Opaque: map[string]string{
+				opaqueTap: tap,
+			},
 		},
 	}
 	if d.ipnet != nil {
@@ -116,6 +135,13 @@ func (d *parentDriver) ConfigureNetwork(childPID int, stateDir string) (*common.
 		netmsg.Gateway = "10.0.2.2"
 		netmsg.DNS = "10.0.2.3"
 	}
+	if d.enableIPv6 {
+		// slirp4netns does not support customizing the IPv6 prefix yet
+		netmsg.IPv6 = "fd00::100"
+		netmsg.IPv6Netmask = 64
+		netmsg.IPv6Gateway = "fd00::2"
+		netmsg.DNSServers = []string{netmsg.DNS, "fd00::3"}
+	}
 	return &netmsg, common.Seq(cleanups), nil
 }
 
@@ -127,7 +153,17 @@ type childDriver struct {
 }
 
 func (d *childDriver) ConfigureTap(netmsg common.NetworkMessage) (string, error) {
-	tap := netmsg.Opaque[opaqueTap]
+	return d.ConfigureInterfaceTap(netmsg, netmsg.InterfaceMessage)
+}
+
+// ConfigureInterfaceTap implements network.MultiChildDriver.
+// Note that the parent driver creates only a single interface.
+func (d *childDriver) ConfigureInterfaceTap(netmsg common.NetworkMessage, iface common.InterfaceMessage) (string, error) {
+	tap := iface.TapName
+	if tap == "" {
+		// parent drivers prior to TapName
+		tap = iface.Opaque[opaqueTap]
+	}
 	if tap == "" {
 		return "", errors.New("could not determine the preconfigured tap")
 	}
@@ -0,0 +1,127 @@
+package parent
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/rancher/k3s/pkg/rootlesskit/common"
+	"github.com/rancher/k3s/pkg/rootlesskit/msgutil"
+)
+
+// ControlClient sends ControlRequest to the child over the control socket.
+// ControlClient is safe for concurrent use.
+type ControlClient struct {
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// Request sends req and waits for the response.
+// ControlResponse.Error is returned as an error.
+func (c *ControlClient) Request(req common.ControlRequest) (*common.ControlResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := msgutil.MarshalToWriter(c.conn, &req); err != nil {
+		return nil, errors.Wrapf(err, "failed to send control request %q", req.Type)
+	}
+	var res common.ControlResponse
+	if _, err := msgutil.UnmarshalFromReader(c.conn, &res); err != nil {
+		return nil, errors.Wrapf(err, "failed to read the response of control request %q", req.Type)
+	}
+	if res.Error != "" {
+		return &res, errors.Errorf("control request %q failed: %s", req.Type, res.Error)
+	}
+	return &res, nil
+}
+
+// UpdateDNS replaces the nameservers in /etc/resolv.conf of the child.
+func (c *ControlClient) UpdateDNS(servers []string) error {
+	_, err := c.Request(common.ControlRequest{
+		Type:       common.ControlRequestDNS,
+		DNSServers: servers,
+	})
+	return err
+}
+
+// Status returns the JSON of the status of the child.
+func (c *ControlClient) Status() (json.RawMessage, error) {
+	res, err := c.Request(common.ControlRequest{
+		Type: common.ControlRequestStatus,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res.Status, nil
+}
+
+func listenControl(socketPath string) (net.Listener, error) {
+	if err := os.RemoveAll(socketPath); err != nil {
+		return nil, err
+	}
+	return net.Listen("unix", socketPath)
+}
+
+// acceptControl accepts the connection from the child, and calls fn with the client.
+// The connections from the other processes are rejected, see checkPeerCred.
+// l is closed after accepting the connection.
+// The connection is closed when done is closed.
+func acceptControl(l net.Listener, childPID int, fn func(*ControlClient), done <-chan struct{}) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			l.Close()
+			select {
+			case <-done:
+			default:
+				logrus.WithError(err).Warn("failed to accept the control connection from the child")
+			}
+			return
+		}
+		if err := checkPeerCred(conn, childPID); err != nil {
+			logrus.WithError(err).Warn("rejecting the control connection")
+			conn.Close()
+			continue
+		}
+		l.Close()
+		go func() {
+			<-done
+			conn.Close()
+		}()
+		fn(&ControlClient{conn: conn})
+		return
+	}
+}
+
+// checkPeerCred checks with SO_PEERCRED that the peer of conn is the process pid, running as the current user.
+// The child keeps the PID across the re-exec, and its root is mapped to the current user.
+func checkPeerCred(conn net.Conn, pid int) error {
+	uconn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return errors.Errorf("unexpected connection type %T", conn)
+	}
+	raw, err := uconn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var (
+		cred    *syscall.Ucred
+		credErr error
+	)
+	if err := raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil {
+		return err
+	}
+	if credErr != nil {
+		return errors.Wrap(credErr, "failed to get SO_PEERCRED")
+	}
+	if int(cred.Pid) != pid || int(cred.Uid) != os.Geteuid() {
+		return errors.Errorf("expected the peer PID %d UID %d, got PID %d UID %d", pid, os.Geteuid(), cred.Pid, cred.Uid)
+	}
+	return nil
+}
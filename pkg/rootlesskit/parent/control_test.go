@@ -0,0 +1,109 @@
+package parent
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func listenControlTest(t *testing.T) (net.Listener, string, func()) {
+	dir, err := ioutil.TempDir("", "control-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(dir, StateFileControlSock)
+	l, err := listenControl(p)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return l, p, func() {
+		l.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestCheckPeerCred(t *testing.T) {
+	testCases := []struct {
+		name    string
+		pid     int
+		wantErr bool
+	}{
+		{name: "self", pid: os.Getpid()},
+		{name: "other", pid: 1, wantErr: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			l, p, cleanup := listenControlTest(t)
+			defer cleanup()
+			client, err := net.Dial("unix", p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			conn, err := l.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			err = checkPeerCred(conn, tc.pid)
+			if tc.wantErr != (err != nil) {
+				t.Fatalf("expected error: %v, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestAcceptControl(t *testing.T) {
+	t.Run("child", func(t *testing.T) {
+		l, p, cleanup := listenControlTest(t)
+		defer cleanup()
+		done := make(chan struct{})
+		defer close(done)
+		connected := make(chan *ControlClient, 1)
+		go acceptControl(l, os.Getpid(), func(c *ControlClient) { connected <- c }, done)
+		client, err := net.Dial("unix", p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		select {
+		case <-connected:
+		case <-time.After(10 * time.Second):
+			t.Fatal("the connection from the child was not accepted")
+		}
+	})
+	t.Run("other process", func(t *testing.T) {
+		l, p, cleanup := listenControlTest(t)
+		defer cleanup()
+		child := exec.Command("sleep", "60")
+		if err := child.Start(); err != nil {
+			t.Skip(err)
+		}
+		defer child.Wait()
+		defer child.Process.Kill()
+		done := make(chan struct{})
+		defer close(done)
+		connected := make(chan *ControlClient, 1)
+		go acceptControl(l, child.Process.Pid, func(c *ControlClient) { connected <- c }, done)
+		client, err := net.Dial("unix", p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		client.SetReadDeadline(time.Now().Add(10 * time.Second))
+		if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatalf("expected the connection to be closed, got %v", err)
+		}
+		select {
+		case <-connected:
+			t.Fatal("the connection from the other process was accepted")
+		default:
+		}
+	})
+}
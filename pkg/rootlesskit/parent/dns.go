@@ -0,0 +1,156 @@
+package parent
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/rancher/k3s/pkg/rootlesskit/common"
+)
+
+// DNS modes for Opt.DNSMode.
+const (
+	// DNSModeExplicit uses the nameservers configured by the network driver, e.g. 10.0.2.3 of slirp4netns.
+	// The queries are resolved by the network driver, which may not follow the changes of the host resolver.
+	DNSModeExplicit = "explicit"
+	// DNSModeHostResolvCopy copies the nameservers, the search domains, and the options of the host.
+	// When the host uses the systemd-resolved stub, the upstreams are copied from /run/systemd/resolve/resolv.conf.
+	// The copy is taken on startup, and the loopback nameservers of the host are unreachable from the namespace.
+	DNSModeHostResolvCopy = "host-resolv-copy"
+	// DNSModeStubBridge runs a forwarder on 127.0.0.53 in the namespace, which sends the queries to the nameservers
+	// of the host over a UDP socket created in the network namespace of the parent.
+	// Works with the loopback nameservers of the host, such as the systemd-resolved stub,
+	// but the queries received over TCP are also forwarded over UDP, so the truncated responses cannot be retried over TCP.
+	// The DNS updates are not supported.
+	DNSModeStubBridge = "stub-bridge"
+)
+
+// systemdResolvConf is the resolv.conf of systemd-resolved with the upstream nameservers.
+const systemdResolvConf = "/run/systemd/resolve/resolv.conf"
+
+func validateDNSMode(opt Opt) error {
+	switch opt.DNSMode {
+	case "", DNSModeExplicit:
+		return nil
+	case DNSModeHostResolvCopy, DNSModeStubBridge:
+		if opt.NetworkDriver == nil {
+			return errors.Errorf("DNS mode %q cannot be used for HostNetwork", opt.DNSMode)
+		}
+		if opt.ResolvConfPath != "" {
+			return errors.Errorf("DNS mode %q cannot be used with ResolvConfPath", opt.DNSMode)
+		}
+		return nil
+	default:
+		return errors.Errorf("unknown DNS mode %q (valid: %s, %s, %s)", opt.DNSMode,
+			DNSModeExplicit, DNSModeHostResolvCopy, DNSModeStubBridge)
+	}
+}
+
+// hostResolvConf is the parsed resolv.conf of the host.
+type hostResolvConf struct {
+	nameservers   []string
+	searchDomains []string
+	options       []string
+}
+
+func parseResolvConf(b []byte) hostResolvConf {
+	var c hostResolvConf
+	for _, line := range strings.Split(string(b), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "nameserver":
+			c.nameservers = append(c.nameservers, fields[1])
+		case "search", "domain":
+			// the last one wins, as in glibc
+			c.searchDomains = fields[1:]
+		case "options":
+			c.options = append(c.options, fields[1:]...)
+		}
+	}
+	return c
+}
+
+// readHostResolvConf reads /etc/resolv.conf.
+// When upstream is true and all the nameservers are loopback addresses, systemdResolvConf is read instead if it exists.
+func readHostResolvConf(upstream bool) (hostResolvConf, error) {
+	b, err := ioutil.ReadFile("/etc/resolv.conf")
+	if err != nil {
+		return hostResolvConf{}, errors.Wrap(err, "reading /etc/resolv.conf")
+	}
+	c := parseResolvConf(b)
+	if !upstream || !allLoopback(c.nameservers) {
+		return c, nil
+	}
+	b, err = ioutil.ReadFile(systemdResolvConf)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logrus.WithError(err).Warnf("failed to read %s", systemdResolvConf)
+		}
+		return c, nil
+	}
+	logrus.Debugf("/etc/resolv.conf has only loopback nameservers, using %s", systemdResolvConf)
+	return parseResolvConf(b), nil
+}
+
+func allLoopback(nameservers []string) bool {
+	for _, ns := range nameservers {
+		ip := net.ParseIP(strings.SplitN(ns, "%", 2)[0])
+		if ip == nil || !ip.IsLoopback() {
+			return false
+		}
+	}
+	return len(nameservers) != 0
+}
+
+// listenDNSBridge creates the UDP socket for DNSModeStubBridge, to be passed to the child.
+func listenDNSBridge() (*os.File, error) {
+	l, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		return nil, errors.Wrap(err, "creating the UDP socket for the DNS bridge")
+	}
+	defer l.Close()
+	return l.File()
+}
+
+// applyDNSMode updates netmsg for mode.
+// bridgeFD is the fd number of the socket created by listenDNSBridge in the child, for DNSModeStubBridge.
+func applyDNSMode(netmsg *common.NetworkMessage, mode string, bridgeFD int) error {
+	switch mode {
+	case DNSModeHostResolvCopy:
+		c, err := readHostResolvConf(true)
+		if err != nil {
+			return err
+		}
+		if len(c.nameservers) == 0 {
+			return errors.New("no nameserver found in the resolv.conf of the host")
+		}
+		if allLoopback(c.nameservers) {
+			logrus.Warnf("the nameservers %v of the host are unreachable from the namespace; consider DNS mode %q",
+				c.nameservers, DNSModeStubBridge)
+		}
+		netmsg.DNS = ""
+		netmsg.DNSServers = c.nameservers
+		netmsg.SearchDomains = c.searchDomains
+		netmsg.ResolvOptions = c.options
+	case DNSModeStubBridge:
+		c, err := readHostResolvConf(false)
+		if err != nil {
+			return err
+		}
+		if len(c.nameservers) == 0 {
+			return errors.New("no nameserver found in the resolv.conf of the host")
+		}
+		netmsg.DNSBridgeFD = bridgeFD
+		netmsg.DNSBridgeUpstreams = c.nameservers
+		netmsg.SearchDomains = c.searchDomains
+		netmsg.ResolvOptions = c.options
+	}
+	return nil
+}
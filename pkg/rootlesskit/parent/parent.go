@@ -0,0 +1,498 @@
+package parent
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/docker/docker/pkg/idtools"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/theckman/go-flock"
+
+	"github.com/rancher/k3s/pkg/rootlesskit/api/router"
+	"github.com/rancher/k3s/pkg/rootlesskit/common"
+	"github.com/rancher/k3s/pkg/rootlesskit/metrics"
+	"github.com/rancher/k3s/pkg/rootlesskit/msgutil"
+	"github.com/rancher/k3s/pkg/rootlesskit/network"
+	"github.com/rancher/k3s/pkg/rootlesskit/port"
+)
+
+type Opt struct {
+	PipeFDEnvKey   string               // needs to be set
+	StateDir       string               // directory needs to be precreated
+	StateDirEnvKey string               // optional env key to propagate StateDir value
+	NetworkDriver  network.ParentDriver // nil for HostNetwork
+	PortDriver     port.ParentDriver    // nil for --port-driver=none
+	ExtraHosts     []string             // optional "host ip" entries to be appended to /etc/hosts
+	Metrics        metrics.Metrics      // optional, observes the duration of the port driver setup
+	Hostname       string               // optional, creates a UTS namespace with the hostname
+	DNSUpdates     <-chan []string      // optional, pushes the updated DNS servers to the running child
+	ResolvConfPath string               // optional, mounted on /etc/resolv.conf verbatim
+	CreatePIDNS    bool                 // optional, creates a PID namespace, in which the child is PID 1
+	OOMScoreAdj    *int                 // optional, oom_score_adj of the child (-1000..1000), inherited by the target command
+	// OnControlConnected is optional. When set, the parent listens on StateFileControlSock,
+	// and calls OnControlConnected after the child connects back to it.
+	OnControlConnected func(*ControlClient)
+	// OnTargetStarted is optional, and called after the child starts the target command.
+	// pid is the PID of the target command on the host, or 0 if unknown.
+	// namespaces are the inode numbers of the namespaces of the target command, keyed by the names in /proc/PID/ns.
+	OnTargetStarted func(pid int, namespaces map[string]uint64)
+	// DNSMode is one of DNSModeExplicit (default), DNSModeHostResolvCopy, and DNSModeStubBridge.
+	DNSMode string
+}
+
+// Documented state files. Undocumented ones are subject to change.
+const (
+	StateFileLock     = "lock"
+	StateFileChildPID = "child_pid" // decimal pid number text
+	StateFileAPISock  = "api.sock"  // REST API Socket
+	// StateFileControlSock is the socket for ControlRequest, accepting only the connection from the child.
+	StateFileControlSock = "control.sock"
+)
+
+func Parent(opt Opt) error {
+	if opt.PipeFDEnvKey == "" {
+		return errors.New("pipe FD env key is not set")
+	}
+	if opt.StateDir == "" {
+		return errors.New("state dir is not set")
+	}
+	if !filepath.IsAbs(opt.StateDir) {
+		return errors.New("state dir must be absolute")
+	}
+	if stat, err := os.Stat(opt.StateDir); err != nil || !stat.IsDir() {
+		return errors.Wrap(err, "state dir is inaccessible")
+	}
+	if opt.OOMScoreAdj != nil && (*opt.OOMScoreAdj < -1000 || *opt.OOMScoreAdj > 1000) {
+		return errors.Errorf("invalid OOMScoreAdj %d: needs to be in [-1000, 1000]", *opt.OOMScoreAdj)
+	}
+	if err := validateDNSMode(opt); err != nil {
+		return err
+	}
+	lockPath := filepath.Join(opt.StateDir, StateFileLock)
+	lock := flock.NewFlock(lockPath)
+	locked, err := lock.TryLock()
+	if err != nil {
+		return errors.Wrapf(err, "failed to lock %s", lockPath)
+	}
+	if !locked {
+		return errors.Errorf("failed to lock %s, another RootlessKit is running with the same state directory?", lockPath)
+	}
+	defer os.RemoveAll(opt.StateDir)
+	defer lock.Unlock()
+	// when the previous execution crashed, the state dir may not be removed successfully.
+	// explicitly remove everything in the state dir except the lock file here.
+	for _, f := range []string{StateFileChildPID} {
+		p := filepath.Join(opt.StateDir, f)
+		if err := os.RemoveAll(p); err != nil {
+			return errors.Wrapf(err, "failed to remove %s", p)
+		}
+	}
+
+	// the child sends Message 2 back over the socketpair
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return errors.Wrap(err, "failed to create a socketpair")
+	}
+	pipe, childPipe := os.NewFile(uintptr(fds[0]), "parent"), os.NewFile(uintptr(fds[1]), "child")
+	defer pipe.Close()
+	cmd := exec.Command("/proc/self/exe", os.Args[1:]...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Pdeathsig:    syscall.SIGKILL,
+		Cloneflags:   syscall.CLONE_NEWUSER,
+		Unshareflags: syscall.CLONE_NEWNS,
+	}
+	if opt.NetworkDriver != nil {
+		cmd.SysProcAttr.Unshareflags |= syscall.CLONE_NEWNET
+	}
+	if opt.Hostname != "" {
+		cmd.SysProcAttr.Unshareflags |= syscall.CLONE_NEWUTS
+	}
+	if opt.CreatePIDNS {
+		// CLONE_NEWPID affects the children of the caller, not the caller itself, so it cannot be in Unshareflags
+		cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWPID
+	}
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{childPipe}
+	cmd.Env = append(os.Environ(), opt.PipeFDEnvKey+"=3")
+	var (
+		dnsBridge   *os.File
+		dnsBridgeFD int
+	)
+	if opt.DNSMode == DNSModeStubBridge {
+		dnsBridge, err = listenDNSBridge()
+		if err != nil {
+			childPipe.Close()
+			return err
+		}
+		cmd.ExtraFiles = append(cmd.ExtraFiles, dnsBridge)
+		dnsBridgeFD = 3 + len(cmd.ExtraFiles) - 1
+	}
+	if opt.StateDirEnvKey != "" {
+		cmd.Env = append(cmd.Env, opt.StateDirEnvKey+"="+opt.StateDir)
+	}
+	err = cmd.Start()
+	childPipe.Close()
+	if dnsBridge != nil {
+		dnsBridge.Close()
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to start the child")
+	}
+	childPIDPath := filepath.Join(opt.StateDir, StateFileChildPID)
+	if err := ioutil.WriteFile(childPIDPath, []byte(strconv.Itoa(cmd.Process.Pid)), 0444); err != nil {
+		return errors.Wrapf(err, "failed to write the child PID %d to %s", cmd.Process.Pid, childPIDPath)
+	}
+	if opt.OOMScoreAdj != nil {
+		if err := setOOMScoreAdj(cmd.Process.Pid, *opt.OOMScoreAdj); err != nil {
+			return err
+		}
+	}
+	if err := setupUIDGIDMap(cmd.Process.Pid); err != nil {
+		return errors.Wrap(err, "failed to setup UID/GID map")
+	}
+	// send message 0
+	msg := common.Message{
+		Version:  common.ProtocolVersion,
+		Stage:    0,
+		Message0: common.Message0{},
+	}
+	if _, err := msgutil.MarshalToWriter(pipe, &msg); err != nil {
+		return err
+	}
+
+	// configure Network driver
+	msg = common.Message{
+		Version: common.ProtocolVersion,
+		Stage:   1,
+		Message1: common.Message1{
+			StateDir:   opt.StateDir,
+			Hostname:   opt.Hostname,
+			ExtraHosts: opt.ExtraHosts,
+		},
+	}
+	var controlListener net.Listener
+	if opt.OnControlConnected != nil {
+		controlSockPath := filepath.Join(opt.StateDir, StateFileControlSock)
+		controlListener, err = listenControl(controlSockPath)
+		if err != nil {
+			return errors.Wrapf(err, "failed to listen on %s", controlSockPath)
+		}
+		defer controlListener.Close()
+		msg.Message1.ControlSocketPath = controlSockPath
+	}
+	if opt.NetworkDriver != nil {
+		netMsg, cleanupNetwork, err := opt.NetworkDriver.ConfigureNetwork(cmd.Process.Pid, opt.StateDir)
+		if cleanupNetwork != nil {
+			defer cleanupNetwork()
+		}
+		if err != nil {
+			return errors.Wrapf(err, "failed to setup network %+v", opt.NetworkDriver)
+		}
+		msg.Message1.Network = *netMsg
+		if opt.ResolvConfPath != "" {
+			msg.Message1.Network.ResolvConfPath = opt.ResolvConfPath
+		}
+		if err := applyDNSMode(&msg.Message1.Network, opt.DNSMode, dnsBridgeFD); err != nil {
+			return err
+		}
+	}
+
+	// configure Port driver
+	portDriverInitComplete := make(chan struct{})
+	portDriverQuit := make(chan struct{})
+	portDriverErr := make(chan error)
+	if opt.PortDriver != nil {
+		msg.Message1.Port.Opaque = opt.PortDriver.OpaqueForChild()
+	}
+
+	// send message 1
+	if _, err := msgutil.MarshalToWriter(pipe, &msg); err != nil {
+		return err
+	}
+	// wait for message 2
+	msg2, err := waitChildReady(pipe)
+	if err != nil {
+		return err
+	}
+	childVersion := msg2.Version
+	// start the port driver with the IP address of the child after the setup, e.g. leased with DHCP
+	if opt.PortDriver != nil {
+		portStart := time.Now()
+		cctx := &port.ChildContext{
+			PID: cmd.Process.Pid,
+			IP:  childIP(msg2.IP),
+		}
+		go func() {
+			portDriverErr <- opt.PortDriver.RunParentDriver(portDriverInitComplete,
+				portDriverQuit, cctx)
+		}()
+		select {
+		case <-portDriverInitComplete:
+			metrics.Observe(opt.Metrics, metrics.PhasePort, portStart)
+		case err = <-portDriverErr:
+			return err
+		}
+	}
+	// listens the API
+	apiSockPath := filepath.Join(opt.StateDir, StateFileAPISock)
+	apiCloser, err := listenServeAPI(apiSockPath, &router.Backend{PortDriver: opt.PortDriver})
+	if err != nil {
+		return err
+	}
+	childExited := make(chan struct{})
+	if opt.DNSUpdates != nil {
+		if childVersion < 3 {
+			logrus.Warnf("the child does not support updating DNS servers (protocol version %d)", childVersion)
+		} else {
+			go sendDNSUpdates(pipe, opt.DNSUpdates, childExited)
+		}
+	}
+	if opt.OnTargetStarted != nil {
+		if childVersion < 4 {
+			logrus.Warnf("the child does not notify the target command (protocol version %d)", childVersion)
+		} else {
+			go waitTargetStarted(pipe, cmd.Process.Pid, opt.OnTargetStarted)
+		}
+	}
+	if controlListener != nil {
+		go acceptControl(controlListener, cmd.Process.Pid, opt.OnControlConnected, childExited)
+	}
+	// block until the child exits
+	err = cmd.Wait()
+	close(childExited)
+	if err != nil {
+		return errors.Wrap(err, "child exited")
+	}
+	// close the API socket
+	if err := apiCloser.Close(); err != nil {
+		return errors.Wrapf(err, "failed to close %s", apiSockPath)
+	}
+	// shut down port driver
+	if opt.PortDriver != nil {
+		portDriverQuit <- struct{}{}
+		err = <-portDriverErr
+	}
+	return err
+}
+
+// waitChildReady blocks until the child sends Message 2, and returns Message 2.
+func waitChildReady(r io.Reader) (*common.Message, error) {
+	var msg common.Message
+	if _, err := msgutil.UnmarshalFromReader(r, &msg); err != nil {
+		if err == io.EOF {
+			return nil, errors.New("child exited before completing the setup")
+		}
+		return nil, errors.Wrap(err, "failed to read message 2 from the child")
+	}
+	if msg.Stage != 2 {
+		return nil, errors.Errorf("expected stage 2, got stage %d", msg.Stage)
+	}
+	if msg.SetupError != "" {
+		return nil, errors.Errorf("child failed to set up: %s", msg.SetupError)
+	}
+	return &msg, nil
+}
+
+// childIP returns the IPv4 address reported in Message 2,
+// or 127.0.0.1 when the child reported none, e.g. for an IPv6-only network or an older child.
+func childIP(reported string) net.IP {
+	if ip := net.ParseIP(reported).To4(); ip != nil {
+		return ip
+	}
+	return net.IPv4(127, 0, 0, 1).To4()
+}
+
+// waitTargetStarted reads Message 4, and calls fn with the PID translated into the host PID.
+func waitTargetStarted(r io.Reader, childPID int, fn func(int, map[string]uint64)) {
+	var msg common.Message
+	if _, err := msgutil.UnmarshalFromReader(r, &msg); err != nil {
+		if err != io.EOF {
+			logrus.WithError(err).Warn("failed to read message 4 from the child")
+		}
+		return
+	}
+	if msg.Stage != 4 {
+		logrus.Warnf("expected stage 4, got stage %d", msg.Stage)
+		return
+	}
+	pid, err := hostPID(childPID, msg.PID)
+	if err != nil {
+		logrus.WithError(err).Warnf("failed to get the host PID of the target command (PID %d in the child)", msg.PID)
+	}
+	fn(pid, msg.Namespaces)
+}
+
+// hostPID returns the host PID of the child process of childPID, whose PID is nsPID in the PID namespace of childPID.
+func hostPID(childPID, nsPID int) (int, error) {
+	dirs, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return 0, err
+	}
+	for _, d := range dirs {
+		pid, err := strconv.Atoi(d.Name())
+		if err != nil {
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join("/proc", d.Name(), "status"))
+		if err != nil {
+			continue
+		}
+		var ppid int
+		var nspids []string
+		for _, line := range strings.Split(string(b), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) < 2 {
+				continue
+			}
+			switch fields[0] {
+			case "PPid:":
+				ppid, _ = strconv.Atoi(fields[1])
+			case "NSpid:":
+				nspids = fields[1:]
+			}
+		}
+		// the last NSpid is the PID in the innermost PID namespace
+		if ppid == childPID && len(nspids) > 0 && nspids[len(nspids)-1] == strconv.Itoa(nsPID) {
+			return pid, nil
+		}
+	}
+	return 0, errors.Errorf("no child process of %d with PID %d in the namespace", childPID, nsPID)
+}
+
+// sendDNSUpdates sends Message 3 for each update, until done is closed.
+func sendDNSUpdates(w io.Writer, updates <-chan []string, done <-chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case servers, ok := <-updates:
+			if !ok {
+				return
+			}
+			msg := common.Message{
+				Version: common.ProtocolVersion,
+				Stage:   3,
+				Message3: common.Message3{
+					DNSServers: servers,
+				},
+			}
+			if _, err := msgutil.MarshalToWriter(w, &msg); err != nil {
+				logrus.WithError(err).Warnf("failed to send DNS servers %v to the child", servers)
+				return
+			}
+		}
+	}
+}
+
+// setOOMScoreAdj sets oom_score_adj of pid.
+// Decreasing the value (below oom_score_adj_min) needs CAP_SYS_RESOURCE.
+func setOOMScoreAdj(pid, score int) error {
+	p := filepath.Join("/proc", strconv.Itoa(pid), "oom_score_adj")
+	if err := ioutil.WriteFile(p, []byte(strconv.Itoa(score)), 0644); err != nil {
+		return errors.Wrapf(err, "failed to set oom_score_adj of the child to %d (decreasing needs CAP_SYS_RESOURCE)", score)
+	}
+	return nil
+}
+
+func newugidmapArgs() ([]string, []string, error) {
+	u, err := user.Current()
+	if err != nil {
+		return nil, nil, err
+	}
+	uidMap := []string{
+		"0",
+		u.Uid,
+		"1",
+	}
+	gidMap := []string{
+		"0",
+		u.Gid,
+		"1",
+	}
+
+	// get both subid maps
+	// uses username for groupname in case primary groupname is not the same
+	// idtools will fall back to getent if /etc/passwd does not contain username
+	// works with external auth, ie sssd, ldap, nis
+	ims, err := idtools.NewIdentityMapping(u.Username, u.Username)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	uidMapLast := 1
+	for _, im := range ims.UIDs() {
+		uidMap = append(uidMap, []string{
+			strconv.Itoa(uidMapLast),
+			strconv.Itoa(im.HostID),
+			strconv.Itoa(im.Size),
+		}...)
+		uidMapLast += im.Size
+	}
+	gidMapLast := 1
+	for _, im := range ims.GIDs() {
+		gidMap = append(gidMap, []string{
+			strconv.Itoa(gidMapLast),
+			strconv.Itoa(im.HostID),
+			strconv.Itoa(im.Size),
+		}...)
+		gidMapLast += im.Size
+	}
+
+	return uidMap, gidMap, nil
+}
+
+func setupUIDGIDMap(pid int) error {
+	uArgs, gArgs, err := newugidmapArgs()
+	if err != nil {
+		return errors.Wrap(err, "failed to compute uid/gid map")
+	}
+	pidS := strconv.Itoa(pid)
+	cmd := exec.Command("newuidmap", append([]string{pidS}, uArgs...)...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return errors.Wrapf(err, "newuidmap %s %v failed: %s", pidS, uArgs, string(out))
+	}
+	cmd = exec.Command("newgidmap", append([]string{pidS}, gArgs...)...)
+	out, err = cmd.CombinedOutput()
+	if err != nil {
+		return errors.Wrapf(err, "newgidmap %s %v failed: %s", pidS, gArgs, string(out))
+	}
+	return nil
+}
+
+// apiCloser is implemented by *http.Server
+type apiCloser interface {
+	Close() error
+	Shutdown(context.Context) error
+}
+
+func listenServeAPI(socketPath string, backend *router.Backend) (apiCloser, error) {
+	r := mux.NewRouter()
+	router.AddRoutes(r, backend)
+	srv := &http.Server{Handler: r}
+	err := os.RemoveAll(socketPath)
+	if err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+	go srv.Serve(l)
+	return srv, nil
+}
@@ -0,0 +1,21 @@
+package parent
+
+import "testing"
+
+func TestChildIP(t *testing.T) {
+	testCases := []struct {
+		reported string
+		expected string
+	}{
+		{"10.0.2.100", "10.0.2.100"},
+		{"", "127.0.0.1"},
+		{"fd00::100", "127.0.0.1"},
+		{"invalid", "127.0.0.1"},
+	}
+	for _, tc := range testCases {
+		ip := childIP(tc.reported)
+		if ip.String() != tc.expected || len(ip) != 4 {
+			t.Errorf("childIP(%q): expected %s, got %v", tc.reported, tc.expected, ip)
+		}
+	}
+}
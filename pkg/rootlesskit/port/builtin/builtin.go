@@ -0,0 +1,94 @@
+// Package builtin provides the port driver that does not depend on external binaries.
+//
+// The parent driver listens on the host-side ports, and passes the listener sockets
+// to the child driver over a UNIX socket (SCM_RIGHTS).
+// The child driver accepts the connections on the passed sockets, and
+// forwards them to the ports in the child network namespace.
+package builtin
+
+import (
+	"io"
+	"net"
+	"syscall"
+
+	"github.com/pkg/errors"
+
+	"github.com/rancher/k3s/pkg/rootlesskit/msgutil"
+	"github.com/rancher/k3s/pkg/rootlesskit/port"
+)
+
+const (
+	opaqueKeySocketPath = "builtin.socketpath"
+	requestTypeAdd      = "add"
+	requestTypeRemove   = "remove"
+	requestTypeList     = "list"
+)
+
+// request is sent from the parent to the child.
+// For requestTypeAdd, the host-side socket is passed as the SCM_RIGHTS ancillary data.
+type request struct {
+	Type string
+	ID   int
+	Spec port.Spec
+}
+
+// reply is sent from the child to the parent.
+type reply struct {
+	Error string
+	// Ports is set for requestTypeList
+	Ports []port.Status
+}
+
+func writeMsg(c *net.UnixConn, x interface{}, fd int) error {
+	b, err := msgutil.Marshal(x)
+	if err != nil {
+		return err
+	}
+	var oob []byte
+	if fd >= 0 {
+		oob = syscall.UnixRights(fd)
+	}
+	_, _, err = c.WriteMsgUnix(b, oob, nil)
+	return err
+}
+
+// readMsg returns the fd passed with the message, or -1.
+func readMsg(c *net.UnixConn, x interface{}) (int, error) {
+	// 4 bytes for the msgutil header
+	b := make([]byte, 4+msgutil.MaxMessageSize)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	n, oobn, _, _, err := c.ReadMsgUnix(b, oob)
+	if err != nil {
+		return -1, err
+	}
+	if n == 0 {
+		return -1, io.EOF
+	}
+	fd := -1
+	if oobn > 0 {
+		scms, err := syscall.ParseSocketControlMessage(oob[:oobn])
+		if err != nil {
+			return -1, errors.Wrap(err, "parsing socket control message")
+		}
+		for _, scm := range scms {
+			fds, err := syscall.ParseUnixRights(&scm)
+			if err != nil {
+				return -1, errors.Wrap(err, "parsing unix rights")
+			}
+			for _, f := range fds {
+				if fd < 0 {
+					fd = f
+				} else {
+					syscall.Close(f)
+				}
+			}
+		}
+	}
+	if err := msgutil.Unmarshal(b[:n], x); err != nil {
+		if fd >= 0 {
+			syscall.Close(fd)
+		}
+		return -1, err
+	}
+	return fd, nil
+}
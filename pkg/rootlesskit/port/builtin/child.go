@@ -0,0 +1,598 @@
+package builtin
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+
+	"github.com/rancher/k3s/pkg/rootlesskit/metrics"
+	"github.com/rancher/k3s/pkg/rootlesskit/port"
+	"github.com/rancher/k3s/pkg/rootlesskit/port/portutil"
+)
+
+// udpIdleTimeout is the default duration to keep the UDP "connections" to the child without traffic.
+const udpIdleTimeout = 60 * time.Second
+
+// NewChildDriver instantiates the child driver.
+// The returned driver also implements port.ChildManager.
+func NewChildDriver(logWriter io.Writer) port.ChildDriver {
+	return NewChildDriverWithMetrics(logWriter, nil)
+}
+
+// NewChildDriverWithMetrics is akin to NewChildDriver, but increments the counters of m.
+// m can be nil.
+func NewChildDriverWithMetrics(logWriter io.Writer, m metrics.Metrics) port.ChildDriver {
+	return &childDriver{
+		logWriter:  logWriter,
+		metrics:    m,
+		ports:      make(map[int]*port.Status),
+		forwarders: make(map[int]forwarder),
+	}
+}
+
+type childDriver struct {
+	logWriter  io.Writer
+	metrics    metrics.Metrics
+	mu         sync.Mutex
+	ports      map[int]*port.Status
+	forwarders map[int]forwarder
+}
+
+func (d *childDriver) RunChildDriver(opaque map[string]string, quit <-chan struct{}) error {
+	socketPath := opaque[opaqueKeySocketPath]
+	if socketPath == "" {
+		return errors.New("socket path not set")
+	}
+	if err := os.RemoveAll(socketPath); err != nil {
+		return err
+	}
+	ln, err := net.ListenUnix("unixpacket", &net.UnixAddr{Name: socketPath, Net: "unixpacket"})
+	if err != nil {
+		return err
+	}
+	go func() {
+		for {
+			c, err := ln.AcceptUnix()
+			if err != nil {
+				// ln is closed
+				return
+			}
+			go d.handleConn(c)
+		}
+	}()
+	<-quit
+	err = ln.Close()
+	d.mu.Lock()
+	for id, fw := range d.forwarders {
+		fw.Close()
+		delete(d.forwarders, id)
+		delete(d.ports, id)
+	}
+	d.mu.Unlock()
+	return err
+}
+
+func (d *childDriver) handleConn(c *net.UnixConn) {
+	defer c.Close()
+	var req request
+	fd, err := readMsg(c, &req)
+	if err != nil {
+		if err != io.EOF {
+			fmt.Fprintf(d.logWriter, "[builtin] failed to read request: %v\n", err)
+		}
+		return
+	}
+	var rep reply
+	if err := d.handleRequest(req, fd, &rep); err != nil {
+		rep.Error = err.Error()
+	}
+	if err := writeMsg(c, &rep, -1); err != nil {
+		fmt.Fprintf(d.logWriter, "[builtin] failed to write reply: %v\n", err)
+	}
+}
+
+func (d *childDriver) handleRequest(req request, fd int, rep *reply) error {
+	ctx := context.TODO()
+	switch req.Type {
+	case requestTypeAdd:
+		if fd < 0 {
+			return errors.New("no socket was passed")
+		}
+		f := os.NewFile(uintptr(fd), "builtin")
+		defer f.Close()
+		return d.AddPort(ctx, req.ID, req.Spec, f)
+	case requestTypeRemove:
+		return d.RemovePort(ctx, req.ID)
+	case requestTypeList:
+		ports, err := d.ListPorts(ctx)
+		rep.Ports = ports
+		return err
+	default:
+		return errors.Errorf("unknown request type: %q", req.Type)
+	}
+}
+
+// AddPort implements port.ChildManager.
+func (d *childDriver) AddPort(ctx context.Context, id int, spec port.Spec, f *os.File) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.ports[id]; ok {
+		return errors.Errorf("duplicated port id: %d", id)
+	}
+	if err := portutil.ValidatePortSpec(spec, d.ports); err != nil {
+		return err
+	}
+	childAddr := net.JoinHostPort("127.0.0.1", strconv.Itoa(spec.ChildPort))
+	var (
+		fw  forwarder
+		err error
+	)
+	switch spec.Proto {
+	case "tcp":
+		if spec.ChildUnixSocket != "" {
+			fw, err = newTCPForwarder(f, "unix", spec.ChildUnixSocket, spec, d.logWriter, d.metrics)
+		} else {
+			fw, err = newTCPForwarder(f, "tcp", childAddr, spec, d.logWriter, d.metrics)
+		}
+	case "udp":
+		fw, err = newUDPForwarder(f, childAddr, spec, d.logWriter, d.metrics)
+	case "sctp":
+		fw, err = newSCTPForwarder(f, net.IPv4(127, 0, 0, 1), spec.ChildPort, d.logWriter)
+	default:
+		err = errors.Errorf("unsupported proto: %s", spec.Proto)
+	}
+	if err != nil {
+		return err
+	}
+	d.ports[id] = &port.Status{
+		ID:   id,
+		Spec: spec,
+	}
+	d.forwarders[id] = fw
+	return nil
+}
+
+// ListPorts implements port.ChildManager.
+func (d *childDriver) ListPorts(ctx context.Context) ([]port.Status, error) {
+	var ports []port.Status
+	d.mu.Lock()
+	for id, p := range d.ports {
+		st := *p
+		fw := d.forwarders[id]
+		if err := fw.Err(); err != nil {
+			st.Error = err.Error()
+		}
+		stats := fw.Stats()
+		st.Stats = &stats
+		ports = append(ports, st)
+	}
+	d.mu.Unlock()
+	return ports, nil
+}
+
+// RemovePort implements port.ChildManager.
+// The host-side socket is closed before RemovePort returns.
+func (d *childDriver) RemovePort(ctx context.Context, id int) error {
+	d.mu.Lock()
+	fw, ok := d.forwarders[id]
+	delete(d.forwarders, id)
+	delete(d.ports, id)
+	d.mu.Unlock()
+	if !ok {
+		return errors.Errorf("unknown port id: %d", id)
+	}
+	return fw.Close()
+}
+
+// forwarder is implemented by tcpForwarder, udpForwarder, and sctpForwarder.
+type forwarder interface {
+	io.Closer
+	// Err returns the error that stopped the forwarder unexpectedly, if any.
+	Err() error
+	Stats() port.Stats
+}
+
+// forwarderState records the error that stopped the forwarder unexpectedly,
+// and the counters.
+type forwarderState struct {
+	// accessed atomically
+	activeConns     int64
+	totalConns      int64
+	rejectedConns   int64
+	bytesIn         int64
+	bytesOut        int64
+	idleClosedConns int64
+
+	mu     sync.Mutex
+	closed bool
+	err    error
+}
+
+func (st *forwarderState) setClosed() {
+	st.mu.Lock()
+	st.closed = true
+	st.mu.Unlock()
+}
+
+// fail records err unless the forwarder was closed intentionally.
+func (st *forwarderState) fail(err error) {
+	st.mu.Lock()
+	if !st.closed {
+		st.err = err
+	}
+	st.mu.Unlock()
+}
+
+func (st *forwarderState) Err() error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.err
+}
+
+func (st *forwarderState) Stats() port.Stats {
+	return port.Stats{
+		ActiveConns:     atomic.LoadInt64(&st.activeConns),
+		TotalConns:      atomic.LoadInt64(&st.totalConns),
+		RejectedConns:   atomic.LoadInt64(&st.rejectedConns),
+		BytesIn:         atomic.LoadInt64(&st.bytesIn),
+		BytesOut:        atomic.LoadInt64(&st.bytesOut),
+		IdleClosedConns: atomic.LoadInt64(&st.idleClosedConns),
+	}
+}
+
+func (st *forwarderState) connOpened() {
+	atomic.AddInt64(&st.activeConns, 1)
+	atomic.AddInt64(&st.totalConns, 1)
+}
+
+func (st *forwarderState) connClosed() {
+	atomic.AddInt64(&st.activeConns, -1)
+}
+
+// connIdleClosed is called after connClosed for the connections closed due to the idle timeout. m can be nil.
+func (st *forwarderState) connIdleClosed(m metrics.Metrics) {
+	atomic.AddInt64(&st.idleClosedConns, 1)
+	metrics.Inc(m, metrics.CounterPortConnIdleClosed)
+}
+
+// tcpForwarder forwards the connections accepted on the host-side listener
+// to childAddr.
+type tcpForwarder struct {
+	// handling is the number of the accepted connections not closed yet, accessed atomically.
+	// Placed first for the 64-bit alignment.
+	handling int64
+	forwarderState
+	l            net.Listener
+	childNetwork string // "tcp" or "unix"
+	childAddr    string
+	dialer       net.Dialer
+	tcpOpt       *port.TCPOpt
+	idleTimeout  time.Duration
+	maxConns     int64
+	acceptRate   int
+	logWriter    io.Writer
+	metrics      metrics.Metrics
+	wg           sync.WaitGroup
+	connsMu      sync.Mutex
+	conns        map[net.Conn]struct{}
+}
+
+// newTCPForwarder creates tcpForwarder with the TCPOpt and the limits in spec. m can be nil.
+func newTCPForwarder(f *os.File, childNetwork, childAddr string, spec port.Spec, logWriter io.Writer, m metrics.Metrics) (*tcpForwarder, error) {
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, err
+	}
+	fw := &tcpForwarder{
+		l:            l,
+		childNetwork: childNetwork,
+		childAddr:    childAddr,
+		dialer:       net.Dialer{Control: markControl(spec.Mark)},
+		tcpOpt:       spec.TCPOpt,
+		idleTimeout:  time.Duration(spec.IdleTimeout) * time.Second,
+		maxConns:     int64(spec.MaxConnections),
+		acceptRate:   spec.MaxAcceptRate,
+		logWriter:    logWriter,
+		metrics:      m,
+		conns:        make(map[net.Conn]struct{}),
+	}
+	fw.wg.Add(1)
+	go fw.serve()
+	return fw, nil
+}
+
+func (fw *tcpForwarder) serve() {
+	defer fw.wg.Done()
+	var lastAccept time.Time
+	for {
+		if fw.acceptRate > 0 {
+			// the pending connections are kept in the backlog of the listener
+			time.Sleep(time.Until(lastAccept.Add(time.Second / time.Duration(fw.acceptRate))))
+		}
+		c, err := fw.l.Accept()
+		if err != nil {
+			fw.fail(err)
+			return
+		}
+		lastAccept = time.Now()
+		if fw.maxConns > 0 && atomic.LoadInt64(&fw.handling) >= fw.maxConns {
+			c.Close()
+			atomic.AddInt64(&fw.rejectedConns, 1)
+			metrics.Inc(fw.metrics, metrics.CounterPortConnRejected)
+			continue
+		}
+		atomic.AddInt64(&fw.handling, 1)
+		fw.wg.Add(1)
+		go fw.handle(c)
+	}
+}
+
+func (fw *tcpForwarder) track(c net.Conn, add bool) {
+	fw.connsMu.Lock()
+	if add {
+		fw.conns[c] = struct{}{}
+	} else {
+		delete(fw.conns, c)
+	}
+	fw.connsMu.Unlock()
+}
+
+func (fw *tcpForwarder) handle(hc net.Conn) {
+	defer fw.wg.Done()
+	defer atomic.AddInt64(&fw.handling, -1)
+	defer hc.Close()
+	fw.track(hc, true)
+	defer fw.track(hc, false)
+	cc, err := fw.dialer.Dial(fw.childNetwork, fw.childAddr)
+	if err != nil {
+		fmt.Fprintf(fw.logWriter, "[builtin] failed to connect to %s: %v\n", fw.childAddr, err)
+		return
+	}
+	defer cc.Close()
+	for _, c := range []net.Conn{hc, cc} {
+		tc, ok := c.(*net.TCPConn)
+		if !ok {
+			continue
+		}
+		if err := applyTCPOpt(tc, fw.tcpOpt); err != nil {
+			fmt.Fprintf(fw.logWriter, "[builtin] failed to apply %+v: %v\n", *fw.tcpOpt, err)
+			return
+		}
+	}
+	fw.track(cc, true)
+	defer fw.track(cc, false)
+	if fw.idleTimeout <= 0 {
+		fw.splice(hc, cc)
+		return
+	}
+	t := newIdleTimer(fw.idleTimeout, hc, cc)
+	fw.splice(t.wrap(hc), t.wrap(cc))
+	if t.expired() {
+		fw.connIdleClosed(fw.metrics)
+	}
+}
+
+// markControl returns net.Dialer.Control for setting SO_MARK.
+// Returns nil for mark 0.
+func markControl(mark int) func(network, address string, c syscall.RawConn) error {
+	if mark == 0 {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		if err := c.Control(func(fd uintptr) {
+			sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK, mark)
+		}); err != nil {
+			return err
+		}
+		return errors.Wrapf(sockErr, "setting SO_MARK %d", mark)
+	}
+}
+
+// applyTCPOpt applies o to c. o can be nil.
+func applyTCPOpt(c *net.TCPConn, o *port.TCPOpt) error {
+	if o == nil {
+		return nil
+	}
+	if o.KeepAlivePeriod < 0 {
+		if err := c.SetKeepAlive(false); err != nil {
+			return err
+		}
+	} else if o.KeepAlivePeriod > 0 {
+		if err := c.SetKeepAlive(true); err != nil {
+			return err
+		}
+		if err := c.SetKeepAlivePeriod(time.Duration(o.KeepAlivePeriod) * time.Second); err != nil {
+			return err
+		}
+	}
+	if o.ReadBuffer > 0 {
+		if err := c.SetReadBuffer(o.ReadBuffer); err != nil {
+			return err
+		}
+	}
+	if o.WriteBuffer > 0 {
+		if err := c.SetWriteBuffer(o.WriteBuffer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close stops accepting new connections and closes the active connections.
+func (fw *tcpForwarder) Close() error {
+	fw.setClosed()
+	err := fw.l.Close()
+	fw.connsMu.Lock()
+	for c := range fw.conns {
+		c.Close()
+	}
+	fw.connsMu.Unlock()
+	fw.wg.Wait()
+	return err
+}
+
+// spliceChunkSize is the granularity of updating the byte counters.
+// io.CopyN still allows the kernel splice for *net.TCPConn.
+const spliceChunkSize = 1 << 20
+
+// splice copies data between the host-side connection h and the child-side connection c
+// until both directions are finished.
+func (st *forwarderState) splice(h, c io.ReadWriteCloser) {
+	st.connOpened()
+	defer st.connClosed()
+	var wg sync.WaitGroup
+	cp := func(dst, src io.ReadWriteCloser, counter *int64) {
+		defer wg.Done()
+		for {
+			n, err := io.CopyN(dst, src, spliceChunkSize)
+			atomic.AddInt64(counter, n)
+			if err != nil {
+				break
+			}
+		}
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		} else {
+			dst.Close()
+		}
+	}
+	wg.Add(2)
+	go cp(c, h, &st.bytesIn)
+	go cp(h, c, &st.bytesOut)
+	wg.Wait()
+}
+
+// udpForwarder forwards the datagrams received on the host-side socket
+// to childAddr, using a dedicated child-side socket per client address.
+type udpForwarder struct {
+	forwarderState
+	pc          net.PacketConn
+	childAddr   string
+	dialer      net.Dialer
+	idleTimeout time.Duration
+	logWriter   io.Writer
+	metrics     metrics.Metrics
+	wg          sync.WaitGroup
+	clientsMu   sync.Mutex
+	clients     map[string]net.Conn
+}
+
+// newUDPForwarder creates udpForwarder with the Mark and the IdleTimeout in spec. m can be nil.
+func newUDPForwarder(f *os.File, childAddr string, spec port.Spec, logWriter io.Writer, m metrics.Metrics) (*udpForwarder, error) {
+	pc, err := net.FilePacketConn(f)
+	if err != nil {
+		return nil, err
+	}
+	idleTimeout := udpIdleTimeout
+	if spec.IdleTimeout > 0 {
+		idleTimeout = time.Duration(spec.IdleTimeout) * time.Second
+	}
+	fw := &udpForwarder{
+		pc:          pc,
+		childAddr:   childAddr,
+		dialer:      net.Dialer{Control: markControl(spec.Mark)},
+		idleTimeout: idleTimeout,
+		logWriter:   logWriter,
+		metrics:     m,
+		clients:     make(map[string]net.Conn),
+	}
+	fw.wg.Add(1)
+	go fw.serve()
+	return fw, nil
+}
+
+func (fw *udpForwarder) serve() {
+	defer fw.wg.Done()
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := fw.pc.ReadFrom(buf)
+		if err != nil {
+			fw.fail(err)
+			return
+		}
+		cc, err := fw.client(addr)
+		if err != nil {
+			fmt.Fprintf(fw.logWriter, "[builtin] failed to connect to %s: %v\n", fw.childAddr, err)
+			continue
+		}
+		if _, err := cc.Write(buf[:n]); err != nil {
+			fmt.Fprintf(fw.logWriter, "[builtin] failed to write to %s: %v\n", fw.childAddr, err)
+			continue
+		}
+		// the datagrams from the client also keep the socket
+		cc.SetReadDeadline(time.Now().Add(fw.idleTimeout))
+		atomic.AddInt64(&fw.bytesIn, int64(n))
+	}
+}
+
+// client returns the child-side socket for the client address.
+func (fw *udpForwarder) client(addr net.Addr) (net.Conn, error) {
+	fw.clientsMu.Lock()
+	defer fw.clientsMu.Unlock()
+	if cc, ok := fw.clients[addr.String()]; ok {
+		return cc, nil
+	}
+	cc, err := fw.dialer.Dial("udp", fw.childAddr)
+	if err != nil {
+		return nil, err
+	}
+	fw.clients[addr.String()] = cc
+	fw.connOpened()
+	fw.wg.Add(1)
+	go fw.reply(addr, cc)
+	return cc, nil
+}
+
+// reply relays the datagrams from the child back to the client,
+// until no datagram is sent or received for fw.idleTimeout.
+func (fw *udpForwarder) reply(addr net.Addr, cc net.Conn) {
+	defer fw.wg.Done()
+	var idle bool
+	defer func() {
+		fw.clientsMu.Lock()
+		delete(fw.clients, addr.String())
+		fw.clientsMu.Unlock()
+		cc.Close()
+		fw.connClosed()
+		if idle {
+			fw.connIdleClosed(fw.metrics)
+		}
+	}()
+	buf := make([]byte, 65536)
+	for {
+		cc.SetReadDeadline(time.Now().Add(fw.idleTimeout))
+		n, err := cc.Read(buf)
+		if err != nil {
+			idle = isTimeout(err)
+			return
+		}
+		if _, err := fw.pc.WriteTo(buf[:n], addr); err != nil {
+			return
+		}
+		atomic.AddInt64(&fw.bytesOut, int64(n))
+	}
+}
+
+// Close closes the host-side socket and the child-side sockets.
+func (fw *udpForwarder) Close() error {
+	fw.setClosed()
+	err := fw.pc.Close()
+	fw.clientsMu.Lock()
+	for _, cc := range fw.clients {
+		cc.Close()
+	}
+	fw.clientsMu.Unlock()
+	fw.wg.Wait()
+	return err
+}
@@ -0,0 +1,194 @@
+package builtin
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rancher/k3s/pkg/rootlesskit/port"
+)
+
+func getsockoptInt(t *testing.T, c *net.TCPConn, level, opt int) int {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		v       int
+		sockErr error
+	)
+	if err := raw.Control(func(fd uintptr) {
+		v, sockErr = unix.GetsockoptInt(int(fd), level, opt)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if sockErr != nil {
+		t.Fatal(sockErr)
+	}
+	return v
+}
+
+// dialLoopback returns a TCP connection to a listener on the loopback.
+func dialLoopback(t *testing.T) *net.TCPConn {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	c, err := net.Dial("tcp4", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c.(*net.TCPConn)
+}
+
+func TestApplyTCPOpt(t *testing.T) {
+	testCases := []struct {
+		name      string
+		opt       port.TCPOpt
+		keepAlive int
+		keepIdle  int // checked when non-zero
+		rcvbuf    int // minimum, as the kernel doubles the value
+		sndbuf    int // minimum, as the kernel doubles the value
+	}{
+		{name: "keepalive", opt: port.TCPOpt{KeepAlivePeriod: 42}, keepAlive: 1, keepIdle: 42},
+		{name: "no keepalive", opt: port.TCPOpt{KeepAlivePeriod: -1}, keepAlive: 0},
+		{name: "buffers", opt: port.TCPOpt{KeepAlivePeriod: 5, ReadBuffer: 1 << 17, WriteBuffer: 1 << 18}, keepAlive: 1, keepIdle: 5, rcvbuf: 1 << 17, sndbuf: 1 << 18},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := dialLoopback(t)
+			defer c.Close()
+			if err := applyTCPOpt(c, &tc.opt); err != nil {
+				t.Fatal(err)
+			}
+			if got := getsockoptInt(t, c, unix.SOL_SOCKET, unix.SO_KEEPALIVE); got != tc.keepAlive {
+				t.Errorf("expected SO_KEEPALIVE %d, got %d", tc.keepAlive, got)
+			}
+			if tc.keepIdle != 0 {
+				if got := getsockoptInt(t, c, unix.IPPROTO_TCP, unix.TCP_KEEPIDLE); got != tc.keepIdle {
+					t.Errorf("expected TCP_KEEPIDLE %d, got %d", tc.keepIdle, got)
+				}
+			}
+			if got := getsockoptInt(t, c, unix.SOL_SOCKET, unix.SO_RCVBUF); got < tc.rcvbuf {
+				t.Errorf("expected SO_RCVBUF >= %d, got %d", tc.rcvbuf, got)
+			}
+			if got := getsockoptInt(t, c, unix.SOL_SOCKET, unix.SO_SNDBUF); got < tc.sndbuf {
+				t.Errorf("expected SO_SNDBUF >= %d, got %d", tc.sndbuf, got)
+			}
+		})
+	}
+}
+
+func TestApplyTCPOptNil(t *testing.T) {
+	c := dialLoopback(t)
+	defer c.Close()
+	before := getsockoptInt(t, c, unix.SOL_SOCKET, unix.SO_KEEPALIVE)
+	if err := applyTCPOpt(c, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := getsockoptInt(t, c, unix.SOL_SOCKET, unix.SO_KEEPALIVE); got != before {
+		t.Fatalf("expected SO_KEEPALIVE to be kept as %d, got %d", before, got)
+	}
+}
+
+// TestForwardIPv6ToIPv4 tests forwarding the connections to a host IPv6 address to an IPv4 child port.
+func TestForwardIPv6ToIPv4(t *testing.T) {
+	if l, err := net.Listen("tcp6", "[::1]:0"); err != nil {
+		t.Skipf("IPv6 loopback is unavailable: %v", err)
+	} else {
+		l.Close()
+	}
+	t.Run("tcp", func(t *testing.T) {
+		child, err := net.Listen("tcp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer child.Close()
+		go func() {
+			for {
+				c, err := child.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					defer c.Close()
+					b := make([]byte, 64)
+					n, _ := c.Read(b)
+					c.Write(b[:n])
+				}()
+			}
+		}()
+		spec := port.Spec{Proto: "tcp", ParentIP: "::1", ChildPort: child.Addr().(*net.TCPAddr).Port}
+		f, err := listen(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parentAddr := boundAddr(t, "tcp", f).String()
+		fw, err := newTCPForwarder(f, "tcp", child.Addr().String(), spec, ioutil.Discard, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fw.Close()
+		c, err := net.Dial("tcp6", parentAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		assertEcho(t, c)
+	})
+	t.Run("udp", func(t *testing.T) {
+		child, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer child.Close()
+		go func() {
+			b := make([]byte, 64)
+			for {
+				n, addr, err := child.ReadFrom(b)
+				if err != nil {
+					return
+				}
+				child.WriteTo(b[:n], addr)
+			}
+		}()
+		spec := port.Spec{Proto: "udp", ParentIP: "::1", ChildPort: child.LocalAddr().(*net.UDPAddr).Port}
+		f, err := listen(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parentAddr := boundAddr(t, "udp", f).String()
+		fw, err := newUDPForwarder(f, child.LocalAddr().String(), spec, ioutil.Discard, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fw.Close()
+		c, err := net.Dial("udp6", parentAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		assertEcho(t, c)
+	})
+}
+
+func assertEcho(t *testing.T, c net.Conn) {
+	if err := c.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 64)
+	n, err := c.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b[:n]) != "hello" {
+		t.Fatalf("expected %q, got %q", "hello", string(b[:n]))
+	}
+}
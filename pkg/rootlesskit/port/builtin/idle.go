@@ -0,0 +1,82 @@
+package builtin
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// idleTimer closes a pair of the connections with the deadlines, when neither of them has traffic for timeout.
+// The deadlines are extended on every read and write, so the kernel splice is not used for the wrapped connections.
+type idleTimer struct {
+	timeout time.Duration
+	conns   []net.Conn
+	// timedOut is set when a read or a write failed with the deadline, accessed atomically.
+	timedOut int32
+}
+
+func newIdleTimer(timeout time.Duration, conns ...net.Conn) *idleTimer {
+	t := &idleTimer{
+		timeout: timeout,
+		conns:   conns,
+	}
+	t.touch()
+	return t
+}
+
+func (t *idleTimer) touch() {
+	deadline := time.Now().Add(t.timeout)
+	for _, c := range t.conns {
+		c.SetDeadline(deadline)
+	}
+}
+
+func (t *idleTimer) observe(n int, err error) {
+	if n > 0 {
+		t.touch()
+	}
+	if isTimeout(err) {
+		atomic.StoreInt32(&t.timedOut, 1)
+	}
+}
+
+// expired returns true if the connections were closed due to the timeout.
+func (t *idleTimer) expired() bool {
+	return atomic.LoadInt32(&t.timedOut) != 0
+}
+
+// wrap returns c that extends the deadlines of t on every read and write.
+// c must be one of the connections of t.
+func (t *idleTimer) wrap(c net.Conn) net.Conn {
+	return &idleConn{Conn: c, t: t}
+}
+
+type idleConn struct {
+	net.Conn
+	t *idleTimer
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.t.observe(n, err)
+	return n, err
+}
+
+func (c *idleConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.t.observe(n, err)
+	return n, err
+}
+
+// CloseWrite is called by splice.
+func (c *idleConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
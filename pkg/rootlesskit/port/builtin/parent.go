@@ -0,0 +1,211 @@
+package builtin
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+
+	"github.com/rancher/k3s/pkg/rootlesskit/port"
+	"github.com/rancher/k3s/pkg/rootlesskit/port/portutil"
+)
+
+// NewParentDriver instantiates the parent driver.
+// stateDir needs to be the same as the StateDir of the parent.
+func NewParentDriver(logWriter io.Writer, stateDir string) (port.ParentDriver, error) {
+	if stateDir == "" {
+		return nil, errors.New("state dir is not set")
+	}
+	d := driver{
+		logWriter:  logWriter,
+		socketPath: filepath.Join(stateDir, ".bp.sock"),
+		ports:      make(map[int]*port.Status, 0),
+		nextID:     1,
+	}
+	return &d, nil
+}
+
+type driver struct {
+	logWriter  io.Writer
+	socketPath string
+	mu         sync.Mutex
+	ports      map[int]*port.Status
+	nextID     int
+}
+
+func (d *driver) OpaqueForChild() map[string]string {
+	return map[string]string{
+		opaqueKeySocketPath: d.socketPath,
+	}
+}
+
+func (d *driver) RunParentDriver(initComplete chan struct{}, quit <-chan struct{}, _ *port.ChildContext) error {
+	// wait for the child driver to start listening on the socket
+	for {
+		c, err := net.Dial("unixpacket", d.socketPath)
+		if err == nil {
+			c.Close()
+			break
+		}
+		select {
+		case <-quit:
+			return nil
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	initComplete <- struct{}{}
+	<-quit
+	return nil
+}
+
+// call sends the request to the child and waits for the reply.
+// fd is passed to the child unless it is negative.
+func (d *driver) call(ctx context.Context, req request, fd int) (*reply, error) {
+	var dialer net.Dialer
+	c, err := dialer.DialContext(ctx, "unixpacket", d.socketPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "connecting to %s", d.socketPath)
+	}
+	defer c.Close()
+	uc := c.(*net.UnixConn)
+	if err := writeMsg(uc, &req, fd); err != nil {
+		return nil, errors.Wrapf(err, "sending %s request", req.Type)
+	}
+	var rep reply
+	if _, err := readMsg(uc, &rep); err != nil {
+		return nil, errors.Wrapf(err, "reading reply for %s request", req.Type)
+	}
+	if rep.Error != "" {
+		return nil, errors.New(rep.Error)
+	}
+	return &rep, nil
+}
+
+// listen creates the host-side socket.
+func listen(spec port.Spec) (*os.File, error) {
+	ip := net.IPv4zero
+	if spec.ParentIP != "" {
+		ip = net.ParseIP(spec.ParentIP)
+		if ip == nil {
+			return nil, errors.Errorf("unsupported parentIP: %s", spec.ParentIP)
+		}
+	}
+	// the child side always connects to 127.0.0.1, regardless of the family of the host side
+	network := spec.Proto + "4"
+	if ip4 := ip.To4(); ip4 != nil {
+		// IPv4-mapped IPv6 addresses are bound as IPv4
+		ip = ip4
+	} else if ip.IsUnspecified() {
+		// "::" is bound as dual-stack
+		network = spec.Proto
+	} else {
+		network = spec.Proto + "6"
+	}
+	addr := net.JoinHostPort(ip.String(), strconv.Itoa(spec.ParentPort))
+	var lc net.ListenConfig
+	if spec.ReusePort {
+		lc.Control = setReusePort
+	}
+	switch spec.Proto {
+	case "tcp":
+		l, err := lc.Listen(context.TODO(), network, addr)
+		if err != nil {
+			return nil, err
+		}
+		defer l.Close()
+		return l.(*net.TCPListener).File()
+	case "udp":
+		c, err := lc.ListenPacket(context.TODO(), network, addr)
+		if err != nil {
+			return nil, err
+		}
+		defer c.Close()
+		return c.(*net.UDPConn).File()
+	case "sctp":
+		if ip.To4() == nil {
+			return nil, errors.Errorf("unsupported parentIP for sctp (v6?): %s", spec.ParentIP)
+		}
+		return listenSCTP(ip, spec.ParentPort, spec.ReusePort)
+	default:
+		return nil, errors.Errorf("unsupported proto: %s", spec.Proto)
+	}
+}
+
+// setReusePort implements net.ListenConfig.Control.
+func setReusePort(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	if err := c.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	}); err != nil {
+		return err
+	}
+	return errors.Wrap(sockErr, "setting SO_REUSEPORT")
+}
+
+func (d *driver) AddPort(ctx context.Context, spec port.Spec) (*port.Status, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := portutil.ValidatePortSpec(spec, d.ports); err != nil {
+		return nil, err
+	}
+	f, err := listen(spec)
+	if err != nil {
+		return nil, errors.Wrapf(err, "listening on %+v", spec)
+	}
+	// the child holds its own copy of the fd
+	defer f.Close()
+	id := d.nextID
+	req := request{
+		Type: requestTypeAdd,
+		ID:   id,
+		Spec: spec,
+	}
+	if _, err := d.call(ctx, req, int(f.Fd())); err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(d.logWriter, "[builtin] added port %d: %+v\n", id, spec)
+	st := port.Status{
+		ID:   id,
+		Spec: spec,
+	}
+	d.ports[id] = &st
+	d.nextID++
+	return &st, nil
+}
+
+// ListPorts returns the status reported by the child.
+func (d *driver) ListPorts(ctx context.Context) ([]port.Status, error) {
+	req := request{
+		Type: requestTypeList,
+	}
+	rep, err := d.call(ctx, req, -1)
+	if err != nil {
+		return nil, err
+	}
+	return rep.Ports, nil
+}
+
+func (d *driver) RemovePort(ctx context.Context, id int) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.ports[id]; !ok {
+		return errors.Errorf("unknown port id: %d", id)
+	}
+	req := request{
+		Type: requestTypeRemove,
+		ID:   id,
+	}
+	_, err := d.call(ctx, req, -1)
+	delete(d.ports, id)
+	fmt.Fprintf(d.logWriter, "[builtin] removed port %d\n", id)
+	return err
+}
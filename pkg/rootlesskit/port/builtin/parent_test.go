@@ -0,0 +1,103 @@
+package builtin
+
+import (
+	"net"
+	"os"
+	"testing"
+
+	"github.com/rancher/k3s/pkg/rootlesskit/port"
+)
+
+// boundAddr returns the local address of the socket returned from listen.
+func boundAddr(t *testing.T, proto string, f *os.File) net.Addr {
+	if proto == "udp" {
+		c, err := net.FilePacketConn(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		return c.LocalAddr()
+	}
+	l, err := net.FileListener(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr()
+}
+
+func boundPort(t *testing.T, proto string, f *os.File) int {
+	switch a := boundAddr(t, proto, f).(type) {
+	case *net.TCPAddr:
+		return a.Port
+	case *net.UDPAddr:
+		return a.Port
+	default:
+		t.Fatalf("unexpected address %v", a)
+		return 0
+	}
+}
+
+func TestListenReusePort(t *testing.T) {
+	testCases := []struct {
+		proto     string
+		reusePort bool
+	}{
+		{"tcp", true},
+		{"tcp", false},
+		{"udp", true},
+		{"udp", false},
+	}
+	for _, tc := range testCases {
+		spec := port.Spec{Proto: tc.proto, ParentIP: "127.0.0.1", ReusePort: tc.reusePort}
+		first, err := listen(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		spec.ParentPort = boundPort(t, tc.proto, first)
+		second, err := listen(spec)
+		if tc.reusePort {
+			if err != nil {
+				t.Errorf("%+v: expected the second listener to bind the same port: %v", spec, err)
+			} else {
+				second.Close()
+			}
+		} else if err == nil {
+			second.Close()
+			t.Errorf("%+v: expected the second listener to fail without ReusePort", spec)
+		}
+		first.Close()
+	}
+}
+
+func TestListenIPv6(t *testing.T) {
+	testCases := []struct {
+		parentIP string
+		expected string
+	}{
+		{"", "0.0.0.0"},
+		{"::1", "::1"},
+		{"::ffff:127.0.0.1", "127.0.0.1"},
+		{"::", "::"},
+	}
+	for _, tc := range testCases {
+		for _, proto := range []string{"tcp", "udp"} {
+			spec := port.Spec{Proto: proto, ParentIP: tc.parentIP}
+			f, err := listen(spec)
+			if err != nil {
+				t.Fatalf("%+v: %v", spec, err)
+			}
+			var ip net.IP
+			switch a := boundAddr(t, proto, f).(type) {
+			case *net.TCPAddr:
+				ip = a.IP
+			case *net.UDPAddr:
+				ip = a.IP
+			}
+			f.Close()
+			if ip.String() != tc.expected {
+				t.Errorf("%+v: expected to be bound on %s, got %s", spec, tc.expected, ip)
+			}
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package builtin
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// sctpSocket creates a one-to-one style SCTP socket.
+// SCTP is not supported by the net package, so we use the raw syscalls.
+func sctpSocket() (int, error) {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, syscall.IPPROTO_SCTP)
+	if err != nil {
+		if err == syscall.EPROTONOSUPPORT || err == syscall.ESOCKTNOSUPPORT {
+			return -1, errors.New("SCTP is not supported on this host (is the sctp kernel module loaded?)")
+		}
+		return -1, errors.Wrap(err, "creating SCTP socket")
+	}
+	return fd, nil
+}
+
+func listenSCTP(ip net.IP, port int, reusePort bool) (*os.File, error) {
+	fd, err := sctpSocket()
+	if err != nil {
+		return nil, err
+	}
+	sa := &syscall.SockaddrInet4{Port: port}
+	copy(sa.Addr[:], ip.To4())
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	if reusePort {
+		if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEPORT, 1); err != nil {
+			syscall.Close(fd)
+			return nil, errors.Wrap(err, "setting SO_REUSEPORT")
+		}
+	}
+	if err := syscall.Bind(fd, sa); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	if err := syscall.Listen(fd, syscall.SOMAXCONN); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	return os.NewFile(uintptr(fd), "sctp"), nil
+}
+
+func dialSCTP(ip net.IP, port int) (*sctpConn, error) {
+	fd, err := sctpSocket()
+	if err != nil {
+		return nil, err
+	}
+	sa := &syscall.SockaddrInet4{Port: port}
+	copy(sa.Addr[:], ip.To4())
+	if err := syscall.Connect(fd, sa); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	return newSCTPConn(fd)
+}
+
+// sctpConn is an SCTP association.
+// The fd is registered to the runtime poller, so that Close interrupts blocking Read and Write.
+type sctpConn struct {
+	*os.File
+}
+
+func newSCTPConn(fd int) (*sctpConn, error) {
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	return &sctpConn{File: os.NewFile(uintptr(fd), "sctp")}, nil
+}
+
+func (c *sctpConn) CloseWrite() error {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var shutdownErr error
+	if err := rc.Control(func(fd uintptr) {
+		shutdownErr = syscall.Shutdown(int(fd), syscall.SHUT_WR)
+	}); err != nil {
+		return err
+	}
+	return shutdownErr
+}
+
+// sctpForwarder forwards the associations accepted on the host-side listener
+// to the child port.
+type sctpForwarder struct {
+	forwarderState
+	l         *os.File
+	childIP   net.IP
+	childPort int
+	logWriter io.Writer
+	wg        sync.WaitGroup
+	connsMu   sync.Mutex
+	conns     map[io.Closer]struct{}
+}
+
+func newSCTPForwarder(f *os.File, childIP net.IP, childPort int, logWriter io.Writer) (*sctpForwarder, error) {
+	// dup, as f is closed by the caller
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		return nil, err
+	}
+	syscall.CloseOnExec(fd)
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	fw := &sctpForwarder{
+		l:         os.NewFile(uintptr(fd), "sctp"),
+		childIP:   childIP,
+		childPort: childPort,
+		logWriter: logWriter,
+		conns:     make(map[io.Closer]struct{}),
+	}
+	fw.wg.Add(1)
+	go fw.serve()
+	return fw, nil
+}
+
+func (fw *sctpForwarder) accept() (*sctpConn, error) {
+	rc, err := fw.l.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var (
+		nfd       int
+		acceptErr error
+	)
+	if err := rc.Read(func(fd uintptr) bool {
+		nfd, _, acceptErr = syscall.Accept4(int(fd), syscall.SOCK_CLOEXEC)
+		return acceptErr != syscall.EAGAIN
+	}); err != nil {
+		return nil, err
+	}
+	if acceptErr != nil {
+		return nil, acceptErr
+	}
+	return newSCTPConn(nfd)
+}
+
+func (fw *sctpForwarder) serve() {
+	defer fw.wg.Done()
+	for {
+		hc, err := fw.accept()
+		if err != nil {
+			fw.fail(err)
+			return
+		}
+		fw.wg.Add(1)
+		go fw.handle(hc)
+	}
+}
+
+func (fw *sctpForwarder) track(c io.Closer, add bool) {
+	fw.connsMu.Lock()
+	if add {
+		fw.conns[c] = struct{}{}
+	} else {
+		delete(fw.conns, c)
+	}
+	fw.connsMu.Unlock()
+}
+
+func (fw *sctpForwarder) handle(hc *sctpConn) {
+	defer fw.wg.Done()
+	defer hc.Close()
+	fw.track(hc, true)
+	defer fw.track(hc, false)
+	cc, err := dialSCTP(fw.childIP, fw.childPort)
+	if err != nil {
+		fmt.Fprintf(fw.logWriter, "[builtin] failed to connect to %s:%d/sctp: %v\n", fw.childIP, fw.childPort, err)
+		return
+	}
+	defer cc.Close()
+	fw.track(cc, true)
+	defer fw.track(cc, false)
+	fw.splice(hc, cc)
+}
+
+// Close stops accepting new associations and closes the active ones.
+func (fw *sctpForwarder) Close() error {
+	err := fw.l.Close()
+	fw.connsMu.Lock()
+	for c := range fw.conns {
+		c.Close()
+	}
+	fw.connsMu.Unlock()
+	fw.wg.Wait()
+	return err
+}
@@ -0,0 +1,134 @@
+package port
+
+import (
+	"context"
+	"net"
+	"os"
+)
+
+type Spec struct {
+	Proto      string `json:"proto,omitempty"`    // "tcp", "udp", or "sctp". "sctp" is not supported by all the drivers.
+	ParentIP   string `json:"parentIP,omitempty"` // IPv4 or IPv6 address. can be empty (0.0.0.0). "::" is dual-stack. IPv6 is not supported by all the drivers.
+	ParentPort int    `json:"parentPort,omitempty"`
+	ChildPort  int    `json:"childPort,omitempty"`
+	// ChildUnixSocket is the absolute path of the UNIX socket in the child namespaces,
+	// used instead of ChildPort. Only for "tcp". Not supported by all the drivers.
+	ChildUnixSocket string `json:"childUnixSocket,omitempty"`
+	// MaxConnections is the maximum number of the connections forwarded at once.
+	// The connections beyond the limit are closed immediately. Zero means unlimited.
+	// Only for "tcp". Not supported by all the drivers.
+	MaxConnections int `json:"maxConnections,omitempty"`
+	// MaxAcceptRate is the maximum number of the connections accepted per second.
+	// The connections beyond the rate are delayed. Zero means unlimited.
+	// Only for "tcp". Not supported by all the drivers.
+	MaxAcceptRate int `json:"maxAcceptRate,omitempty"`
+	// ReusePort sets SO_REUSEPORT on the host-side socket, so that another process of the same user
+	// can bind the same ParentIP and ParentPort, e.g. a new RootlessKit replacing the old one without downtime.
+	// The kernel distributes the incoming connections among all the sockets bound with SO_REUSEPORT.
+	// Not supported by all the drivers.
+	ReusePort bool `json:"reusePort,omitempty"`
+	// Mark sets SO_MARK on the child-side sockets, e.g. for the policy routing with common.RuleMessage.
+	// The host-side sockets are not marked, as SO_MARK needs CAP_NET_ADMIN in the initial user namespace.
+	// Zero means no mark. Only for "tcp" and "udp". Not supported by all the drivers.
+	Mark int `json:"mark,omitempty"`
+	// TCPOpt is applied to both ends of the forwarded TCP connections.
+	// Not supported by all the drivers.
+	TCPOpt *TCPOpt `json:"tcpOpt,omitempty"`
+	// IdleTimeout is the duration in seconds to close the forwarded connections without traffic in either direction.
+	// Zero means no timeout for "tcp", and 60 seconds for "udp".
+	// Only for "tcp" and "udp". Not supported by all the drivers.
+	IdleTimeout int `json:"idleTimeout,omitempty"`
+}
+
+// TCPOpt is the socket options for the forwarded TCP connections.
+// Zero values keep the defaults of the driver.
+type TCPOpt struct {
+	// KeepAlivePeriod is the keepalive period in seconds.
+	// Negative values disable SO_KEEPALIVE.
+	KeepAlivePeriod int `json:"keepAlivePeriod,omitempty"`
+	// ReadBuffer and WriteBuffer are SO_RCVBUF and SO_SNDBUF in bytes.
+	ReadBuffer  int `json:"readBuffer,omitempty"`
+	WriteBuffer int `json:"writeBuffer,omitempty"`
+}
+
+type Status struct {
+	ID   int  `json:"id"`
+	Spec Spec `json:"spec"`
+	// Error is set when the port is no longer being forwarded due to an error.
+	// Not all the drivers report the error.
+	Error string `json:"error,omitempty"`
+	// Stats is set by the drivers that forward the connections by themselves.
+	Stats *Stats `json:"stats,omitempty"`
+}
+
+// Stats are the counters of a port. The counters except ActiveConns never decrease.
+type Stats struct {
+	// ActiveConns is the number of the connections being forwarded.
+	// For UDP, the number of the client addresses that sent a datagram recently.
+	ActiveConns int64 `json:"activeConns"`
+	TotalConns  int64 `json:"totalConns"`
+	// RejectedConns is the number of the connections rejected due to Spec.MaxConnections.
+	RejectedConns int64 `json:"rejectedConns"`
+	// BytesIn is the number of the bytes forwarded from the host to the child.
+	BytesIn int64 `json:"bytesIn"`
+	// BytesOut is the number of the bytes forwarded from the child to the host.
+	BytesOut int64 `json:"bytesOut"`
+	// IdleClosedConns is the number of the connections closed due to Spec.IdleTimeout.
+	// For UDP, including the ones closed due to the default timeout.
+	IdleClosedConns int64 `json:"idleClosedConns"`
+}
+
+// Manager MUST be thread-safe.
+type Manager interface {
+	AddPort(ctx context.Context, spec Spec) (*Status, error)
+	ListPorts(ctx context.Context) ([]Status, error)
+	RemovePort(ctx context.Context, id int) error
+}
+
+// ChildContext is used for RunParentDriver
+type ChildContext struct {
+	// PID of the child, can be used for ns-entering to the child namespaces.
+	PID int
+	// IP is the IPv4 address of the primary interface of the child after the setup,
+	// or 127.0.0.1 when the interface has no IPv4 address.
+	IP net.IP
+}
+
+// ParentDriver is a driver for the parent process.
+type ParentDriver interface {
+	Manager
+	// OpaqueForChild typically consists of socket path
+	// for controlling child from parent
+	OpaqueForChild() map[string]string
+	// RunParentDriver signals initComplete when ParentDriver is ready to
+	// serve as Manager.
+	// RunParentDriver blocks until quit is signaled.
+	//
+	// ChildContext is optional.
+	RunParentDriver(initComplete chan struct{}, quit <-chan struct{}, cctx *ChildContext) error
+}
+
+// ChildDriver is a driver for the child process.
+type ChildDriver interface {
+	// RunChildDriver is called in the child namespaces with the opaque map
+	// returned from ParentDriver.OpaqueForChild.
+	// Drivers that forward the connections in the child dispatch them by Spec.Proto.
+	//
+	// RunChildDriver blocks until quit is signaled, and then tears down
+	// all the forwarding, regardless of the proto.
+	RunChildDriver(opaque map[string]string, quit <-chan struct{}) error
+}
+
+// ChildManager is optionally implemented by ChildDriver, for publishing and
+// unpublishing ports while RunChildDriver is running.
+// ChildManager MUST be thread-safe.
+type ChildManager interface {
+	// AddPort starts forwarding the connections on the host-side socket f
+	// to spec.ChildPort. id is assigned by the parent.
+	// f is still owned by the caller.
+	AddPort(ctx context.Context, id int, spec Spec, f *os.File) error
+	// ListPorts returns the active ports, with the error state.
+	ListPorts(ctx context.Context) ([]Status, error)
+	// RemovePort stops forwarding immediately and closes the host-side socket.
+	RemovePort(ctx context.Context, id int) error
+}
@@ -0,0 +1,137 @@
+package portutil
+
+import (
+	"net"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/rancher/k3s/pkg/rootlesskit/port"
+)
+
+// ParsePortSpec parses a Docker-like representation of PortSpec.
+// e.g. "127.0.0.1:8080:80/tcp", "[::1]:8080:80/tcp"
+// IPv6 addresses need to be enclosed in brackets.
+func ParsePortSpec(s string) (*port.Spec, error) {
+	r := regexp.MustCompile("^([0-9a-f\\.]+|\\[[0-9a-fA-F:\\.]+\\]):([0-9]+):([0-9]+)/([a-z]+)$")
+	g := r.FindStringSubmatch(s)
+	if len(g) != 5 {
+		return nil, errors.Errorf("unexpected PortSpec string: %q", s)
+	}
+	parentIP := strings.TrimSuffix(strings.TrimPrefix(g[1], "["), "]")
+	parentPort, err := strconv.Atoi(g[2])
+	if err != nil {
+		return nil, errors.Wrapf(err, "unexpected ParentPort in PortSpec string: %q", s)
+	}
+	childPort, err := strconv.Atoi(g[3])
+	if err != nil {
+		return nil, errors.Wrapf(err, "unexpected ChildPort in PortSpec string: %q", s)
+	}
+	proto := g[4]
+	// validation is up to the caller (as json.Unmarshal doesn't validate values)
+	return &port.Spec{
+		Proto:      proto,
+		ParentIP:   parentIP,
+		ParentPort: parentPort,
+		ChildPort:  childPort,
+	}, nil
+}
+
+// ValidatePortSpec validates *port.Spec.
+// existingPorts can be optionally passed for detecting conflicts.
+func ValidatePortSpec(spec port.Spec, existingPorts map[int]*port.Status) error {
+	if spec.Proto != "tcp" && spec.Proto != "udp" && spec.Proto != "sctp" {
+		return errors.Errorf("unknown proto: %q", spec.Proto)
+	}
+	if spec.ParentIP != "" {
+		if net.ParseIP(spec.ParentIP) == nil {
+			return errors.Errorf("invalid ParentIP: %q", spec.ParentIP)
+		}
+	}
+	if spec.ParentPort <= 0 || spec.ParentPort > 65535 {
+		return errors.Errorf("invalid ParentPort: %d", spec.ParentPort)
+	}
+	if spec.ChildUnixSocket != "" {
+		if spec.Proto != "tcp" {
+			return errors.Errorf("ChildUnixSocket is not applicable to proto %q", spec.Proto)
+		}
+		if !filepath.IsAbs(spec.ChildUnixSocket) {
+			return errors.Errorf("ChildUnixSocket needs to be an absolute path: %q", spec.ChildUnixSocket)
+		}
+		if spec.ChildPort != 0 {
+			return errors.Errorf("ChildPort cannot be set with ChildUnixSocket: %d", spec.ChildPort)
+		}
+	} else if spec.ChildPort <= 0 || spec.ChildPort > 65535 {
+		return errors.Errorf("invalid ChildPort: %d", spec.ChildPort)
+	}
+	if spec.MaxConnections != 0 || spec.MaxAcceptRate != 0 {
+		if spec.Proto != "tcp" {
+			return errors.Errorf("MaxConnections and MaxAcceptRate are not applicable to proto %q", spec.Proto)
+		}
+		if spec.MaxConnections < 0 || spec.MaxAcceptRate < 0 {
+			return errors.Errorf("invalid MaxConnections (%d) or MaxAcceptRate (%d)", spec.MaxConnections, spec.MaxAcceptRate)
+		}
+	}
+	if spec.Mark != 0 {
+		if spec.Proto != "tcp" && spec.Proto != "udp" {
+			return errors.Errorf("Mark is not applicable to proto %q", spec.Proto)
+		}
+		if spec.ChildUnixSocket != "" {
+			return errors.New("Mark cannot be set with ChildUnixSocket")
+		}
+		if spec.Mark < 0 {
+			return errors.Errorf("invalid Mark: %d", spec.Mark)
+		}
+	}
+	if spec.IdleTimeout != 0 {
+		if spec.Proto != "tcp" && spec.Proto != "udp" {
+			return errors.Errorf("IdleTimeout is not applicable to proto %q", spec.Proto)
+		}
+		if spec.IdleTimeout < 0 {
+			return errors.Errorf("invalid IdleTimeout: %d", spec.IdleTimeout)
+		}
+	}
+	if o := spec.TCPOpt; o != nil {
+		if spec.Proto != "tcp" {
+			return errors.Errorf("TCPOpt is not applicable to proto %q", spec.Proto)
+		}
+		if o.ReadBuffer < 0 || o.WriteBuffer < 0 {
+			return errors.Errorf("invalid buffer size in TCPOpt: %+v", *o)
+		}
+	}
+	for id, p := range existingPorts {
+		sp := p.Spec
+		sameProto := sp.Proto == spec.Proto
+		sameParent := sameParentIP(sp.ParentIP, spec.ParentIP) && sp.ParentPort == spec.ParentPort
+		sameChild := sp.ChildPort == spec.ChildPort && sp.ChildUnixSocket == spec.ChildUnixSocket
+		if sameProto && (sameParent || sameChild) {
+			return errors.Errorf("conflict with ID %d (%+v)", id, sp)
+		}
+	}
+	return nil
+}
+
+// sameParentIP returns true if the listeners on a and b conflict.
+// Empty ParentIP binds on all the IPv4 addresses, as well as "0.0.0.0".
+// "::" binds on all the IPv4 and IPv6 addresses.
+// IPv4-mapped IPv6 addresses are regarded as IPv4 addresses.
+func sameParentIP(a, b string) bool {
+	ipA, ipB := parseParentIP(a), parseParentIP(b)
+	if ipA.Equal(net.IPv6unspecified) || ipB.Equal(net.IPv6unspecified) {
+		return true
+	}
+	if (ipA.To4() == nil) != (ipB.To4() == nil) {
+		return false
+	}
+	return ipA.IsUnspecified() || ipB.IsUnspecified() || ipA.Equal(ipB)
+}
+
+func parseParentIP(s string) net.IP {
+	if s == "" {
+		return net.IPv4zero
+	}
+	return net.ParseIP(s)
+}
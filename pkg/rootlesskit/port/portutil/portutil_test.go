@@ -0,0 +1,226 @@
+package portutil
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/rancher/k3s/pkg/rootlesskit/port"
+)
+
+func TestValidatePortSpec(t *testing.T) {
+	testCases := []struct {
+		name    string
+		spec    port.Spec
+		wantErr bool
+	}{
+		{
+			name: "tcp",
+			spec: port.Spec{Proto: "tcp", ParentIP: "127.0.0.1", ParentPort: 8080, ChildPort: 80},
+		},
+		{
+			name:    "unknown proto",
+			spec:    port.Spec{Proto: "icmp", ParentPort: 8080, ChildPort: 80},
+			wantErr: true,
+		},
+		{
+			name:    "invalid ParentPort",
+			spec:    port.Spec{Proto: "tcp", ParentPort: 65536, ChildPort: 80},
+			wantErr: true,
+		},
+		{
+			name: "IPv6",
+			spec: port.Spec{Proto: "tcp", ParentIP: "::1", ParentPort: 8080, ChildPort: 80},
+		},
+		{
+			name: "IPv4-mapped IPv6",
+			spec: port.Spec{Proto: "udp", ParentIP: "::ffff:127.0.0.1", ParentPort: 8080, ChildPort: 80},
+		},
+		{
+			name:    "bracketed IPv6",
+			spec:    port.Spec{Proto: "tcp", ParentIP: "[::1]", ParentPort: 8080, ChildPort: 80},
+			wantErr: true,
+		},
+		{
+			name: "TCPOpt",
+			spec: port.Spec{Proto: "tcp", ParentPort: 8080, ChildPort: 80, TCPOpt: &port.TCPOpt{KeepAlivePeriod: 30, ReadBuffer: 65536, WriteBuffer: 65536}},
+		},
+		{
+			name: "TCPOpt disabling keepalive",
+			spec: port.Spec{Proto: "tcp", ParentPort: 8080, ChildPort: 80, TCPOpt: &port.TCPOpt{KeepAlivePeriod: -1}},
+		},
+		{
+			name:    "TCPOpt for udp",
+			spec:    port.Spec{Proto: "udp", ParentPort: 8080, ChildPort: 80, TCPOpt: &port.TCPOpt{KeepAlivePeriod: 30}},
+			wantErr: true,
+		},
+		{
+			name:    "TCPOpt with negative buffer",
+			spec:    port.Spec{Proto: "tcp", ParentPort: 8080, ChildPort: 80, TCPOpt: &port.TCPOpt{ReadBuffer: -1}},
+			wantErr: true,
+		},
+		{
+			name: "MaxConnections and MaxAcceptRate",
+			spec: port.Spec{Proto: "tcp", ParentPort: 8080, ChildPort: 80, MaxConnections: 10, MaxAcceptRate: 5},
+		},
+		{
+			name:    "MaxConnections for udp",
+			spec:    port.Spec{Proto: "udp", ParentPort: 8080, ChildPort: 80, MaxConnections: 10},
+			wantErr: true,
+		},
+		{
+			name:    "negative MaxAcceptRate",
+			spec:    port.Spec{Proto: "tcp", ParentPort: 8080, ChildPort: 80, MaxAcceptRate: -1},
+			wantErr: true,
+		},
+		{
+			name: "Mark for udp",
+			spec: port.Spec{Proto: "udp", ParentPort: 8080, ChildPort: 80, Mark: 42},
+		},
+		{
+			name:    "Mark for sctp",
+			spec:    port.Spec{Proto: "sctp", ParentPort: 8080, ChildPort: 80, Mark: 42},
+			wantErr: true,
+		},
+		{
+			name:    "Mark with ChildUnixSocket",
+			spec:    port.Spec{Proto: "tcp", ParentPort: 8080, ChildUnixSocket: "/run/app.sock", Mark: 42},
+			wantErr: true,
+		},
+		{
+			name:    "negative Mark",
+			spec:    port.Spec{Proto: "tcp", ParentPort: 8080, ChildPort: 80, Mark: -1},
+			wantErr: true,
+		},
+		{
+			name: "IdleTimeout for udp",
+			spec: port.Spec{Proto: "udp", ParentPort: 8080, ChildPort: 80, IdleTimeout: 30},
+		},
+		{
+			name:    "IdleTimeout for sctp",
+			spec:    port.Spec{Proto: "sctp", ParentPort: 8080, ChildPort: 80, IdleTimeout: 30},
+			wantErr: true,
+		},
+		{
+			name:    "negative IdleTimeout",
+			spec:    port.Spec{Proto: "tcp", ParentPort: 8080, ChildPort: 80, IdleTimeout: -1},
+			wantErr: true,
+		},
+		{
+			name: "ChildUnixSocket",
+			spec: port.Spec{Proto: "tcp", ParentPort: 8080, ChildUnixSocket: "/run/app.sock"},
+		},
+		{
+			name:    "relative ChildUnixSocket",
+			spec:    port.Spec{Proto: "tcp", ParentPort: 8080, ChildUnixSocket: "app.sock"},
+			wantErr: true,
+		},
+		{
+			name:    "ChildUnixSocket with ChildPort",
+			spec:    port.Spec{Proto: "tcp", ParentPort: 8080, ChildPort: 80, ChildUnixSocket: "/run/app.sock"},
+			wantErr: true,
+		},
+		{
+			name:    "ChildUnixSocket for udp",
+			spec:    port.Spec{Proto: "udp", ParentPort: 8080, ChildUnixSocket: "/run/app.sock"},
+			wantErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := ValidatePortSpec(tc.spec, nil)
+			if tc.wantErr && err == nil {
+				t.Fatalf("expected an error for %+v", tc.spec)
+			}
+			if !tc.wantErr && err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestSameParentIP(t *testing.T) {
+	testCases := []struct {
+		a, b     string
+		expected bool
+	}{
+		{"", "0.0.0.0", true},
+		{"", "127.0.0.1", true},
+		{"127.0.0.1", "::ffff:127.0.0.1", true},
+		{"127.0.0.1", "127.0.0.2", false},
+		{"::", "127.0.0.1", true},
+		{"::", "::1", true},
+		{"", "::1", false},
+		{"::1", "127.0.0.1", false},
+		{"::1", "::1", true},
+		{"::1", "::2", false},
+	}
+	for _, tc := range testCases {
+		if got := sameParentIP(tc.a, tc.b); got != tc.expected {
+			t.Errorf("sameParentIP(%q, %q): expected %v, got %v", tc.a, tc.b, tc.expected, got)
+		}
+	}
+}
+
+func TestValidatePortSpecConflict(t *testing.T) {
+	existing := map[int]*port.Status{
+		1: {ID: 1, Spec: port.Spec{Proto: "tcp", ParentIP: "127.0.0.1", ParentPort: 8080, ChildPort: 80}},
+	}
+	testCases := []struct {
+		name    string
+		spec    port.Spec
+		wantErr bool
+	}{
+		{name: "same parent", spec: port.Spec{Proto: "tcp", ParentPort: 8080, ChildPort: 81}, wantErr: true},
+		{name: "same child", spec: port.Spec{Proto: "tcp", ParentPort: 8081, ChildPort: 80}, wantErr: true},
+		{name: "dual-stack parent", spec: port.Spec{Proto: "tcp", ParentIP: "::", ParentPort: 8080, ChildPort: 81}, wantErr: true},
+		{name: "IPv6 parent", spec: port.Spec{Proto: "tcp", ParentIP: "::1", ParentPort: 8080, ChildPort: 81}},
+		{name: "other proto", spec: port.Spec{Proto: "udp", ParentPort: 8080, ChildPort: 80}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := ValidatePortSpec(tc.spec, existing)
+			if tc.wantErr && err == nil {
+				t.Fatalf("expected a conflict for %+v", tc.spec)
+			}
+			if !tc.wantErr && err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestParsePortSpec(t *testing.T) {
+	testCases := []struct {
+		s        string
+		expected *port.Spec
+	}{
+		{"127.0.0.1:8080:80/tcp", &port.Spec{Proto: "tcp", ParentIP: "127.0.0.1", ParentPort: 8080, ChildPort: 80}},
+		{"0.0.0.0:53:53/udp", &port.Spec{Proto: "udp", ParentIP: "0.0.0.0", ParentPort: 53, ChildPort: 53}},
+		{"[::1]:8080:80/tcp", &port.Spec{Proto: "tcp", ParentIP: "::1", ParentPort: 8080, ChildPort: 80}},
+		{"[::]:8080:80/tcp", &port.Spec{Proto: "tcp", ParentIP: "::", ParentPort: 8080, ChildPort: 80}},
+		{"[::ffff:127.0.0.1]:8080:80/tcp", &port.Spec{Proto: "tcp", ParentIP: "::ffff:127.0.0.1", ParentPort: 8080, ChildPort: 80}},
+		{"::1:8080:80/tcp", nil},
+		{"[::1:8080:80/tcp", nil},
+		{"8080:80/tcp", nil},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.s, func(t *testing.T) {
+			got, err := ParsePortSpec(tc.s)
+			if tc.expected == nil {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.expected) {
+				t.Fatalf("expected %+v, got %+v", tc.expected, got)
+			}
+			if err := ValidatePortSpec(*got, nil); err != nil {
+				t.Fatalf("expected the parsed spec to be valid: %v", err)
+			}
+		})
+	}
+}
@@ -13,8 +13,8 @@ import (
 
 	"github.com/pkg/errors"
 
-	"github.com/rootless-containers/rootlesskit/pkg/port"
-	"github.com/rootless-containers/rootlesskit/pkg/port/portutil"
+	"github.com/rancher/k3s/pkg/rootlesskit/port"
+	"github.com/rancher/k3s/pkg/rootlesskit/port/portutil"
 )
 
 func NewParentDriver(logWriter io.Writer) (port.ParentDriver, error) {
@@ -67,6 +67,24 @@ func (d *driver) AddPort(ctx context.Context, spec port.Spec) (*port.Status, err
 	if err != nil {
 		return nil, err
 	}
+	if spec.TCPOpt != nil {
+		return nil, errors.New("TCPOpt is not supported by the socat driver")
+	}
+	if spec.ChildUnixSocket != "" {
+		return nil, errors.New("ChildUnixSocket is not supported by the socat driver")
+	}
+	if spec.MaxConnections != 0 || spec.MaxAcceptRate != 0 {
+		return nil, errors.New("MaxConnections and MaxAcceptRate are not supported by the socat driver")
+	}
+	if spec.ReusePort {
+		return nil, errors.New("ReusePort is not supported by the socat driver")
+	}
+	if spec.Mark != 0 {
+		return nil, errors.New("Mark is not supported by the socat driver")
+	}
+	if spec.IdleTimeout != 0 {
+		return nil, errors.New("IdleTimeout is not supported by the socat driver")
+	}
 	cf := func() (*exec.Cmd, error) {
 		return createSocatCmd(ctx, spec, d.logWriter, d.childPID)
 	}
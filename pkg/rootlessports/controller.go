@@ -5,9 +5,9 @@ import (
 	"time"
 
 	"github.com/rancher/k3s/pkg/rootless"
+	"github.com/rancher/k3s/pkg/rootlesskit/api/client"
+	"github.com/rancher/k3s/pkg/rootlesskit/port"
 	coreClients "github.com/rancher/k3s/types/apis/core/v1"
-	"github.com/rootless-containers/rootlesskit/pkg/api/client"
-	"github.com/rootless-containers/rootlesskit/pkg/port"
 	"github.com/sirupsen/logrus"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/labels"